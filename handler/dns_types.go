@@ -2,10 +2,12 @@ package handler
 
 import (
 	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"net"
+	"strings"
 )
 
 type RRSets struct {
@@ -13,12 +15,21 @@ type RRSets struct {
 	AAAA  IP_RRSet      `json:"aaaa,omitempty"`
 	TXT   TXT_RRSet     `json:"txt,omitempty"`
 	CNAME *CNAME_RRSet  `json:"cname,omitempty"`
+	DNAME *DNAME_RRSet  `json:"dname,omitempty"`
 	NS    NS_RRSet      `json:"ns,omitempty"`
 	MX    MX_RRSet      `json:"mx,omitempty"`
 	SRV   SRV_RRSet     `json:"srv,omitempty"`
 	CAA   CAA_RRSet     `json:"caa,omitempty"`
 	PTR   *PTR_RRSet    `json:"ptr,omitempty"`
 	TLSA  TLSA_RRSet    `json:"tlsa,omitempty"`
+	SSHFP SSHFP_RRSet   `json:"sshfp,omitempty"`
+	NAPTR NAPTR_RRSet   `json:"naptr,omitempty"`
+	DS    DS_RRSet      `json:"ds,omitempty"`
+	HINFO HINFO_RRSet   `json:"hinfo,omitempty"`
+	LOC   LOC_RRSet     `json:"loc,omitempty"`
+	URI   URI_RRSet     `json:"uri,omitempty"`
+	SVCB  SVCB_RRSet    `json:"svcb,omitempty"`
+	HTTPS SVCB_RRSet    `json:"https,omitempty"`
 	ANAME *ANAME_Record `json:"aname,omitempty"`
 }
 
@@ -29,26 +40,54 @@ type Record struct {
 }
 
 type ZoneKey struct {
-	DnsKey        *dns.DNSKEY
-	PrivateKey    crypto.PrivateKey
-	KeyInception  uint32
-	KeyExpiration uint32
+	DnsKey     *dns.DNSKEY
+	PrivateKey crypto.PrivateKey
 }
 
 type ZoneConfig struct {
-	DomainId        string     `json:"domain_id,omitempty"`
-	SOA             *SOA_RRSet `json:"soa,omitempty"`
-	DnsSec          bool       `json:"dnssec,omitempty"`
-	CnameFlattening bool       `json:"cname_flattening,omitempty"`
+	DomainId         string          `json:"domain_id,omitempty"`
+	SOA              *SOA_RRSet      `json:"soa,omitempty"`
+	DnsSec           bool            `json:"dnssec,omitempty"`
+	CnameFlattening  bool            `json:"cname_flattening,omitempty"`
+	Transfer         TransferConfig  `json:"transfer,omitempty"`
+	Notify           NotifyConfig    `json:"notify,omitempty"`
+	Update           UpdateConfig    `json:"update,omitempty"`
+	NSEC3            *NSEC3Config    `json:"nsec3,omitempty"`
+	CdsDelete        bool            `json:"cds_delete,omitempty"`
+	Signature        SignatureConfig `json:"signature,omitempty"`
+	MinimalResponses bool            `json:"minimal_responses,omitempty"`
+}
+
+type NSEC3Config struct {
+	Salt       string `json:"salt,omitempty"`
+	Iterations uint16 `json:"iterations,omitempty"`
+	OptOut     bool   `json:"opt_out,omitempty"`
+}
+
+type SignatureConfig struct {
+	Validity int `json:"validity,omitempty"`
+	Refresh  int `json:"refresh,omitempty"`
+	Jitter   int `json:"jitter,omitempty"`
+}
+
+type TransferConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+type NotifyConfig struct {
+	Targets []string `json:"targets,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
 }
 
 type Zone struct {
-	Name          string
-	Config        ZoneConfig
-	Locations     map[string]struct{}
-	ZSK           *ZoneKey
-	KSK           *ZoneKey
-	DnsKeySig     dns.RR
+	Name      string
+	Config    ZoneConfig
+	Locations map[string]struct{}
+	ZSK       *ZoneKey
+	KSK       *ZoneKey
+	KSKs      []*ZoneKey
+	DnsKeys   []dns.RR
 }
 
 type IP_RRSet struct {
@@ -138,6 +177,11 @@ type CNAME_RRSet struct {
 	Ttl  uint32 `json:"ttl,omitempty"`
 }
 
+type DNAME_RRSet struct {
+	Target string `json:"target"`
+	Ttl    uint32 `json:"ttl,omitempty"`
+}
+
 type TXT_RRSet struct {
 	Ttl  uint32   `json:"ttl,omitempty"`
 	Data []TXT_RR `json:"records,omitempty"`
@@ -206,6 +250,180 @@ type TLSA_RR struct {
 	Certificate  string `json:"certificate"`
 }
 
+type SSHFP_RRSet struct {
+	Ttl  uint32     `json:"ttl,omitempty"`
+	Data []SSHFP_RR `json:"records,omitempty"`
+}
+
+type SSHFP_RR struct {
+	Algorithm   uint8  `json:"algorithm"`
+	Type        uint8  `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type NAPTR_RRSet struct {
+	Ttl  uint32     `json:"ttl,omitempty"`
+	Data []NAPTR_RR `json:"records,omitempty"`
+}
+
+type NAPTR_RR struct {
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags"`
+	Service     string `json:"service"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+}
+
+type DS_RRSet struct {
+	Ttl  uint32  `json:"ttl,omitempty"`
+	Data []DS_RR `json:"records,omitempty"`
+}
+
+type DS_RR struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+}
+
+type HINFO_RRSet struct {
+	Ttl  uint32     `json:"ttl,omitempty"`
+	Data []HINFO_RR `json:"records,omitempty"`
+}
+
+type HINFO_RR struct {
+	Cpu string `json:"cpu"`
+	Os  string `json:"os"`
+}
+
+type LOC_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []LOC_RR `json:"records,omitempty"`
+}
+
+// LOC_RR coordinates are in degrees, altitude and precisions in meters (RFC 1876)
+type LOC_RR struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  float64  `json:"altitude"`
+	Size      *float64 `json:"size,omitempty"`
+	HorizPre  *float64 `json:"horiz_pre,omitempty"`
+	VertPre   *float64 `json:"vert_pre,omitempty"`
+}
+
+type URI_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []URI_RR `json:"records,omitempty"`
+}
+
+type URI_RR struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target"`
+}
+
+// SVCB_RRSet is used for both SVCB and HTTPS records (RFC 9460), with auto_hints ipv4hint and ipv6hint
+// of ServiceMode records targeting the owner name are filled from location's A and AAAA records
+type SVCB_RRSet struct {
+	Ttl       uint32    `json:"ttl,omitempty"`
+	AutoHints bool      `json:"auto_hints,omitempty"`
+	Data      []SVCB_RR `json:"records,omitempty"`
+}
+
+// SVCB_RR is in AliasMode if priority is 0, params are ignored in this mode
+type SVCB_RR struct {
+	Priority      uint16   `json:"priority"`
+	Target        string   `json:"target"`
+	Mandatory     []string `json:"mandatory,omitempty"`
+	Alpn          []string `json:"alpn,omitempty"`
+	NoDefaultAlpn bool     `json:"no_default_alpn,omitempty"`
+	Port          uint16   `json:"port,omitempty"`
+	Ipv4Hint      []net.IP `json:"ipv4hint,omitempty"`
+	Ipv6Hint      []net.IP `json:"ipv6hint,omitempty"`
+	Ech           string   `json:"ech,omitempty"` // base64 encoded ECHConfigList
+}
+
+var svcbKeys = map[string]dns.SVCBKey{
+	"mandatory":       dns.SVCB_MANDATORY,
+	"alpn":            dns.SVCB_ALPN,
+	"no-default-alpn": dns.SVCB_NO_DEFAULT_ALPN,
+	"port":            dns.SVCB_PORT,
+	"ipv4hint":        dns.SVCB_IPV4HINT,
+	"ech":             dns.SVCB_ECHCONFIG,
+	"ipv6hint":        dns.SVCB_IPV6HINT,
+}
+
+// svcbRR converts rr to SVCB record without header, params are added in key order
+func svcbRR(rr SVCB_RR) (*dns.SVCB, error) {
+	svcb := &dns.SVCB{Priority: rr.Priority, Target: dns.Fqdn(rr.Target)}
+	if rr.Priority == 0 {
+		return svcb, nil
+	}
+	if len(rr.Mandatory) > 0 {
+		mandatory := &dns.SVCBMandatory{}
+		for _, name := range rr.Mandatory {
+			key, ok := svcbKeys[name]
+			if !ok || key == dns.SVCB_MANDATORY {
+				return nil, errors.Errorf("invalid mandatory key %s", name)
+			}
+			mandatory.Code = append(mandatory.Code, key)
+		}
+		svcb.Value = append(svcb.Value, mandatory)
+	}
+	if len(rr.Alpn) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: rr.Alpn})
+	}
+	if rr.NoDefaultAlpn {
+		svcb.Value = append(svcb.Value, &dns.SVCBNoDefaultAlpn{})
+	}
+	if rr.Port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: rr.Port})
+	}
+	if len(rr.Ipv4Hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: rr.Ipv4Hint})
+	}
+	if rr.Ech != "" {
+		ech, err := base64.StdEncoding.DecodeString(rr.Ech)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ech")
+		}
+		svcb.Value = append(svcb.Value, &dns.SVCBECHConfig{ECH: ech})
+	}
+	if len(rr.Ipv6Hint) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: rr.Ipv6Hint})
+	}
+	return svcb, nil
+}
+
+// svcbData converts svcb to json storage format, false is returned for params not supported
+func svcbData(svcb *dns.SVCB) (SVCB_RR, bool) {
+	rr := SVCB_RR{Priority: svcb.Priority, Target: svcb.Target}
+	for _, kv := range svcb.Value {
+		switch v := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range v.Code {
+				rr.Mandatory = append(rr.Mandatory, key.String())
+			}
+		case *dns.SVCBAlpn:
+			rr.Alpn = v.Alpn
+		case *dns.SVCBNoDefaultAlpn:
+			rr.NoDefaultAlpn = true
+		case *dns.SVCBPort:
+			rr.Port = v.Port
+		case *dns.SVCBIPv4Hint:
+			rr.Ipv4Hint = v.Hint
+		case *dns.SVCBECHConfig:
+			rr.Ech = base64.StdEncoding.EncodeToString(v.ECH)
+		case *dns.SVCBIPv6Hint:
+			rr.Ipv6Hint = v.Hint
+		default:
+			return rr, false
+		}
+	}
+	return rr, true
+}
+
 type SOA_RRSet struct {
 	Ns      string   `json:"ns"`
 	MBox    string   `json:"MBox"`
@@ -218,6 +436,52 @@ type SOA_RRSet struct {
 	Serial  uint32   `json:"serial"`
 }
 
+// ANAME_Record serves records of its targets for types, A and AAAA if types is empty.
+// targets with lowest priority are tried first, targets with the same priority are chosen by weight
 type ANAME_Record struct {
-	Location string `json:"location,omitempty"`
+	Location string         `json:"location,omitempty"`
+	Targets  []ANAME_Target `json:"targets,omitempty"`
+	Types    []string       `json:"types,omitempty"`
+	Filter   IpFilterConfig `json:"filter,omitempty"`
+}
+
+type ANAME_Target struct {
+	Location string `json:"location"`
+	Weight   int    `json:"weight,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// anameTypes are record types an ANAME can serve
+var anameTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"CAA":   dns.TypeCAA,
+	"HTTPS": dns.TypeHTTPS,
+}
+
+// serves reports whether qtype records are taken from aname targets, aname may be nil
+func (aname *ANAME_Record) serves(qtype uint16) bool {
+	if aname == nil {
+		return false
+	}
+	if len(aname.Types) == 0 {
+		return qtype == dns.TypeA || qtype == dns.TypeAAAA
+	}
+	for _, t := range aname.Types {
+		if anameTypes[strings.ToUpper(t)] == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// targets returns location followed by targets
+func (aname *ANAME_Record) targets() []ANAME_Target {
+	var targets []ANAME_Target
+	if aname.Location != "" {
+		targets = append(targets, ANAME_Target{Location: aname.Location})
+	}
+	return append(targets, aname.Targets...)
 }
@@ -1,18 +1,37 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cloudflare/circl/sign/ed448"
 	"github.com/hawell/logger"
 	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
 )
 
 var (
 	NSecTypes = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
 )
 
+const defaultSignatureValidity = 8 * 24 * 3600
+
 type rrset struct {
 	qname string
 	qtype uint16
@@ -43,18 +62,40 @@ func splitSets(rrs []dns.RR) map[rrset][]dns.RR {
 	return nil
 }
 
-func Sign(rrs []dns.RR, qname string, record *Record) []dns.RR {
+// Sign adds RRSIGs to rrs, wildcards maps owners synthesized from a wildcard to the wildcard name
+func (h *DnsRequestHandler) Sign(rrs []dns.RR, qname string, record *Record, wildcards map[string]string) []dns.RR {
 	var res []dns.RR
+	var dnames []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			dnames = append(dnames, rr.Header().Name)
+		}
+	}
 	sets := splitSets(rrs)
 	for _, set := range sets {
 		res = append(res, set...)
+		if set[0].Header().Rrtype == dns.TypeCNAME && synthesized(set[0].Header().Name, dnames) {
+			// validators synthesize the cname from signed dname (RFC 6672 section 5.3.1)
+			continue
+		}
+		if source, ok := wildcards[set[0].Header().Name]; ok {
+			if rrsig := h.signWildcard(set, source, record.Zone); rrsig != nil {
+				res = append(res, rrsig)
+			}
+			continue
+		}
 		switch set[0].Header().Rrtype {
 		case dns.TypeRRSIG, dns.TypeOPT:
 			continue
-		case dns.TypeDNSKEY:
-			res = append(res, record.Zone.DnsKeySig)
+		case dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+			// signed by keys referenced in parent DS (RFC 7344 section 4.1)
+			for _, key := range record.Zone.KSKs {
+				if rrsig, err := h.signatures.Sign(set, key, record.Zone); err == nil {
+					res = append(res, rrsig)
+				}
+			}
 		default:
-			if rrsig, err := sign(set, qname, record.Zone.ZSK, set[0].Header().Ttl); err == nil {
+			if rrsig, err := h.signatures.Sign(set, record.Zone.ZSK, record.Zone); err == nil {
 				res = append(res, rrsig)
 			}
 		}
@@ -62,11 +103,127 @@ func Sign(rrs []dns.RR, qname string, record *Record) []dns.RR {
 	return res
 }
 
-func sign(rrs []dns.RR, name string, key *ZoneKey, ttl uint32) (*dns.RRSIG, error) {
+// synthesized checks if name is below one of dnames
+func synthesized(name string, dnames []string) bool {
+	for _, dname := range dnames {
+		if name != dname && dns.IsSubDomain(dname, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signWildcard signs set as its wildcard source so labels field lets validators reconstruct it (RFC 4035 section 5.3.2)
+func (h *DnsRequestHandler) signWildcard(set []dns.RR, source string, z *Zone) *dns.RRSIG {
+	owner := set[0].Header().Name
+	wildcard := make([]dns.RR, 0, len(set))
+	for _, rr := range set {
+		rr = dns.Copy(rr)
+		rr.Header().Name = source
+		wildcard = append(wildcard, rr)
+	}
+	rrsig, err := h.signatures.Sign(wildcard, z.ZSK, z)
+	if err != nil {
+		return nil
+	}
+	rrsig.Hdr.Name = owner
+	return rrsig
+}
+
+// wildcardSources returns owners of answers in zone z which are synthesized from a wildcard, mapped to the wildcard name
+func (h *DnsRequestHandler) wildcardSources(answers []dns.RR, z *Zone) map[string]string {
+	wildcards := make(map[string]string)
+	for _, rr := range answers {
+		owner := rr.Header().Name
+		if _, ok := wildcards[owner]; ok || !dns.IsSubDomain(z.Name, owner) {
+			continue
+		}
+		record, res := h.FetchRecord(owner, map[string]interface{}{})
+		if res == dns.RcodeSuccess && record.Name != owner && strings.HasPrefix(record.Name, "*.") {
+			wildcards[owner] = record.Name
+		}
+	}
+	return wildcards
+}
+
+// wildcardNextCloser returns ancestor of qname one label longer than wildcard's closest encloser
+func wildcardNextCloser(qname string, wildcard string) string {
+	labels := dns.CountLabel(wildcard)
+	indexes := dns.Split(qname)
+	return qname[indexes[len(indexes)-labels]:]
+}
+
+// SignatureCache keeps RRSIGs of rrsets until they should be refreshed
+type SignatureCache struct {
+	cache *cache.Cache
+}
+
+func NewSignatureCache() *SignatureCache {
+	return &SignatureCache{
+		cache: cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+}
+
+// Sign returns cached signature of rrs by key or creates a new one with zone's signature validity
+func (c *SignatureCache) Sign(rrs []dns.RR, key *ZoneKey, z *Zone) (*dns.RRSIG, error) {
+	// denial records are unique per query name, caching them lets random names fill the cache
+	rrtype := rrs[0].Header().Rrtype
+	cacheable := rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3
+	cacheKey := ""
+	ttl := rrs[0].Header().Ttl
+	if cacheable {
+		cacheKey = signatureCacheKey(rrs, key, z)
+		// signature covers the rrset served with lower ttls too, like upstream answers counting down
+		if cached, found := c.cache.Get(cacheKey); found && cached.(*dns.RRSIG).OrigTtl >= ttl {
+			rrsig := dns.Copy(cached.(*dns.RRSIG)).(*dns.RRSIG)
+			rrsig.Hdr.Ttl = ttl
+			return rrsig, nil
+		}
+	}
+
+	config := z.Config.Signature
+	now := time.Now()
+	expiration := now.Add(time.Duration(config.Validity) * time.Second)
+	if config.Jitter > 0 {
+		expiration = expiration.Add(-time.Duration(rand.Intn(config.Jitter+1)) * time.Second)
+	}
+	rrsig, err := sign(rrs, rrs[0].Header().Name, key, ttl, uint32(now.Add(-3*time.Hour).Unix()), uint32(expiration.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if refresh := expiration.Add(-time.Duration(config.Refresh) * time.Second); cacheable && refresh.After(now) {
+		c.cache.Set(cacheKey, dns.Copy(rrsig), refresh.Sub(now))
+	}
+	return rrsig, nil
+}
+
+// InvalidateZone removes signatures of zone rrsets
+func (c *SignatureCache) InvalidateZone(zone string) {
+	for key := range c.cache.Items() {
+		if strings.HasPrefix(key, zone+"|") {
+			c.cache.Delete(key)
+		}
+	}
+}
+
+// signatureCacheKey identifies rrset content regardless of records order and ttl
+func signatureCacheKey(rrs []dns.RR, key *ZoneKey, z *Zone) string {
+	strs := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		strs = append(strs, rr.String())
+	}
+	sort.Strings(strs)
+	hash := sha256.Sum256([]byte(strings.Join(strs, "\n")))
+	return fmt.Sprintf("%s|%d|%d|%x", z.Name, key.DnsKey.KeyTag(), key.DnsKey.Algorithm, hash)
+}
+
+func sign(rrs []dns.RR, name string, key *ZoneKey, ttl uint32, inception uint32, expiration uint32) (*dns.RRSIG, error) {
 	rrsig := &dns.RRSIG{
 		Hdr:        dns.RR_Header{name, dns.TypeRRSIG, dns.ClassINET, ttl, 0},
-		Inception:  key.KeyInception,
-		Expiration: key.KeyExpiration,
+		Inception:  inception,
+		Expiration: expiration,
 		KeyTag:     key.DnsKey.KeyTag(),
 		SignerName: key.DnsKey.Hdr.Name,
 		Algorithm:  key.DnsKey.Algorithm,
@@ -82,6 +239,26 @@ func sign(rrs []dns.RR, name string, key *ZoneKey, ttl uint32) (*dns.RRSIG, erro
 			logger.Default.Errorf("sign failed : %s", err)
 			return nil, err
 		}
+	case dns.ED25519:
+		if err := rrsig.Sign(key.PrivateKey.(ed25519.PrivateKey), rrs); err != nil {
+			logger.Default.Errorf("sign failed : %s", err)
+			return nil, err
+		}
+	case dns.ED448:
+		// miekg/dns has no ED448 support, signed data is prepared here
+		owner := rrs[0].Header().Name
+		rrsig.OrigTtl = rrs[0].Header().Ttl
+		rrsig.TypeCovered = rrs[0].Header().Rrtype
+		rrsig.Labels = uint8(dns.CountLabel(owner))
+		if strings.HasPrefix(owner, "*") {
+			rrsig.Labels--
+		}
+		data, err := signedData(rrsig, rrs)
+		if err != nil {
+			logger.Default.Errorf("sign failed : %s", err)
+			return nil, err
+		}
+		rrsig.Signature = base64.StdEncoding.EncodeToString(ed448.Sign(key.PrivateKey.(ed448.PrivateKey), data, ""))
 	case dns.DSA, dns.DSANSEC3SHA1:
 		//rrsig.Sign(zone.PrivateKey.(*dsa.PrivateKey), rrs)
 		fallthrough
@@ -91,12 +268,409 @@ func sign(rrs []dns.RR, name string, key *ZoneKey, ttl uint32) (*dns.RRSIG, erro
 	return rrsig, nil
 }
 
-func NSec(name string, zone *Zone) dns.RR {
+// signedData returns rrsig rdata without signature followed by rrs in canonical form and order (RFC 4034 section 3.1.8.1)
+func signedData(rrsig *dns.RRSIG, rrs []dns.RR) ([]byte, error) {
+	sig := *rrsig
+	sig.Hdr.Name = "."
+	sig.SignerName = dns.CanonicalName(rrsig.SignerName)
+	sig.Signature = ""
+	data, err := packRdata(&sig)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := dns.CanonicalName(rrs[0].Header().Name)
+	if labels := dns.SplitDomainName(owner); len(labels) > int(rrsig.Labels) {
+		owner = "*." + strings.Join(labels[len(labels)-int(rrsig.Labels):], ".") + "."
+	}
+	name := make([]byte, 256)
+	n, err := dns.PackDomainName(owner, name, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	var rdatas [][]byte
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = "."
+		rr.Header().Ttl = rrsig.OrigTtl
+		// domain names in rdata are lowercased for types listed in RFC 4034 section 6.2
+		switch x := rr.(type) {
+		case *dns.NS:
+			x.Ns = dns.CanonicalName(x.Ns)
+		case *dns.CNAME:
+			x.Target = dns.CanonicalName(x.Target)
+		case *dns.SOA:
+			x.Ns = dns.CanonicalName(x.Ns)
+			x.Mbox = dns.CanonicalName(x.Mbox)
+		case *dns.PTR:
+			x.Ptr = dns.CanonicalName(x.Ptr)
+		case *dns.MX:
+			x.Mx = dns.CanonicalName(x.Mx)
+		case *dns.NAPTR:
+			x.Replacement = dns.CanonicalName(x.Replacement)
+		case *dns.SRV:
+			x.Target = dns.CanonicalName(x.Target)
+		case *dns.DNAME:
+			x.Target = dns.CanonicalName(x.Target)
+		}
+		rdata, err := packRdata(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, name[:n]...)
+		var header [10]byte
+		binary.BigEndian.PutUint16(header[0:], rrs[0].Header().Rrtype)
+		binary.BigEndian.PutUint16(header[2:], rrs[0].Header().Class)
+		binary.BigEndian.PutUint32(header[4:], rrsig.OrigTtl)
+		binary.BigEndian.PutUint16(header[8:], uint16(len(rdata)))
+		data = append(data, header[:]...)
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// packRdata returns wire format rdata of rr owned by root, root owner takes 1 byte followed by 10 bytes of type, class, ttl and rdlength
+func packRdata(rr dns.RR) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr)+1)
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return buf[11:off], nil
+}
+
+// newEd448PrivateKey parses private key in BIND format, public key should match key
+func newEd448PrivateKey(key *dns.DNSKEY, s string) (crypto.PrivateKey, error) {
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.ToLower(strings.TrimSpace(parts[0])) != "privatekey" {
+			continue
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(seed) != ed448.SeedSize {
+			return nil, dns.ErrPrivKey
+		}
+		priv := ed448.NewKeyFromSeed(seed)
+		if base64.StdEncoding.EncodeToString(priv[ed448.SeedSize:]) != key.PublicKey {
+			return nil, dns.ErrKey
+		}
+		return priv, nil
+	}
+	return nil, dns.ErrPrivKey
+}
+
+// CDS returns CDS records of zone ksks (RFC 7344) or delete signal if cds_delete is set (RFC 8078)
+func CDS(z *Zone) []dns.RR {
+	hdr := dns.RR_Header{Name: z.Name, Rrtype: dns.TypeCDS, Class: dns.ClassINET, Ttl: z.KSK.DnsKey.Hdr.Ttl}
+	if z.Config.CdsDelete {
+		return []dns.RR{&dns.CDS{DS: dns.DS{Hdr: hdr, Digest: "00"}}}
+	}
+	var res []dns.RR
+	for _, key := range z.KSKs {
+		if ds := key.DnsKey.ToDS(dns.SHA256); ds != nil {
+			ds.Hdr = hdr
+			res = append(res, &dns.CDS{DS: *ds})
+		}
+	}
+	return res
+}
+
+// CDNSKEY returns CDNSKEY records of zone ksks (RFC 7344) or delete signal if cds_delete is set (RFC 8078)
+func CDNSKEY(z *Zone) []dns.RR {
+	hdr := dns.RR_Header{Name: z.Name, Rrtype: dns.TypeCDNSKEY, Class: dns.ClassINET, Ttl: z.KSK.DnsKey.Hdr.Ttl}
+	if z.Config.CdsDelete {
+		return []dns.RR{&dns.CDNSKEY{DNSKEY: dns.DNSKEY{Hdr: hdr, Protocol: 3, PublicKey: "AA=="}}}
+	}
+	var res []dns.RR
+	for _, key := range z.KSKs {
+		cdnskey := &dns.CDNSKEY{DNSKEY: *key.DnsKey}
+		cdnskey.Hdr = hdr
+		res = append(res, cdnskey)
+	}
+	return res
+}
+
+// NSec returns compact denial of existence NSEC (RFC 9824) for name with types in its bitmap
+func NSec(name string, zone *Zone, types []uint16) dns.RR {
+	bitmap := append(append([]uint16{}, NSecTypes...), types...)
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	j := 0
+	for i := range bitmap {
+		if i == 0 || bitmap[i] != bitmap[j-1] {
+			bitmap[j] = bitmap[i]
+			j++
+		}
+	}
 	nsec := &dns.NSEC{
 		Hdr:        dns.RR_Header{name, dns.TypeNSEC, dns.ClassINET, zone.Config.SOA.MinTtl, 0},
 		NextDomain: "\\000." + name,
-		TypeBitMap: NSecTypes,
+		TypeBitMap: bitmap[:j],
 	}
 
 	return nsec
 }
+
+// NSecCover returns an NSEC covering only name, used to prove name doesn't exist when answer is synthesized from a wildcard
+func NSecCover(name string, zone *Zone) dns.RR {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{nsecPredecessor(name), dns.TypeNSEC, dns.ClassINET, zone.Config.SOA.MinTtl, 0},
+		NextDomain: "\\000." + name,
+		TypeBitMap: NSecTypes,
+	}
+}
+
+// nsecPredecessor returns a name sorted right before name by decrementing last octet of its first label (RFC 4471 section 3.2)
+func nsecPredecessor(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return name
+	}
+	label, parent := name[:i-1], name[i:]
+	var last byte
+	switch n := len(label); {
+	case n >= 4 && label[n-4] == '\\' && isDigits(label[n-3:]):
+		d, _ := strconv.Atoi(label[n-3:])
+		last, label = byte(d), label[:n-4]
+	case n >= 2 && label[n-2] == '\\':
+		last, label = label[n-1], label[:n-2]
+	default:
+		last, label = label[n-1], label[:n-1]
+	}
+	if last == 0 {
+		if label == "" {
+			return parent
+		}
+		return label + "." + parent
+	}
+	last--
+	// names are compared in lower case
+	if last >= 'A' && last <= 'Z' {
+		last = 'A' - 1
+	}
+	if (last >= 'a' && last <= 'z') || (last >= '0' && last <= '9') || last == '-' || last == '_' {
+		label += string(last)
+	} else {
+		label += fmt.Sprintf("\\%03d", last)
+	}
+	return label + "\\255." + parent
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NSec3 returns NSEC3 white lies (RFC 7129 appendix B) proving qname, or qtype at qname if nameError is false, doesn't exist
+func (h *DnsRequestHandler) NSec3(qname string, record *Record, nameError bool) []dns.RR {
+	z := record.Zone
+	if !nameError {
+		return []dns.RR{nsec3Match(qname, h.typeBitMap(record), z)}
+	}
+
+	closestEncloser, nextCloser := closestEncloser(qname, z)
+	var types []uint16
+	if ceRecord := h.LoadLocation(zoneLocation(closestEncloser, z), z); ceRecord != nil {
+		types = h.typeBitMap(ceRecord)
+	}
+	return []dns.RR{
+		nsec3Match(closestEncloser, types, z),
+		nsec3Cover(nextCloser, z),
+		nsec3Cover("*."+closestEncloser, z),
+	}
+}
+
+// typeBitMap returns types present at record's name
+func (h *DnsRequestHandler) typeBitMap(record *Record) []uint16 {
+	var types []uint16
+	// other data at a delegation point is occluded
+	if isDelegation(record) {
+		types = append(types, dns.TypeNS)
+		if len(record.DS.Data) > 0 {
+			types = append(types, dns.TypeDS)
+		}
+		return types
+	}
+	if len(record.A.Data) > 0 || record.ANAME.serves(dns.TypeA) {
+		types = append(types, dns.TypeA)
+	}
+	if len(record.AAAA.Data) > 0 || record.ANAME.serves(dns.TypeAAAA) {
+		types = append(types, dns.TypeAAAA)
+	}
+	if record.CNAME != nil {
+		types = append(types, dns.TypeCNAME)
+	}
+	if record.DNAME != nil {
+		types = append(types, dns.TypeDNAME)
+	}
+	if len(record.TXT.Data) > 0 || record.ANAME.serves(dns.TypeTXT) {
+		types = append(types, dns.TypeTXT)
+	}
+	if len(record.NS.Data) > 0 {
+		types = append(types, dns.TypeNS)
+	}
+	if len(record.MX.Data) > 0 || record.ANAME.serves(dns.TypeMX) {
+		types = append(types, dns.TypeMX)
+	}
+	if len(record.SRV.Data) > 0 {
+		types = append(types, dns.TypeSRV)
+	}
+	if len(record.CAA.Data) > 0 || record.ANAME.serves(dns.TypeCAA) {
+		types = append(types, dns.TypeCAA)
+	}
+	if record.PTR != nil {
+		types = append(types, dns.TypePTR)
+	}
+	if len(record.TLSA.Data) > 0 {
+		types = append(types, dns.TypeTLSA)
+	}
+	if len(record.SSHFP.Data) > 0 {
+		types = append(types, dns.TypeSSHFP)
+	}
+	if len(record.NAPTR.Data) > 0 {
+		types = append(types, dns.TypeNAPTR)
+	}
+	if len(record.DS.Data) > 0 {
+		types = append(types, dns.TypeDS)
+	}
+	if len(record.HINFO.Data) > 0 {
+		types = append(types, dns.TypeHINFO)
+	}
+	if len(record.LOC.Data) > 0 {
+		types = append(types, dns.TypeLOC)
+	}
+	if len(record.URI.Data) > 0 {
+		types = append(types, dns.TypeURI)
+	}
+	if len(record.SVCB.Data) > 0 {
+		types = append(types, dns.TypeSVCB)
+	}
+	if len(record.HTTPS.Data) > 0 || record.ANAME.serves(dns.TypeHTTPS) {
+		types = append(types, dns.TypeHTTPS)
+	}
+	if record.Name == record.Zone.Name {
+		types = append(types, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY)
+		if record.Zone.Config.NSEC3 != nil {
+			types = append(types, dns.TypeNSEC3PARAM)
+		}
+	}
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// closestEncloser returns closest existing ancestor of qname and the next closer name (RFC 5155 section 7.2.1)
+func closestEncloser(qname string, z *Zone) (string, string) {
+	nextCloser := qname
+	for {
+		i, end := dns.NextLabel(nextCloser, 0)
+		if end {
+			return z.Name, nextCloser
+		}
+		name := nextCloser[i:]
+		if name == z.Name || !dns.IsSubDomain(z.Name, name) || nameExists(zoneLocation(name, z), z) {
+			return name, nextCloser
+		}
+		nextCloser = name
+	}
+}
+
+// nameExists checks if location or an empty non-terminal with this label exists
+func nameExists(label string, z *Zone) bool {
+	if _, ok := z.Locations[label]; ok {
+		return true
+	}
+	for location := range z.Locations {
+		if strings.HasSuffix(location, "."+label) {
+			return true
+		}
+	}
+	return false
+}
+
+func zoneLocation(name string, z *Zone) string {
+	if name == z.Name {
+		return name
+	}
+	return strings.TrimSuffix(name, "."+z.Name)
+}
+
+func NSec3Param(z *Zone) *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: z.Name, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: z.Config.SOA.Ttl},
+		Hash:       dns.SHA1,
+		Iterations: z.Config.NSEC3.Iterations,
+		SaltLength: uint8(len(z.Config.NSEC3.Salt) / 2),
+		Salt:       z.Config.NSEC3.Salt,
+	}
+}
+
+// nsec3Match returns NSEC3 matching name with next hash right after its hash
+func nsec3Match(name string, types []uint16, z *Zone) dns.RR {
+	hash := nsec3Hash(name, z)
+	return nsec3(hash, nsec3HashShift(hash, 1), types, z)
+}
+
+// nsec3Cover returns NSEC3 covering only hash of name
+func nsec3Cover(name string, z *Zone) dns.RR {
+	hash := nsec3Hash(name, z)
+	return nsec3(nsec3HashShift(hash, -1), nsec3HashShift(hash, 1), nil, z)
+}
+
+func nsec3(hash string, next string, types []uint16, z *Zone) dns.RR {
+	var flags uint8
+	if z.Config.NSEC3.OptOut {
+		flags = 1
+	}
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + z.Name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: z.Config.SOA.MinTtl},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		Iterations: z.Config.NSEC3.Iterations,
+		SaltLength: uint8(len(z.Config.NSEC3.Salt) / 2),
+		Salt:       z.Config.NSEC3.Salt,
+		HashLength: sha1.Size,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func nsec3Hash(name string, z *Zone) string {
+	return dns.HashName(name, dns.SHA1, z.Config.NSEC3.Iterations, z.Config.NSEC3.Salt)
+}
+
+// nsec3HashShift adds delta (1 or -1) to base32hex encoded hash
+func nsec3HashShift(hash string, delta int) string {
+	b, err := base32.HexEncoding.DecodeString(hash)
+	if err != nil {
+		return hash
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		if delta > 0 {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		} else {
+			b[i]--
+			if b[i] != 0xff {
+				break
+			}
+		}
+	}
+	return base32.HexEncoding.EncodeToString(b)
+}
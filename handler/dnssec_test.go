@@ -2,14 +2,20 @@ package handler
 
 import (
 	"arvancloud/redins/test"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/cloudflare/circl/sign/ed448"
 	"github.com/coredns/coredns/request"
 	"github.com/hawell/logger"
 	"github.com/hawell/uperdis"
 	"github.com/miekg/dns"
 	"log"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 var dnssecZone = string("dnssec_test.com.")
@@ -24,7 +30,6 @@ var dnssecEntries = [][]string{
             "a":{"ttl":300, "records":[{"ip":"1.2.3.4", "country":"ES"},{"ip":"5.6.7.8", "country":""}]},
             "aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
             "txt":{"ttl":300, "records":[{"text":"foo"},{"text":"bar"}]},
-            "ns":{"ttl":300, "records":[{"host":"ns1.dnssec_test.com."},{"host":"ns2.dnssec_test.com."}]},
             "mx":{"ttl":300, "records":[{"host":"mx1.dnssec_test.com.", "preference":10},{"host":"mx2.dnssec_test.com.", "preference":10}]},
             "srv":{"ttl":300, "records":[{"target":"sip.dnssec_test.com.","port":555,"priority":10,"weight":100}]}
             }`,
@@ -149,14 +154,15 @@ var dnssecTestCases = []test.Case{
 	},
 	// NS Test
 	{
-		Qname: "x.dnssec_test.com.", Qtype: dns.TypeNS,
+		Qname: "dnssec_test.com.", Qtype: dns.TypeNS,
 		Answer: []dns.RR{
-			test.NS("x.dnssec_test.com. 300 IN NS ns1.dnssec_test.com."),
-			test.NS("x.dnssec_test.com. 300 IN NS ns2.dnssec_test.com."),
-			test.RRSIG("x.dnssec_test.com.	300	IN	RRSIG	NS 5 3 300 20180726104727 20180718074727 22548 dnssec_test.com. NTYiqJBR8hFjYQcHeuUUWH2zIEqpF5xfFeHBb24icTbd5kg7VU9QHkzc/odnAFu80SfDJVnxX9OTV7re8Epp06CBT7m8VpUUv6+qnn6ma2qukWa8wyvFPg/PXJLA8cpG"),
+			test.NS("dnssec_test.com.	300	IN	NS	a.dnssec_test.com."),
+			test.RRSIG("dnssec_test.com.	300	IN	RRSIG	NS 5 2 300 20261024034017 20261016222446 22548 dnssec_test.com. eBXF1Tb9LwPSOCshqB5Eg2vdzxTwc59YO00BQ3QixQk2hlgQ6+26230oPfSXNzQhbUO66nzfAptT0hyBoOO1Uj4wzkThEfuLhTfWuo4z0Vszy85SoHlI0SndT6k+g0eh"),
 		},
 		Do: true,
 		Extra: []dns.RR{
+			test.A("a.dnssec_test.com.	300	IN	A	129.0.2.1"),
+			test.RRSIG("a.dnssec_test.com.	300	IN	RRSIG	A 5 3 300 20180731105909 20180723075909 22548 dnssec_test.com. fKHuZTJgweFmBmASxDiZYr8r300CtAmJ03ICKAHS8FkATjLvUyZxWqjI/fExZz277pZ0FMGRiwIb7o6aI31fpAahtU1E0Mo7J0sXjVATCBhME0S88DDuPXgrOMzu8f7K"),
 			test.OPT(4096, true),
 		},
 	},
@@ -203,8 +209,22 @@ var dnssecTestCases = []test.Case{
 		Ns: []dns.RR{
 			test.SOA("dnssec_test.com.	300	IN	SOA	ns1.dnssec_test.com. hostmaster.dnssec_test.com. 1533107621 44 55 66 100"),
 			test.RRSIG("dnssec_test.com.	300	IN	RRSIG	SOA 5 2 300 20180809071341 20180801041341 22548 dnssec_test.com. hJ6GxQo46z5hxBV48hs5Ab1tdfCJ1S7wxIIoI3cksCtf+dqv/eLmlxGH0KuEabAPWhp9VqyjjQYxvSP/0gH0Z/BwYxoghxrROuqHqiIbkbM8wvgLHBwNv+vA4xXUN/Ej"),
-			test.NSEC("nxdomain.x.dnssec_test.com.	100	IN	NSEC	\\000.nxdomain.x.dnssec_test.com. RRSIG NSEC"),
-			test.RRSIG("nxdomain.x.dnssec_test.com.	100	IN	RRSIG	NSEC 5 4 100 20180809115341 20180801085341 22548 dnssec_test.com. cHqIhWUalUAib9cpVd+4XLLzxrm6zKiQKLWs1/2T4dNhaS/CAkIXY6so0YDpsm0wgS2McpVd/GL+2fPDEb0MXJYyTfX8mzn5i49riQjEiHbmlL7oZfXCUKxKTRYczxjf"),
+			test.NSEC("nxdomain.x.dnssec_test.com.	100	IN	NSEC	\\000.nxdomain.x.dnssec_test.com. RRSIG NSEC NXNAME"),
+			test.RRSIG("nxdomain.x.dnssec_test.com.	100	IN	RRSIG	NSEC 5 4 100 20261025004609 20261016214609 22548 dnssec_test.com. NbYlfiPZM0i8vR9ePhXOiGxMYDc0wJ1WiHgxMvcTtjwcq+6TF7C5wXjpqiDio9P1KA+sWrPe2l0UCKM7s7u6/H67q4zk+ZKCEvUoUJMsyk2mvFB7UiNEz+Sk/YNpPkrL"),
+		},
+		Do: true,
+		Extra: []dns.RR{
+			test.OPT(4096, true),
+		},
+	},
+	// NoData Test
+	{
+		Qname: "a.dnssec_test.com.", Qtype: dns.TypeAAAA,
+		Ns: []dns.RR{
+			test.SOA("dnssec_test.com.	300	IN	SOA	ns1.dnssec_test.com. hostmaster.dnssec_test.com. 1533107621 44 55 66 100"),
+			test.RRSIG("dnssec_test.com.	300	IN	RRSIG	SOA 5 2 300 20180809071341 20180801041341 22548 dnssec_test.com. hJ6GxQo46z5hxBV48hs5Ab1tdfCJ1S7wxIIoI3cksCtf+dqv/eLmlxGH0KuEabAPWhp9VqyjjQYxvSP/0gH0Z/BwYxoghxrROuqHqiIbkbM8wvgLHBwNv+vA4xXUN/Ej"),
+			test.NSEC("a.dnssec_test.com.	100	IN	NSEC	\\000.a.dnssec_test.com. A TXT RRSIG NSEC"),
+			test.RRSIG("a.dnssec_test.com.	100	IN	RRSIG	NSEC 5 3 100 20261025004609 20261016214609 22548 dnssec_test.com. CYk3pJ59EFIsQIL/hUsZHadO3XfR0mb/M2Aek1RveCX996rsp3mPejnA5ivJPuiqh6EiQNEci5AV8Fxt1MlI8FcwQmYLgvGVvvxc2SpHKcL41NUSipLL9YU0TMnXCoLc"),
 		},
 		Do: true,
 		Extra: []dns.RR{
@@ -216,7 +236,11 @@ var dnssecTestCases = []test.Case{
 		Qname: "z.dnssec_test.com.", Qtype: dns.TypeTXT,
 		Answer: []dns.RR{
 			test.TXT("z.dnssec_test.com. 300 IN TXT \"wildcard text\""),
-			test.RRSIG("z.dnssec_test.com.	300	IN	RRSIG	TXT 5 3 300 20180731095235 20180723065235 22548 dnssec_test.com. YCmkNMLkg6qtey+9+Yt+Jq0V1itDF9Gw8rodPk82b486jE22xxleLq8zcwne8Xekp57H/9Sk5mmTzczWTZQAUauUQF+o2QzLkgiI5vr0gtC5Y3fraRCDclo9/8IQ2yEs"),
+			test.RRSIG("z.dnssec_test.com.	300	IN	RRSIG	TXT 5 2 300 20261024061725 20261016220621 22548 dnssec_test.com. JDuN6jS08AJOh89kl43hY5BnBsFJ9tJTBDuBG9fmJCQsvmYlDugUER7V/TUYtVo/EIXtk2Rdws6aYFqZ1N8pr7pC1kY22qGr6U1BwbqBegOmQGPs2YNi6iJk03n8Aapv"),
+		},
+		Ns: []dns.RR{
+			test.NSEC("y\\255.dnssec_test.com.	100	IN	NSEC	\\000.z.dnssec_test.com. RRSIG NSEC"),
+			test.RRSIG("y\\255.dnssec_test.com.	100	IN	RRSIG	NSEC 5 3 100 20261024055607 20261016220621 22548 dnssec_test.com. e9sCUMEgChDHtsnYlIdCLiqM24lQcRJH9QlOfi/BE+K+8OPzLv8yArzWYVNWV3yX9d8TG9PmhkDDy6o8HcTozmaGE+vMaI+tIXHj/OoTbKULzhpweFgjvvhi04HWb8OJ"),
 		},
 		Do: true,
 		Extra: []dns.RR{
@@ -246,14 +270,22 @@ var dnssecTestCases = []test.Case{
 		Qname: "w.dnssec_test.com.", Qtype: dns.TypeA,
 		Answer: []dns.RR{
 			test.CNAME("w.a.dnssec_test.com.	300	IN	CNAME	w.b.dnssec_test.com."),
-			test.RRSIG("w.a.dnssec_test.com.	300	IN	RRSIG	CNAME 5 4 300 20180801064612 20180724034612 22548 dnssec_test.com. OZlpQZTJH6KjNJPDuB/YPQORgwRfPpGz5FR0AReqRizAJMOjPSNjcmzpjpFXi7N5Hg+x+15RD0pnE8yL6XXSrg5pNsQo7p9XJa/6H9AL9OGMgYcOJe5FRJwHN9XXGrVr"),
+			test.RRSIG("w.a.dnssec_test.com.	300	IN	RRSIG	CNAME 5 3 300 20261024052638 20261016220621 22548 dnssec_test.com. laGY/OoLpXB5fx9J0ZmkO1LfTva3hhFIO46XKgU3+0DrCDEan5QV5ICpb8v/+CTBBHjqtlAfjS4b7yAg/DiAebR4vdHh8qb9ysHla62he60VRzQuN9bh7MJS/jaqVanH"),
 			test.CNAME("w.b.dnssec_test.com.	300	IN	CNAME	w.c.dnssec_test.com."),
-			test.RRSIG("w.b.dnssec_test.com.	300	IN	RRSIG	CNAME 5 4 300 20180801064612 20180724034612 22548 dnssec_test.com. VMs35joPFxyRrWtz1gyGRKju9j6p7MrQihOwU8m7cmCKmNT/6e58qS3OYYnp6tH34IxJnf+DZGapL07pMwSe+JyaOpsSirTmmytKU6NRQoidijKa7QkMXtXpY1l70Fga"),
+			test.RRSIG("w.b.dnssec_test.com.	300	IN	RRSIG	CNAME 5 3 300 20261024144938 20261016220622 22548 dnssec_test.com. I2QEv+zRgCHZEyxlZbgAxcmDW7JrhbW7/f2bBJPOdosseRCHxrbPJd47Rx3jeVVUyvHv3X2eQuijS0TqEvopjlavM2jNUa6QDfL/8H2rPqRwRydugJXGxYze03IUeCtw"),
 			test.A("w.c.dnssec_test.com.	300	IN	A	129.0.2.1"),
-			test.RRSIG("w.c.dnssec_test.com.	300	IN	RRSIG	A 5 4 300 20180801064612 20180724034612 22548 dnssec_test.com. LrrMYhyADHnznyVFx/DKqpteVrRqqOIgkrWzpOO3AI8Mx1xTfNqy6xMi/ngZPRfUuLHqkp9dyYhJN1qHrRwu2rJw1P+X3n7oD3hDL982ppB3hYAWPzTcwYO0C5848AQD"),
+			test.RRSIG("w.c.dnssec_test.com.	300	IN	RRSIG	A 5 3 300 20261024021458 20261016220622 22548 dnssec_test.com. D8M/sVmsYHzkSH/GfA1D+jJEJ42FO1tpFGUTWT9NkC4Cyg77Hc3heY7Po58/RdzXGt3yz0G0yRXHQ4jxd8+6GrIikYUt5mv7rDp3FitzPO9KBL128Lzs9xTpEFd/x9wU"),
 			test.CNAME("w.dnssec_test.com.	300	IN	CNAME	w.a.dnssec_test.com."),
 			test.RRSIG("w.dnssec_test.com.	300	IN	RRSIG	CNAME 5 3 300 20180801064612 20180724034612 22548 dnssec_test.com. fgaoAooAffMg2apxMqmQBKgVVTGx+PaOo7ik61DvsG9UP7EeBQ7K0bNGxYlcQHDv7aZdLwtTU5OpLk2UCbZPhVAr69Irdr0RYOc+/Jzgw0u+iWU2o0ERxUG9ICiB+Ix8"),
 		},
+		Ns: []dns.RR{
+			test.NSEC("v\\255.a.dnssec_test.com.	100	IN	NSEC	\\000.w.a.dnssec_test.com. RRSIG NSEC"),
+			test.RRSIG("v\\255.a.dnssec_test.com.	100	IN	RRSIG	NSEC 5 4 100 20261024185034 20261016220622 22548 dnssec_test.com. E/o0SRCSYadRgu0fjpCShAb1CFKv1ghtYcLZEo9KH7U8DY/un1xnWhqlzRrXk82+qK8tDmiZHhCkOsFkUX4WTk6Y2wdF2FZbmu17SH1Jx3WPRZ8FqrL/AZY6RLQZucLe"),
+			test.NSEC("v\\255.b.dnssec_test.com.	100	IN	NSEC	\\000.w.b.dnssec_test.com. RRSIG NSEC"),
+			test.RRSIG("v\\255.b.dnssec_test.com.	100	IN	RRSIG	NSEC 5 4 100 20261024082326 20261016220622 22548 dnssec_test.com. eYJLZki2KcTELdbyKhP9hgc5aJbVEptbkxwZRIYPYczSa3l4IiU9d9HCmKSYR1wJmaYMLcX8WAlWH34K3XOV5+UZmUKtclfIH2MumZz5fmi7XCj0+ZD/at5meX6mCzG4"),
+			test.NSEC("v\\255.c.dnssec_test.com.	100	IN	NSEC	\\000.w.c.dnssec_test.com. RRSIG NSEC"),
+			test.RRSIG("v\\255.c.dnssec_test.com.	100	IN	RRSIG	NSEC 5 4 100 20261024120527 20261016220622 22548 dnssec_test.com. MBUJdLeQ7L9pes0LnOILHrAoP6PFS8LcPNap31SY87sdggzS688At5rPwsjXb5l0gHeJ/V7iDKyI+i9gcafdI0jNEkGhzMCm5cpmXLmVRNBrqu8eVx5lC3KBbnPleXjk"),
+		},
 		Do: true,
 		Extra: []dns.RR{
 			test.OPT(4096, true),
@@ -297,20 +329,20 @@ func TestDNSSEC(t *testing.T) {
 
 	h := NewHandler(&dnssecTestConfig)
 
-	h.Redis.Del(dnssecZone)
+	h.testRedis().Del(dnssecZone)
 	for _, cmd := range dnssecEntries {
-		err := h.Redis.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
-	h.Redis.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
-	h.Redis.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
-	h.Redis.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
-	h.Redis.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
-	h.Redis.SAdd("redins:zones", dnssecZone)
+	h.testRedis().Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	h.testRedis().Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	h.testRedis().Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	h.testRedis().Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	h.testRedis().Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h.testRedis().SAdd("redins:zones", dnssecZone)
 	h.LoadZones()
 
 	var zsk dns.RR
@@ -347,6 +379,11 @@ func TestDNSSEC(t *testing.T) {
 		}
 		copy(tc.Answer, dnssecTestCases[i].Answer)
 		copy(tc.Ns, dnssecTestCases[i].Ns)
+		for _, rr := range dnssecTestCases[i].Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				tc.Extra = append(tc.Extra, rr)
+			}
+		}
 		sort.Sort(test.RRSet(tc.Answer))
 		sort.Sort(test.RRSet(tc.Ns))
 
@@ -389,4 +426,608 @@ func TestDNSSEC(t *testing.T) {
 		}
 		//fmt.Println("xxxx")
 	}
+
+	// compact answers ok flag keeps nxdomain rcode
+	r := new(dns.Msg)
+	r.SetQuestion("nxdomain.x.dnssec_test.com.", dns.TypeAAAA)
+	r.SetEdns0(4096, true)
+	r.IsEdns0().SetCo(true)
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(&request.Request{W: w, Req: r})
+	if w.Msg.Rcode != dns.RcodeNameError {
+		fmt.Println("expected nxdomain : ", w.Msg)
+		t.Fail()
+	}
+
+	r = new(dns.Msg)
+	r.SetQuestion("x.dnssec_test.com.", dns.TypeNXNAME)
+	w = test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(&request.Request{W: w, Req: r})
+	if w.Msg.Rcode != dns.RcodeFormatError {
+		fmt.Println("expected formerr : ", w.Msg)
+		t.Fail()
+	}
+}
+
+var nsec3Zone = "nsec3_test.com."
+
+var nsec3Config = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.nsec3_test.com.","ns":"ns1.nsec3_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true,"nsec3":{"salt":"aabbccdd","iterations":1,"opt_out":true}}`
+
+var nsec3Entries = [][]string{
+	{"@",
+		`{"ns":{"ttl":300,"records":[{"host":"ns1.nsec3_test.com."}]}}`,
+	},
+	{"x",
+		`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},"txt":{"ttl":300, "records":[{"text":"foo"}]}}`,
+	},
+	{"a.b.c",
+		`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+	},
+	{"*.w",
+		`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+	},
+}
+
+func TestNSEC3(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	h := NewHandler(&dnssecTestConfig)
+	h.testRedis().Del("redins:zones:" + nsec3Zone)
+	for _, cmd := range nsec3Entries {
+		h.testRedis().HSet("redins:zones:"+nsec3Zone, cmd[0], cmd[1])
+	}
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":config", nsec3Config)
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":zsk:pub", strings.Replace(zskPub, dnssecZone, nsec3Zone, 1))
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":zsk:priv", zskPriv)
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":ksk:pub", strings.Replace(kskPub, dnssecZone, nsec3Zone, 1))
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":ksk:priv", kskPriv)
+	h.testRedis().SAdd("redins:zones", nsec3Zone)
+	h.LoadZones()
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		state := request.Request{W: w, Req: tc.Msg()}
+		h.HandleRequest(&state)
+		return w.Msg
+	}
+
+	zsk := h.LoadZone(nsec3Zone).ZSK.DnsKey
+	nsec3s := func(resp *dns.Msg) []*dns.NSEC3 {
+		var res []*dns.NSEC3
+		for _, rr := range resp.Ns {
+			if nsec3, ok := rr.(*dns.NSEC3); ok {
+				res = append(res, nsec3)
+			}
+		}
+		for _, set := range splitSets(resp.Ns) {
+			verified := false
+			for _, rr := range resp.Ns {
+				if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.Hdr.Name == set[0].Header().Name && rrsig.TypeCovered == set[0].Header().Rrtype {
+					verified = rrsig.Verify(zsk, set) == nil
+				}
+			}
+			if !verified {
+				fmt.Println("rrset not signed correctly : ", set)
+				t.Fail()
+			}
+		}
+		return res
+	}
+	// authority section order is not preserved by Sign
+	matching := func(proof []*dns.NSEC3, name string) *dns.NSEC3 {
+		for _, nsec3 := range proof {
+			if nsec3.Match(name) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+	covering := func(proof []*dns.NSEC3, name string) *dns.NSEC3 {
+		for _, nsec3 := range proof {
+			if nsec3.Cover(name) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+	hasType := func(nsec3 *dns.NSEC3, qtype uint16) bool {
+		for _, t := range nsec3.TypeBitMap {
+			if t == qtype {
+				return true
+			}
+		}
+		return false
+	}
+
+	// nxdomain : closest encloser is matched, next closer and wildcard are covered
+	resp := query("nx.a.b.c.nsec3_test.com.", dns.TypeA)
+	proof := nsec3s(resp)
+	if resp.Rcode != dns.RcodeNameError || len(proof) != 3 {
+		fmt.Println("unexpected response : ", resp)
+		t.FailNow()
+	}
+	if ce := matching(proof, "a.b.c.nsec3_test.com."); ce == nil || !hasType(ce, dns.TypeA) || ce.Flags != 1 || ce.Iterations != 1 || ce.Salt != "AABBCCDD" {
+		fmt.Println("closest encloser not matched : ", proof)
+		t.Fail()
+	}
+	if nc := covering(proof, "nx.a.b.c.nsec3_test.com."); nc == nil || nc.Cover("a.b.c.nsec3_test.com.") {
+		fmt.Println("next closer not covered : ", proof)
+		t.Fail()
+	}
+	if covering(proof, "*.a.b.c.nsec3_test.com.") == nil {
+		fmt.Println("wildcard not covered : ", proof)
+		t.Fail()
+	}
+
+	// empty non-terminal as closest encloser
+	resp = query("nx.b.c.nsec3_test.com.", dns.TypeA)
+	proof = nsec3s(resp)
+	if resp.Rcode != dns.RcodeNameError || len(proof) != 3 || matching(proof, "b.c.nsec3_test.com.") == nil || len(matching(proof, "b.c.nsec3_test.com.").TypeBitMap) != 0 || covering(proof, "nx.b.c.nsec3_test.com.") == nil {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+
+	// nodata : qname is matched and qtype is not in type bitmap
+	resp = query("x.nsec3_test.com.", dns.TypeMX)
+	proof = nsec3s(resp)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(proof) != 1 || matching(proof, "x.nsec3_test.com.") == nil ||
+		hasType(proof[0], dns.TypeMX) || !hasType(proof[0], dns.TypeA) || !hasType(proof[0], dns.TypeTXT) {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+
+	// wildcard expansion : signed as wildcard, next closer is covered
+	resp = query("y.z.w.nsec3_test.com.", dns.TypeA)
+	proof = nsec3s(resp)
+	if len(resp.Answer) != 2 || len(proof) != 1 || covering(proof, "z.w.nsec3_test.com.") == nil {
+		fmt.Println("unexpected response : ", resp)
+		t.FailNow()
+	}
+	if rrsig := resp.Answer[1].(*dns.RRSIG); rrsig.Labels != 3 || rrsig.Hdr.Name != "y.z.w.nsec3_test.com." || rrsig.Verify(zsk, resp.Answer[:1]) != nil {
+		fmt.Println("wildcard answer not signed correctly : ", resp)
+		t.Fail()
+	}
+
+	resp = query("nsec3_test.com.", dns.TypeNSEC3PARAM)
+	if len(resp.Answer) != 2 || resp.Answer[0].(*dns.NSEC3PARAM).Salt != "AABBCCDD" {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+
+	// too many iterations make zone insecure for validators, 0 is used instead
+	h.testRedis().Set("redins:zones:"+nsec3Zone+":config", strings.Replace(nsec3Config, `"iterations":1`, `"iterations":500`, 1))
+	h.InvalidateZone(nsec3Zone)
+	resp = query("nsec3_test.com.", dns.TypeNSEC3PARAM)
+	if len(resp.Answer) != 2 || resp.Answer[0].(*dns.NSEC3PARAM).Iterations != 0 {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+}
+
+var eddsaEntries = [][]string{
+	{"@",
+		`{"ns":{"ttl":300,"records":[{"host":"ns1.eddsa_test.com."}]}}`,
+	},
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+	},
+}
+
+var eddsaKeys = []struct {
+	algorithm uint8
+	zskPub    string
+	zskPriv   string
+	kskPub    string
+	kskPriv   string
+}{
+	{
+		algorithm: dns.ED25519,
+		zskPub:    "eddsa_test.com. 3600 IN DNSKEY 256 3 15 Kx9f0tjam5WyKVnGKvgvKYhY4WbeO6vl0eWoRuGerRo=",
+		zskPriv:   "Private-key-format: v1.3\nAlgorithm: 15 (ED25519)\nPrivateKey: hswiRTxerDfXY5Ln16bJwpzQbOw/uJ8RUuRVwpeK3L0=\n",
+		kskPub:    "eddsa_test.com. 3600 IN DNSKEY 257 3 15 xalkmbPIbGYnOMWEUtW7OKlMfIjiHZyFrNqlZp0Z1m8=",
+		kskPriv:   "Private-key-format: v1.3\nAlgorithm: 15 (ED25519)\nPrivateKey: tUGg3Nh9WHr1W1CSNH5Kd3HLCTBF1qmKN1fwSSwIR7g=\n",
+	},
+	{
+		algorithm: dns.ED448,
+		zskPub:    "eddsa_test.com. 3600 IN DNSKEY 256 3 16 FM2N28ThSs51Lb25SVnOAZW449AejkJzmeeiGVsX5ttESQ1yogYtBGojjdp7stEtIVVdK5mx8TyA",
+		zskPriv:   "Private-key-format: v1.3\nAlgorithm: 16 (ED448)\nPrivateKey: cqsEvArvLIugoLBZU5+NybvXXfcU9HzQYxIy+5LNgxbdZtYhkDRA/brib4++STx0gCgLQH/2RK/z\n",
+		kskPub:    "eddsa_test.com. 3600 IN DNSKEY 257 3 16 7bc2eIh6eNV47HbFCqdap4cfYya7C9LliyNFAmdNK1YI1oanX3xlZk1YtldSYl2IsyKDAMd0nhKA",
+		kskPriv:   "Private-key-format: v1.3\nAlgorithm: 16 (ED448)\nPrivateKey: aJzqw0EqNa7CpSmq1aAPGifUbDtxu37EhBIkzLnHa+53hckjjVwBIK0VxUogO+uEjg+E1c5QCMYP\n",
+	},
+}
+
+// verify uses ed448 directly since miekg/dns doesn't support it
+func verify(rrsig *dns.RRSIG, key *dns.DNSKEY, rrs []dns.RR) error {
+	if key.Algorithm != dns.ED448 {
+		return rrsig.Verify(key, rrs)
+	}
+	if rrsig.KeyTag != key.KeyTag() || rrsig.Algorithm != key.Algorithm {
+		return dns.ErrKey
+	}
+	data, err := signedData(rrsig, rrs)
+	if err != nil {
+		return err
+	}
+	pub, _ := base64.StdEncoding.DecodeString(key.PublicKey)
+	sig, _ := base64.StdEncoding.DecodeString(rrsig.Signature)
+	if !ed448.Verify(pub, data, sig, "") {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func TestEdDSA(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	for _, keys := range eddsaKeys {
+		zone := "eddsa_test.com."
+		h := NewHandler(&dnssecTestConfig)
+		h.testRedis().Del("redins:zones:" + zone)
+		for _, cmd := range eddsaEntries {
+			h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
+		}
+		h.testRedis().Set("redins:zones:"+zone+":config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.eddsa_test.com.","ns":"ns1.eddsa_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true}`)
+		h.testRedis().Set("redins:zones:"+zone+":zsk:pub", keys.zskPub)
+		h.testRedis().Set("redins:zones:"+zone+":zsk:priv", keys.zskPriv)
+		h.testRedis().Set("redins:zones:"+zone+":ksk:pub", keys.kskPub)
+		h.testRedis().Set("redins:zones:"+zone+":ksk:priv", keys.kskPriv)
+		h.testRedis().SAdd("redins:zones", zone)
+		h.LoadZones()
+
+		query := func(qname string, qtype uint16) *dns.Msg {
+			tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+			w := test.NewRecorder(&test.ResponseWriter{})
+			state := request.Request{W: w, Req: tc.Msg()}
+			h.HandleRequest(&state)
+			return w.Msg
+		}
+
+		z := h.LoadZone(zone)
+		if !z.Config.DnsSec || z.ZSK.DnsKey.Algorithm != keys.algorithm {
+			fmt.Println(keys.algorithm, "dnssec is disabled")
+			t.Fail()
+			continue
+		}
+
+		resp := query(zone, dns.TypeDNSKEY)
+		if len(resp.Answer) != 3 {
+			fmt.Println(keys.algorithm, "unexpected DNSKEY response : ", resp)
+			t.Fail()
+			continue
+		}
+		if err := verify(resp.Answer[2].(*dns.RRSIG), z.KSK.DnsKey, resp.Answer[:2]); err != nil {
+			fmt.Println(keys.algorithm, "invalid DNSKEY signature : ", err)
+			t.Fail()
+		}
+
+		resp = query("www."+zone, dns.TypeA)
+		if len(resp.Answer) != 2 {
+			fmt.Println(keys.algorithm, "unexpected response : ", resp)
+			t.Fail()
+			continue
+		}
+		if err := verify(resp.Answer[1].(*dns.RRSIG), z.ZSK.DnsKey, resp.Answer[:1]); err != nil {
+			fmt.Println(keys.algorithm, "invalid signature : ", err)
+			t.Fail()
+		}
+
+		resp = query("nx."+zone, dns.TypeA)
+		for _, set := range splitSets(resp.Ns) {
+			verified := false
+			for _, rr := range resp.Ns {
+				if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.TypeCovered == set[0].Header().Rrtype {
+					verified = verify(rrsig, z.ZSK.DnsKey, set) == nil
+				}
+			}
+			if !verified {
+				fmt.Println(keys.algorithm, "rrset not signed correctly : ", set)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestCDS(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "cds_test.com."
+	zoneConfig := `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.cds_test.com.","ns":"ns1.cds_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true}`
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, zoneConfig)
+	store.SetLocation(zone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	for _, key := range []string{"zsk", "ksk"} {
+		pub, priv, _ := GenerateZoneKey(zone, "ecdsa", 0, key == "ksk")
+		store.SetKey(zone, key+":pub", pub)
+		store.SetKey(zone, key+":priv", priv)
+	}
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+
+	ksk := h.LoadZone(zone).KSK.DnsKey
+	ds := ksk.ToDS(dns.SHA256)
+	resp := query(zone, dns.TypeCDS)
+	if len(resp.Answer) != 2 || resp.Answer[0].(*dns.CDS).Digest != ds.Digest || resp.Answer[0].(*dns.CDS).KeyTag != ds.KeyTag {
+		fmt.Println("unexpected CDS response : ", resp)
+		t.FailNow()
+	}
+	if err := resp.Answer[1].(*dns.RRSIG).Verify(ksk, resp.Answer[:1]); err != nil {
+		fmt.Println("CDS is not signed by ksk : ", err)
+		t.Fail()
+	}
+	resp = query(zone, dns.TypeCDNSKEY)
+	if len(resp.Answer) != 2 || resp.Answer[0].(*dns.CDNSKEY).PublicKey != ksk.PublicKey || resp.Answer[0].(*dns.CDNSKEY).Flags != 257 {
+		fmt.Println("unexpected CDNSKEY response : ", resp)
+		t.FailNow()
+	}
+	if err := resp.Answer[1].(*dns.RRSIG).Verify(ksk, resp.Answer[:1]); err != nil {
+		fmt.Println("CDNSKEY is not signed by ksk : ", err)
+		t.Fail()
+	}
+	if resp := query("www."+zone, dns.TypeCDS); len(resp.Answer) != 0 {
+		fmt.Println("CDS is only served at apex : ", resp)
+		t.Fail()
+	}
+
+	// delete signal
+	store.SetZoneConfig(zone, strings.Replace(zoneConfig, `"dnssec": true`, `"dnssec": true, "cds_delete": true`, 1))
+	h.InvalidateZone(zone)
+	resp = query(zone, dns.TypeCDS)
+	if len(resp.Answer) != 2 || resp.Answer[0].String() != "cds_test.com.\t3600\tIN\tCDS\t0 0 0 00" {
+		fmt.Println("unexpected CDS response : ", resp)
+		t.Fail()
+	}
+	resp = query(zone, dns.TypeCDNSKEY)
+	if len(resp.Answer) != 2 || resp.Answer[0].String() != "cds_test.com.\t3600\tIN\tCDNSKEY\t0 3 0 AA==" {
+		fmt.Println("unexpected CDNSKEY response : ", resp)
+		t.Fail()
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "sig_test.com."
+	zoneConfig := `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.sig_test.com.","ns":"ns1.sig_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true, "signature":%s}`
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, `{"validity":4,"refresh":2,"jitter":1}`))
+	store.SetLocation(zone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	for _, key := range []string{"zsk", "ksk"} {
+		pub, priv, _ := GenerateZoneKey(zone, "ecdsa", 0, key == "ksk")
+		store.SetKey(zone, key+":pub", pub)
+		store.SetKey(zone, key+":priv", priv)
+	}
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	// ecdsa signatures are randomized, equal signatures are served from cache
+	signature := func(qname string, qtype uint16) *dns.RRSIG {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		for _, rr := range append(w.Msg.Answer, w.Msg.Ns...) {
+			if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.TypeCovered == qtype {
+				return rrsig
+			}
+		}
+		fmt.Println("no signature : ", w.Msg)
+		t.FailNow()
+		return nil
+	}
+
+	now := uint32(time.Now().Unix())
+	first := signature("www."+zone, dns.TypeA)
+	if first.Expiration < now+3 || first.Expiration > now+5 {
+		fmt.Println("unexpected expiration : ", first.Expiration-now)
+		t.Fail()
+	}
+	if second := signature("www."+zone, dns.TypeA); second.Signature != first.Signature {
+		fmt.Println("signature not cached")
+		t.Fail()
+	}
+	// nsec records are unique per name and are not cached
+	if signature("nx."+zone, dns.TypeNSEC).Signature == signature("nx."+zone, dns.TypeNSEC).Signature {
+		fmt.Println("denial signature is cached")
+		t.Fail()
+	}
+
+	// upstream answers counting down ttl share a signature
+	z := h.LoadZone(zone)
+	set := func(ttl uint32) []dns.RR {
+		rr, _ := dns.NewRR(fmt.Sprintf("ext.%s %d IN A 5.6.7.8", zone, ttl))
+		return []dns.RR{rr}
+	}
+	original, _ := h.signatures.Sign(set(300), z.ZSK, z)
+	lower, _ := h.signatures.Sign(set(200), z.ZSK, z)
+	if lower.Signature != original.Signature || lower.Hdr.Ttl != 200 || lower.OrigTtl != 300 || lower.Verify(z.ZSK.DnsKey, set(200)) != nil {
+		fmt.Println("signature not cached for lower ttl : ", lower)
+		t.Fail()
+	}
+	if higher, _ := h.signatures.Sign(set(400), z.ZSK, z); higher.Signature == original.Signature || higher.OrigTtl != 400 {
+		fmt.Println("signature cached for higher ttl : ", higher)
+		t.Fail()
+	}
+
+	// signature is refreshed before expiration
+	time.Sleep(time.Millisecond * 2500)
+	if refreshed := signature("www."+zone, dns.TypeA); refreshed.Signature == first.Signature || refreshed.Expiration <= first.Expiration {
+		fmt.Println("signature not refreshed")
+		t.Fail()
+	}
+
+	// invalid config falls back to default validity
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, `{"validity":10,"refresh":10}`))
+	h.InvalidateZone(zone)
+	now = uint32(time.Now().Unix())
+	if rrsig := signature("www."+zone, dns.TypeA); rrsig.Expiration < now+defaultSignatureValidity*7/8-1 || rrsig.Expiration > now+defaultSignatureValidity+1 {
+		fmt.Println("unexpected expiration : ", rrsig.Expiration-now)
+		t.Fail()
+	}
+}
+
+func TestDNAMESigning(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "dname_test.com."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.dname_test.com.","ns":"ns1.dname_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true}`)
+	store.SetLocation(zone, "old", `{"dname":{"ttl":300, "target":"new.dname_test.com."}}`)
+	store.SetLocation(zone, "x.new", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	for _, key := range []string{"zsk", "ksk"} {
+		pub, priv, _ := GenerateZoneKey(zone, "ecdsa", 0, key == "ksk")
+		store.SetKey(zone, key+":pub", pub)
+		store.SetKey(zone, key+":priv", priv)
+	}
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	tc := test.Case{Qname: "x.old." + zone, Qtype: dns.TypeA, Do: true}
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+	resp := w.Msg
+
+	// dname and target are signed, synthesized cname is not
+	zsk := h.LoadZone(zone).ZSK.DnsKey
+	signed := make(map[uint16]bool)
+	for _, set := range splitSets(resp.Answer) {
+		for _, rr := range resp.Answer {
+			if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.TypeCovered == set[0].Header().Rrtype {
+				if rrsig.Verify(zsk, set) != nil {
+					fmt.Println("invalid signature : ", rrsig)
+					t.Fail()
+				}
+				signed[rrsig.TypeCovered] = true
+			}
+		}
+	}
+	if len(resp.Answer) != 5 || !signed[dns.TypeDNAME] || !signed[dns.TypeA] || signed[dns.TypeCNAME] {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "deleg_test.com."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	zoneConfig := `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.deleg_test.com.","ns":"ns1.deleg_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true%s}`
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, ""))
+	store.SetLocation(zone, "sub", `{"ns":{"ttl":300, "records":[{"host":"ns1.sub.deleg_test.com."},{"host":"ns.example.org."}]}}`)
+	store.SetLocation(zone, "ns1.sub", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	store.SetLocation(zone, "secure", `{"ns":{"ttl":300, "records":[{"host":"ns.example.org."}]},
+		"ds":{"ttl":300, "records":[{"key_tag":60485, "algorithm":5, "digest_type":1, "digest":"2BB183AF5F22588179A53B0A98631FAD1A292118"}]}}`)
+	for _, key := range []string{"zsk", "ksk"} {
+		pub, priv, _ := GenerateZoneKey(zone, "ecdsa", 0, key == "ksk")
+		store.SetKey(zone, key+":pub", pub)
+		store.SetKey(zone, key+":priv", priv)
+	}
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+	// checkReferral verifies referral is not authoritative and only its ds or nsec is signed
+	checkReferral := func(resp *dns.Msg, proof uint16, glue int) {
+		zsk := h.LoadZone(zone).ZSK.DnsKey
+		types := make(map[uint16]bool)
+		for _, rr := range resp.Ns {
+			if rrsig, ok := rr.(*dns.RRSIG); ok {
+				types[rrsig.TypeCovered] = true
+				var covered []dns.RR
+				for _, rr := range resp.Ns {
+					if rr.Header().Rrtype == rrsig.TypeCovered {
+						covered = append(covered, rr)
+					}
+				}
+				if rrsig.Verify(zsk, covered) != nil {
+					fmt.Println("invalid signature : ", rrsig)
+					t.Fail()
+				}
+			}
+		}
+		if resp.Authoritative || len(resp.Answer) != 0 || len(resp.Extra) != glue+1 || len(types) != 1 || !types[proof] {
+			fmt.Println("unexpected referral : ", resp)
+			t.Fail()
+		}
+	}
+
+	checkReferral(query("www.sub."+zone, dns.TypeA), dns.TypeNSEC, 1)
+	checkReferral(query("ns1.sub."+zone, dns.TypeA), dns.TypeNSEC, 1)
+	checkReferral(query("secure."+zone, dns.TypeNS), dns.TypeDS, 0)
+
+	// ds is answered authoritatively by parent
+	resp := query("secure."+zone, dns.TypeDS)
+	if !resp.Authoritative || len(resp.Answer) != 2 {
+		fmt.Println("unexpected ds response : ", resp)
+		t.Fail()
+	}
+	resp = query("sub."+zone, dns.TypeDS)
+	var nsec *dns.NSEC
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNSEC {
+			nsec = rr.(*dns.NSEC)
+		}
+	}
+	if !resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 4 || nsec == nil || nsec.TypeBitMap[0] != dns.TypeNS {
+		fmt.Println("unexpected ds response : ", resp)
+		t.Fail()
+	}
+
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, `,"nsec3":{"salt":"aabbccdd","iterations":1}`))
+	h.InvalidateZone(zone)
+	checkReferral(query("www.sub."+zone, dns.TypeA), dns.TypeNSEC3, 1)
+}
+
+func TestSignedData(t *testing.T) {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600}, Flags: 256, Protocol: 3, Algorithm: dns.ED25519}
+	priv, _ := key.Generate(256)
+	pub, _ := base64.StdEncoding.DecodeString(key.PublicKey)
+	rrset := func(owner string) []dns.RR {
+		var rrs []dns.RR
+		for _, s := range []string{"MX 20 Mail2.Example.COM.", "MX 10 mail1.example.com.", "MX 10 mail1.example.com."} {
+			rr, _ := dns.NewRR(owner + " 300 IN " + s)
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+
+	// data matches what miekg/dns signs, for wildcard expansions as well
+	for _, owner := range []string{"WWW.Example.com.", "*.example.com."} {
+		rrsig := &dns.RRSIG{Inception: 1, Expiration: 2, KeyTag: key.KeyTag(), SignerName: "Example.com.", Algorithm: dns.ED25519}
+		if err := rrsig.Sign(priv.(ed25519.PrivateKey), rrset(owner)); err != nil {
+			fmt.Println("sign failed : ", err)
+			t.FailNow()
+		}
+		rrsig.Hdr.Ttl = 100
+		sig, _ := base64.StdEncoding.DecodeString(rrsig.Signature)
+		data, err := signedData(rrsig, rrset(strings.Replace(owner, "*", "a.b", 1)))
+		if err != nil || !ed25519.Verify(pub, data, sig) {
+			fmt.Println("invalid signed data : ", owner, err)
+			t.Fail()
+		}
+	}
 }
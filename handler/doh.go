@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDohPath    = "/dns-query"
+	dohContentType    = "application/dns-message"
+	dohMaxMessageSize = dns.MaxMsgSize
+	// same as dns.Server defaults used by tcp and tls listeners
+	dohReadTimeout  = 2 * time.Second
+	dohWriteTimeout = 2 * time.Second
+	dohIdleTimeout  = 8 * time.Second
+)
+
+// DohServer serves dns over https (RFC 8484)
+type DohServer struct {
+	Handler      dns.Handler
+	TsigProvider dns.TsigProvider
+	config       ServerConfig
+	server       *http.Server
+}
+
+func NewDohServer(config ServerConfig, tlsConfig *tls.Config, tsigProvider dns.TsigProvider) *DohServer {
+	s := &DohServer{
+		TsigProvider: tsigProvider,
+		config:       config,
+	}
+	if s.config.Path == "" {
+		s.config.Path = defaultDohPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(s.config.Path, s)
+	s.server = &http.Server{
+		Addr:              config.Ip + ":" + strconv.Itoa(config.Port),
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: dohReadTimeout,
+		ReadTimeout:       dohReadTimeout,
+		WriteTimeout:      dohWriteTimeout,
+		IdleTimeout:       dohIdleTimeout,
+	}
+	return s
+}
+
+func (s *DohServer) ListenAndServe() error {
+	var err error
+	if s.server.TLSConfig != nil {
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *DohServer) Shutdown() error {
+	return s.server.Shutdown(context.Background())
+}
+
+func (s *DohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if buf, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if buf, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dohMaxMessageSize)); err != nil {
+			http.Error(w, "cannot read request", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	dw := newMsgResponseWriter(s.localAddr(r), s.remoteAddr(r), s.TsigProvider, req, buf)
+	handler := s.Handler
+	if handler == nil {
+		handler = dns.DefaultServeMux
+	}
+	if !refuseTransfer(dw, req) {
+		handler.ServeDNS(dw, req)
+	}
+
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(dohMaxAge(dw.msg))))
+	w.Write(dw.msg)
+}
+
+func (s *DohServer) localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			p, _ := strconv.Atoi(port)
+			return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+		}
+	}
+	return &net.TCPAddr{IP: net.ParseIP(s.config.Ip), Port: s.config.Port}
+}
+
+// remoteAddr returns client address, X-Forwarded-For is used only for requests coming from trusted proxies
+func (s *DohServer) remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	if ip != nil && transferAllowed(ip.String(), s.config.TrustedProxies) {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			forwardedIp := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if forwardedIp == nil {
+				break
+			}
+			ip = forwardedIp
+			if !transferAllowed(ip.String(), s.config.TrustedProxies) {
+				break
+			}
+		}
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// dohMaxAge returns minimum ttl of response records to use in http caching (RFC 8484 section 5.1)
+func dohMaxAge(buf []byte) uint32 {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0
+	}
+	var minTtl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeTSIG {
+				continue
+			}
+			if first || rr.Header().Ttl < minTtl {
+				minTtl, first = rr.Header().Ttl, false
+			}
+		}
+	}
+	return minTtl
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var dohZone = "doh.zon."
+
+var dohEntries = [][]string{
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+	},
+}
+
+func dohExchange(t *testing.T, method string, m *dns.Msg, contentType string, forwardedFor string) (*dns.Msg, int) {
+	buf, _ := m.Pack()
+	var req *http.Request
+	if method == http.MethodGet {
+		req, _ = http.NewRequest(http.MethodGet, "http://127.0.0.1:10556/resolve?dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req, _ = http.NewRequest(http.MethodPost, "http://127.0.0.1:10556/resolve", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", contentType)
+	}
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("doh request failed : ", err)
+		t.Fail()
+		return nil, 0
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	if resp.Header.Get("Content-Type") != "application/dns-message" {
+		fmt.Println("invalid content type : ", resp.Header.Get("Content-Type"))
+		t.Fail()
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		fmt.Println("invalid response : ", err)
+		t.Fail()
+		return nil, resp.StatusCode
+	}
+	return r, resp.StatusCode
+}
+
+func TestDoh(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	h := NewHandler(&handlerTestConfig)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", dohZone)
+	for _, cmd := range dohEntries {
+		h.testRedis().HSet("redins:zones:"+dohZone, cmd[0], cmd[1])
+	}
+	h.LoadZones()
+
+	l := NewRateLimiter(&RateLimiterConfig{
+		Enable:    true,
+		Rate:      60000,
+		Burst:     10,
+		BlackList: []string{"10.10.10.10"},
+	})
+	servers, err := NewServer([]ServerConfig{
+		{Ip: "127.0.0.1", Port: 10556, Protocol: "https", Path: "/resolve", TrustedProxies: []string{"127.0.0.0/8"}},
+	}, h.TsigProvider())
+	if err != nil {
+		fmt.Println("cannot create servers : ", err)
+		t.FailNow()
+	}
+	servers[0].(*DohServer).Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		state := request.Request{W: w, Req: r}
+		if l.CanHandle(state.IP()) {
+			h.HandleRequest(&state)
+		} else {
+			msg := new(dns.Msg)
+			msg.SetRcode(r, dns.RcodeRefused)
+			state.W.WriteMsg(msg)
+		}
+	})
+	go servers[0].ListenAndServe()
+	defer servers[0].Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.doh.zon.", dns.TypeA)
+	m.Id = 0
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		r, status := dohExchange(t, method, m, "application/dns-message", "")
+		if status != http.StatusOK || r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+			fmt.Println(method, "unexpected response : ", status, r)
+			t.Fail()
+		}
+	}
+
+	// transfers don't fit in a single response
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		transfer := new(dns.Msg)
+		transfer.SetQuestion(dohZone, qtype)
+		transfer.Id = 0
+		if r, _ := dohExchange(t, http.MethodPost, transfer, "application/dns-message", ""); r == nil || r.Rcode != dns.RcodeRefused {
+			fmt.Println("transfer not refused : ", r)
+			t.Fail()
+		}
+	}
+
+	if _, status := dohExchange(t, http.MethodPost, m, "text/plain", ""); status != http.StatusUnsupportedMediaType {
+		fmt.Println("unexpected status : ", status)
+		t.Fail()
+	}
+
+	// client address is taken from X-Forwarded-For set by trusted proxies
+	r, _ := dohExchange(t, http.MethodGet, m, "", "10.10.10.10, 127.0.0.2")
+	if r == nil || r.Rcode != dns.RcodeRefused {
+		fmt.Println("expected refused : ", r)
+		t.Fail()
+	}
+	r, _ = dohExchange(t, http.MethodGet, m, "", "127.0.0.3, 10.10.10.11")
+	if r == nil || r.Rcode != dns.RcodeSuccess {
+		fmt.Println("expected success : ", r)
+		t.Fail()
+	}
+
+	// connections sending incomplete requests are closed
+	conn, err := net.Dial("tcp", "127.0.0.1:10556")
+	if err != nil {
+		fmt.Println("cannot connect : ", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /resolve HTTP/1.1\r\n"))
+	conn.SetReadDeadline(time.Now().Add(dohReadTimeout * 2))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 512)); err != io.EOF || time.Since(start) >= dohReadTimeout*2 {
+		fmt.Println("connection not closed : ", err)
+		t.Fail()
+	}
+}
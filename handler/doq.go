@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	doqAlpn          = "doq"
+	doqNoError       = 0x0
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+	doqIdleTimeout   = 30 * time.Second
+	doqReadTimeout   = 5 * time.Second
+)
+
+// DoqServer serves dns over quic (RFC 9250)
+type DoqServer struct {
+	Handler      dns.Handler
+	TsigProvider dns.TsigProvider
+	addr         string
+	tlsConfig    *tls.Config
+	lock         sync.Mutex
+	listener     *quic.Listener
+	ctx          context.Context
+	cancel       context.CancelFunc
+}
+
+func NewDoqServer(config ServerConfig, tlsConfig *tls.Config, tsigProvider dns.TsigProvider) *DoqServer {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{doqAlpn}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	s := &DoqServer{
+		TsigProvider: tsigProvider,
+		addr:         config.Ip + ":" + strconv.Itoa(config.Port),
+		tlsConfig:    tlsConfig,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *DoqServer) ListenAndServe() error {
+	listener, err := quic.ListenAddr(s.addr, s.tlsConfig, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConnection(conn)
+	}
+}
+
+func (s *DoqServer) Shutdown() error {
+	s.cancel()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *DoqServer) serveConnection(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(s.ctx)
+		if err != nil {
+			conn.CloseWithError(doqNoError, "")
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+func (s *DoqServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(doqReadTimeout))
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		conn.CloseWithError(doqProtocolError, "cannot read message length")
+		return
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		conn.CloseWithError(doqProtocolError, "cannot read message")
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		conn.CloseWithError(doqProtocolError, "invalid dns message")
+		return
+	}
+	// message id must be 0 (RFC 9250 section 4.2.1)
+	if req.Id != 0 {
+		conn.CloseWithError(doqProtocolError, "non-zero message id")
+		return
+	}
+
+	w := newMsgResponseWriter(streamAddr(conn.LocalAddr()), streamAddr(conn.RemoteAddr()), s.TsigProvider, req, buf)
+	handler := s.Handler
+	if handler == nil {
+		handler = dns.DefaultServeMux
+	}
+	if !refuseTransfer(w, req) {
+		handler.ServeDNS(w, req)
+	}
+	if w.msg == nil {
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+
+	out := make([]byte, 2+len(w.msg))
+	binary.BigEndian.PutUint16(out, uint16(len(w.msg)))
+	copy(out[2:], w.msg)
+	if _, err := stream.Write(out); err != nil {
+		logger.Default.Errorf("cannot write doq response to %s : %s", conn.RemoteAddr(), err)
+	}
+}
+
+// streamAddr converts quic addresses so responses are not truncated as they would be for udp
+func streamAddr(addr net.Addr) net.Addr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port, Zone: udpAddr.Zone}
+	}
+	return addr
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+var doqZone = "doq.zon."
+
+var doqEntries = [][]string{
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`,
+	},
+}
+
+func doqExchange(addr string, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	if _, err := stream.Write(out); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	in := make([]byte, length)
+	if _, err := io.ReadFull(stream, in); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(in); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func TestDoq(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	dir, _ := ioutil.TempDir("", "redins")
+	defer os.RemoveAll(dir)
+	certPath, keyPath, err := writeTestCert(dir, "server", 1)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	h := NewHandler(&handlerTestConfig)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", doqZone)
+	for _, cmd := range doqEntries {
+		h.testRedis().HSet("redins:zones:"+doqZone, cmd[0], cmd[1])
+	}
+	h.LoadZones()
+
+	if _, err := NewServer([]ServerConfig{{Ip: "127.0.0.1", Port: 10559, Protocol: "quic"}}, nil); err == nil {
+		fmt.Println("quic listener without tls accepted")
+		t.Fail()
+	}
+	servers, err := NewServer([]ServerConfig{
+		{Ip: "127.0.0.1", Port: 10559, Protocol: "quic", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath}},
+	}, h.TsigProvider())
+	if err != nil {
+		fmt.Println("cannot create servers : ", err)
+		t.FailNow()
+	}
+	servers[0].(*DoqServer).Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		state := request.Request{W: w, Req: r}
+		h.HandleRequest(&state)
+	})
+	go servers[0].ListenAndServe()
+	defer servers[0].Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.doq.zon.", dns.TypeA)
+	m.Id = 0
+	r, err := doqExchange("127.0.0.1:10559", m)
+	if err != nil || r.Id != 0 || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "2.2.2.2" {
+		fmt.Println("unexpected response : ", r, err)
+		t.Fail()
+	}
+
+	// transfers don't fit in a single response
+	transfer := new(dns.Msg)
+	transfer.SetAxfr(doqZone)
+	transfer.Id = 0
+	if r, err := doqExchange("127.0.0.1:10559", transfer); err != nil || r.Rcode != dns.RcodeRefused {
+		fmt.Println("transfer not refused : ", r, err)
+		t.Fail()
+	}
+
+	// message id must be 0
+	m.Id = 1234
+	if r, err := doqExchange("127.0.0.1:10559", m); err == nil {
+		fmt.Println("non-zero message id accepted : ", r)
+		t.Fail()
+	}
+}
@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const defaultFileStoreReloadInterval = 60
+
+// zoneFile is the json format of a zone in file store
+type zoneFile struct {
+	Config    json.RawMessage            `json:"config,omitempty"`
+	Locations map[string]json.RawMessage `json:"locations,omitempty"`
+	Keys      map[string]string          `json:"keys,omitempty"`
+}
+
+// FileStore keeps each zone in <path>/<zone>.json, files are checked for changes every reload interval.
+// zones in master files, <path>/<zone>.zone, are loaded as well but cannot be changed through store
+type FileStore struct {
+	*MemoryStore
+	path     string
+	interval time.Duration
+	fileLock sync.Mutex
+	modTimes map[string]time.Time
+	files    map[string]string // zone -> loaded file
+	quit     chan struct{}
+}
+
+func NewFileStore(path string, reloadInterval int) (*FileStore, error) {
+	if path == "" {
+		return nil, errors.New("path is not set for file store")
+	}
+	if info, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "cannot access %s", path)
+	} else if !info.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", path)
+	}
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+		interval:    time.Duration(reloadInterval) * time.Second,
+		modTimes:    make(map[string]time.Time),
+		files:       make(map[string]string),
+		quit:        make(chan struct{}),
+	}
+	if reloadInterval == 0 {
+		s.interval = defaultFileStoreReloadInterval * time.Second
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(s.interval):
+				if err := s.Reload(); err != nil {
+					logger.Default.Errorf("cannot reload zones from %s : %s", s.path, err)
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *FileStore) ShutDown() {
+	close(s.quit)
+}
+
+func (s *FileStore) fileName(zone string) string {
+	return filepath.Join(s.path, strings.TrimSuffix(zone, ".")+".json")
+}
+
+// Reload loads zone files changed since last load, json file of a zone is used if it has a master file too
+func (s *FileStore) Reload() error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	masterFiles, err := filepath.Glob(filepath.Join(s.path, "*.zone"))
+	if err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(s.path, "*.json"))
+	if err != nil {
+		return err
+	}
+	zoneFiles := make(map[string]string)
+	for _, file := range append(masterFiles, files...) {
+		zone := dns.Fqdn(strings.ToLower(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))))
+		zoneFiles[zone] = file
+	}
+	seen := make(map[string]bool)
+	for zone, file := range zoneFiles {
+		seen[zone] = true
+		info, err := os.Stat(file)
+		if err != nil {
+			logger.Default.Errorf("cannot access %s : %s", file, err)
+			continue
+		}
+		if modTime, ok := s.modTimes[zone]; ok && modTime.Equal(info.ModTime()) && s.files[zone] == file {
+			continue
+		}
+		var zf *zoneFile
+		if filepath.Ext(file) == ".zone" {
+			zf, err = readMasterFile(zone, file)
+		} else {
+			zf, err = readZoneFile(file)
+		}
+		if err != nil {
+			logger.Default.Errorf("cannot load %s : %s", file, err)
+			continue
+		}
+		s.modTimes[zone] = info.ModTime()
+		s.files[zone] = file
+		s.loadZone(zone, zf)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for zone, z := range s.zones {
+		if z.listed && !seen[zone] {
+			delete(s.zones, zone)
+			delete(s.modTimes, zone)
+			delete(s.files, zone)
+			s.zonesChanged()
+		}
+	}
+	return nil
+}
+
+func readZoneFile(file string) (*zoneFile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	zf := new(zoneFile)
+	if err := json.Unmarshal(data, zf); err != nil {
+		return nil, err
+	}
+	return zf, nil
+}
+
+// readMasterFile parses a zone master file into a temporary store
+func readMasterFile(zone string, file string) (*zoneFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	store := NewMemoryStore()
+	if err := ImportZone(store, zone, f, file); err != nil {
+		return nil, err
+	}
+	zf := &zoneFile{Locations: make(map[string]json.RawMessage)}
+	config, _ := store.GetZoneConfig(zone)
+	zf.Config = json.RawMessage(config)
+	labels, _ := store.GetLocations(zone)
+	for _, label := range labels {
+		value, _ := store.GetLocation(zone, label)
+		zf.Locations[label] = json.RawMessage(value)
+	}
+	return zf, nil
+}
+
+// writable returns an error for zones loaded from master files, changes could not be written back to them
+func (s *FileStore) writable(zone string) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if filepath.Ext(s.files[zone]) == ".zone" {
+		return errors.Errorf("zone %s is loaded from master file %s and cannot be changed", zone, s.files[zone])
+	}
+	return nil
+}
+
+func (s *FileStore) loadZone(zone string, zf *zoneFile) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	z := s.zone(zone)
+	if !z.listed {
+		z.listed = true
+		s.zonesChanged()
+	}
+	if config := string(zf.Config); config != z.config {
+		z.config = config
+		s.zoneChanged(zone, true)
+	}
+	z.locations = make(map[string]string)
+	for label, value := range zf.Locations {
+		z.locations[label] = string(value)
+	}
+	z.keys = make(map[string]string)
+	for name, value := range zf.Keys {
+		z.keys[name] = value
+	}
+	s.zoneChanged(zone, false)
+}
+
+// save writes zone to its file, a temporary file is used so readers never see partial files
+func (s *FileStore) save(zone string) error {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	zf := &zoneFile{
+		Locations: make(map[string]json.RawMessage),
+		Keys:      make(map[string]string),
+	}
+	s.lock.RLock()
+	if z, ok := s.zones[zone]; ok {
+		if z.config != "" {
+			zf.Config = json.RawMessage(z.config)
+		}
+		for label, value := range z.locations {
+			zf.Locations[label] = json.RawMessage(value)
+		}
+		for name, value := range z.keys {
+			zf.Keys[name] = value
+		}
+	}
+	s.lock.RUnlock()
+
+	data, err := json.MarshalIndent(zf, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode zone %s", zone)
+	}
+	file := s.fileName(zone)
+	tmp, err := ioutil.TempFile(s.path, ".redins")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if info, err := os.Stat(file); err == nil {
+		s.modTimes[zone] = info.ModTime()
+		s.files[zone] = file
+	}
+	return nil
+}
+
+func (s *FileStore) AddZone(zone string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.AddZone(zone); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) RemoveZone(zone string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.RemoveZone(zone); err != nil {
+		return err
+	}
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	delete(s.modTimes, zone)
+	delete(s.files, zone)
+	if err := os.Remove(s.fileName(zone)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) SetZoneConfig(zone string, config string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.SetZoneConfig(zone, config); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) SetLocation(zone string, label string, value string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.SetLocation(zone, label, value); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) RemoveLocation(zone string, label string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.RemoveLocation(zone, label); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) SetLocations(zone string, locations map[string]string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.SetLocations(zone, locations); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) UpdateLocations(zone string, locations map[string]string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.UpdateLocations(zone, locations); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) SetKey(zone string, name string, value string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.SetKey(zone, name, value); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
+
+func (s *FileStore) SetKeys(zone string, keys map[string]string) error {
+	if err := s.writable(zone); err != nil {
+		return err
+	}
+	if err := s.MemoryStore.SetKeys(zone, keys); err != nil {
+		return err
+	}
+	return s.save(zone)
+}
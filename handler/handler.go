@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"crypto"
+	"encoding/hex"
 	"encoding/json"
+	"math"
 	"math/rand"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,35 +18,64 @@ import (
 	"github.com/hawell/uperdis"
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
 )
 
 type DnsRequestHandler struct {
 	Config         *HandlerConfig
 	Zones          *iradix.Tree
 	LastZoneUpdate time.Time
-	Redis          *uperdis.Redis
+	Store          ZoneStore
 	Logger         *logger.EventLogger
 	RecordCache    *cache.Cache
 	ZoneCache      *cache.Cache
 	geoip          *GeoIp
 	healthcheck    *Healthcheck
 	upstream       *Upstream
+	secondary      *Secondary
+	notifier       *Notifier
+	keyManager     *KeyManager
+	signatures     *SignatureCache
+	tsig           *TsigKeyStore
 	quit           chan struct{}
 	quitWG         sync.WaitGroup
 	numRoutines    int
 }
 
+// ttl of synthesized HINFO answer to ANY queries, limited by max_ttl
+const anyHinfoTtl = 86400
+
+// validators treat nsec3 with more iterations as insecure (RFC 9276)
+const nsec3MaxIterations = 150
+
+const (
+	zoneLockTtl   = 10 * time.Second
+	zoneLockWait  = 2 * time.Second
+	zoneLockRetry = 10 * time.Millisecond
+)
+
 type HandlerConfig struct {
-	Upstream          []UpstreamConfig    `json:"upstream,omitempty"`
-	GeoIp             GeoIpConfig         `json:"geoip,omitempty"`
-	HealthCheck       HealthcheckConfig   `json:"healthcheck,omitempty"`
-	MaxTtl            int                 `json:"max_ttl,omitempty"`
-	CacheTimeout      int                 `json:"cache_timeout,omitempty"`
-	ZoneReload        int                 `json:"zone_reload,omitempty"`
-	LogSourceLocation bool                `json:"log_source_location,omitempty"`
-	UpstreamFallback  bool                `json:"upstream_fallback,omitempty"`
-	Redis             uperdis.RedisConfig `json:"redis,omitempty"`
-	Log               logger.LogConfig    `json:"log,omitempty"`
+	Upstream          []UpstreamConfig      `json:"upstream,omitempty"`
+	GeoIp             GeoIpConfig           `json:"geoip,omitempty"`
+	HealthCheck       HealthcheckConfig     `json:"healthcheck,omitempty"`
+	MaxTtl            int                   `json:"max_ttl,omitempty"`
+	CacheTimeout      int                   `json:"cache_timeout,omitempty"`
+	ZoneReload        int                   `json:"zone_reload,omitempty"`
+	LogSourceLocation bool                  `json:"log_source_location,omitempty"`
+	UpstreamFallback  bool                  `json:"upstream_fallback,omitempty"`
+	Redis             uperdis.RedisConfig   `json:"redis,omitempty"`
+	Store             StoreConfig           `json:"store,omitempty"`
+	Log               logger.LogConfig      `json:"log,omitempty"`
+	Secondary         []SecondaryZoneConfig `json:"secondary,omitempty"`
+	TsigKeys          []TsigKey             `json:"tsig_keys,omitempty"`
+	KeyManager        KeyManagerConfig      `json:"key_manager,omitempty"`
+	Any               AnyConfig             `json:"any,omitempty"`
+}
+
+// AnyConfig sets how ANY queries are answered (RFC 8482)
+type AnyConfig struct {
+	Response string   `json:"response,omitempty"`
+	TcpAllow []string `json:"tcp_allow,omitempty"`
 }
 
 func NewHandler(config *HandlerConfig) *DnsRequestHandler {
@@ -50,10 +83,15 @@ func NewHandler(config *HandlerConfig) *DnsRequestHandler {
 		Config: config,
 	}
 
-	h.Redis = uperdis.NewRedis(&config.Redis)
+	store, err := NewZoneStore(&config.Store, &config.Redis)
+	if err != nil {
+		logger.Default.Errorf("cannot create zone store, no zones will be served : %s", err)
+		store = NewMemoryStore()
+	}
+	h.Store = store
 	h.Logger = logger.NewLogger(&config.Log)
 	h.geoip = NewGeoIp(&config.GeoIp)
-	h.healthcheck = NewHealthcheck(&config.HealthCheck, h.Redis)
+	h.healthcheck = NewHealthcheck(&config.HealthCheck, h.Store)
 	h.upstream = NewUpstream(config.Upstream)
 	h.Zones = iradix.New()
 	h.quit = make(chan struct{}, 1)
@@ -62,10 +100,24 @@ func NewHandler(config *HandlerConfig) *DnsRequestHandler {
 
 	h.RecordCache = cache.New(time.Second*time.Duration(h.Config.CacheTimeout), time.Duration(h.Config.CacheTimeout)*time.Second*10)
 	h.ZoneCache = cache.New(time.Second*time.Duration(h.Config.CacheTimeout), time.Duration(h.Config.CacheTimeout)*time.Second*10)
+	h.signatures = NewSignatureCache()
 
 	go h.healthcheck.Start()
 
-	if h.Redis.SubscribeEvent("redins:zones", func(channel string, event string) {
+	h.tsig = NewTsigKeyStore(config.TsigKeys, h.Store, config.CacheTimeout)
+
+	h.secondary = NewSecondary(config.Secondary, h)
+	h.secondary.Start()
+
+	h.notifier = NewNotifier(h)
+	if h.Store.SubscribeZoneChanges(h.notifier.ZoneEvent) != nil {
+		logger.Default.Warning("event notification is not available, zone changes will not be notified to secondaries")
+	}
+
+	h.keyManager = NewKeyManager(&config.KeyManager, h)
+	h.keyManager.Start()
+
+	if h.Store.SubscribeZones(func() {
 		logger.Default.Debug("loading zones")
 		h.LoadZones()
 	}) != nil {
@@ -93,6 +145,10 @@ func NewHandler(config *HandlerConfig) *DnsRequestHandler {
 func (h *DnsRequestHandler) ShutDown() {
 	// fmt.Println("handler : stopping")
 	h.healthcheck.ShutDown()
+	h.secondary.ShutDown()
+	h.keyManager.ShutDown()
+	h.notifier.ShutDown()
+	h.Store.ShutDown()
 	h.quitWG.Add(h.numRoutines)
 	close(h.quit)
 	h.quitWG.Wait()
@@ -123,6 +179,39 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 		logData["source_asn"] = sourceASN
 	}
 
+	if state.Req.IsTsig() != nil && state.W.TsigStatus() != nil {
+		res := h.tsigError(state)
+		h.LogRequest(logData, requestStartTime, res)
+		return
+	}
+
+	if state.Req.Opcode == dns.OpcodeNotify {
+		res := h.HandleNotify(state)
+		h.LogRequest(logData, requestStartTime, res)
+		return
+	}
+
+	if state.Req.Opcode == dns.OpcodeUpdate {
+		res := h.HandleUpdate(state)
+		h.LogRequest(logData, requestStartTime, res)
+		return
+	}
+
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		res := h.HandleTransfer(state)
+		h.LogRequest(logData, requestStartTime, res)
+		return
+	}
+
+	// NXNAME is a meta type (RFC 9824 section 3.1)
+	if qtype == dns.TypeNXNAME {
+		m := new(dns.Msg)
+		m.SetRcode(state.Req, dns.RcodeFormatError)
+		h.LogRequest(logData, requestStartTime, dns.RcodeFormatError)
+		state.W.WriteMsg(m)
+		return
+	}
+
 	auth := true
 
 	var record *Record
@@ -130,61 +219,93 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 	var res int
 	var answers []dns.RR
 	var authority []dns.RR
+	var extra []dns.RR
 	record, localRes = h.FetchRecord(qname, logData)
 	originalRecord := record
+	// set when a dname redirects query out of zone, qtype is CNAME or an external cname target is flattened, nothing is left to answer from zone data
+	redirected := false
+	// minimum ttl of flattened cnames
+	chainTtl := uint32(math.MaxUint32)
+	// set when qname is at or below a delegation point
+	referral := false
 	if record != nil {
 		logData["domain_uuid"] = record.Zone.Config.DomainId
-		if qtype != dns.TypeCNAME {
-			count := 0
-			for {
-				if count >= 10 {
-					answers = []dns.RR{}
-					localRes = dns.RcodeServerFailure
+		count := 0
+		for {
+			if count >= 10 {
+				answers = []dns.RR{}
+				localRes = dns.RcodeServerFailure
+				break
+			}
+			if localRes != dns.RcodeSuccess {
+				break
+			}
+			// names at or below a delegation point get a referral, except ds which belongs to parent side (RFC 4035 section 3.1.4.1)
+			if isDelegation(record) && !(qtype == dns.TypeDS && qname == record.Name) {
+				if len(answers) == 0 {
+					referral = true
+				} else {
+					redirected = true
+				}
+				break
+			}
+			if record.DNAME != nil && qname != record.Name && dns.IsSubDomain(record.Name, qname) {
+				target := dnameTarget(qname, record)
+				answers = append(answers, h.DNAME(record.Name, record)...)
+				if _, ok := dns.IsDomainName(target); !ok {
+					localRes = dns.RcodeYXDomain
 					break
 				}
-				if localRes != dns.RcodeSuccess {
+				answers = append(answers, h.synthesizedCNAME(qname, target, record))
+				if qtype == dns.TypeCNAME || h.Matches(target) != originalRecord.Zone.Name {
+					redirected = true
 					break
 				}
-				if record.CNAME == nil {
+				qname = target
+				record, localRes = h.FetchRecord(qname, logData)
+				count++
+				continue
+			}
+			// cname is an answer to ANY queries
+			if qtype == dns.TypeCNAME || qtype == dns.TypeANY || record.CNAME == nil {
+				break
+			}
+			if !record.Zone.Config.CnameFlattening {
+				answers = append(answers, h.CNAME(qname, record)...)
+				if h.Matches(record.CNAME.Host) != originalRecord.Zone.Name {
 					break
 				}
-				if !record.Zone.Config.CnameFlattening {
-					answers = append(answers, h.CNAME(qname, record)...)
-					if h.Matches(record.CNAME.Host) != originalRecord.Zone.Name {
-						break
+				qname = record.CNAME.Host
+			} else {
+				if ttl := h.getTtl(record.CNAME.Ttl); ttl < chainTtl {
+					chainTtl = ttl
+				}
+				if h.Matches(record.CNAME.Host) == "" && len(h.Config.Upstream) > 0 && flattenedType(qtype) {
+					answers, localRes = h.flattenExternal(qname, dns.Fqdn(record.CNAME.Host), qtype, chainTtl)
+					if localRes == dns.RcodeSuccess && len(answers) == 0 {
+						authority = append(authority, originalRecord.Zone.Config.SOA.Data)
 					}
-					qname = record.CNAME.Host
+					redirected = true
+					break
 				}
-				record, localRes = h.FetchRecord(record.CNAME.Host, logData)
-				count++
 			}
+			record, localRes = h.FetchRecord(record.CNAME.Host, logData)
+			count++
 		}
 	}
 
 	res = localRes
-	if localRes == dns.RcodeSuccess {
+	if referral {
+		auth = false
+		authority, extra = h.Referral(state, record)
+	} else if localRes == dns.RcodeSuccess && !redirected {
+		var anameAnswers []dns.RR
 		switch qtype {
 		case dns.TypeA:
 			if len(record.A.Data) == 0 {
-				if record.ANAME != nil {
-					anameAnswer, anameRes := h.FetchRecord(record.ANAME.Location, logData)
-					if anameRes == dns.RcodeSuccess {
-						ips := h.Filter(state, &anameAnswer.A, logData)
-						answers = append(answers, h.A(qname, anameAnswer, ips)...)
-					} else {
-						upstreamAnswers, upstreamRes := h.upstream.Query(record.ANAME.Location, dns.TypeA)
-						if upstreamRes == dns.RcodeSuccess {
-							var anameRecord []dns.RR
-							for _, r := range upstreamAnswers {
-								if r.Header().Name == record.ANAME.Location && r.Header().Rrtype == dns.TypeA {
-									a := r.(*dns.A)
-									anameRecord = append(anameRecord, &dns.A{A: a.A, Hdr: dns.RR_Header{Rrtype: dns.TypeA, Name: qname, Ttl: a.Hdr.Ttl, Class: dns.ClassINET, Rdlength: 0}})
-								}
-							}
-							answers = append(answers, anameRecord...)
-						}
-						res = upstreamRes
-					}
+				if record.ANAME.serves(qtype) {
+					anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+					answers = append(answers, anameAnswers...)
 				}
 			} else {
 				ips := h.Filter(state, &record.A, logData)
@@ -192,25 +313,9 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 			}
 		case dns.TypeAAAA:
 			if len(record.AAAA.Data) == 0 {
-				if record.ANAME != nil {
-					anameAnswer, anameRes := h.FetchRecord(record.ANAME.Location, logData)
-					if anameRes == dns.RcodeSuccess {
-						ips := h.Filter(state, &anameAnswer.AAAA, logData)
-						answers = append(answers, h.AAAA(qname, anameAnswer, ips)...)
-					} else {
-						upstreamAnswers, upstreamRes := h.upstream.Query(record.ANAME.Location, dns.TypeAAAA)
-						if upstreamRes == dns.RcodeSuccess {
-							var anameRecord []dns.RR
-							for _, r := range upstreamAnswers {
-								if r.Header().Name == record.ANAME.Location && r.Header().Rrtype == dns.TypeAAAA {
-									a := r.(*dns.AAAA)
-									anameRecord = append(anameRecord, &dns.AAAA{AAAA: a.AAAA, Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA, Name: qname, Ttl: a.Hdr.Ttl, Class: dns.ClassINET, Rdlength: 0}})
-								}
-							}
-							answers = append(answers, anameRecord...)
-						}
-						res = upstreamRes
-					}
+				if record.ANAME.serves(qtype) {
+					anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+					answers = append(answers, anameAnswers...)
 				}
 			} else {
 				ips := h.Filter(state, &record.AAAA, logData)
@@ -218,29 +323,83 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 			}
 		case dns.TypeCNAME:
 			answers = append(answers, h.CNAME(qname, record)...)
+		case dns.TypeDNAME:
+			answers = append(answers, h.DNAME(qname, record)...)
 		case dns.TypeTXT:
-			answers = append(answers, h.TXT(qname, record)...)
+			if len(record.TXT.Data) == 0 && record.ANAME.serves(qtype) {
+				anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+				answers = append(answers, anameAnswers...)
+			} else {
+				answers = append(answers, h.TXT(qname, record)...)
+			}
 		case dns.TypeNS:
 			answers = append(answers, h.NS(qname, record)...)
 		case dns.TypeMX:
-			answers = append(answers, h.MX(qname, record)...)
+			if len(record.MX.Data) == 0 && record.ANAME.serves(qtype) {
+				anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+				answers = append(answers, anameAnswers...)
+			} else {
+				answers = append(answers, h.MX(qname, record)...)
+			}
 		case dns.TypeSRV:
 			answers = append(answers, h.SRV(qname, record)...)
 		case dns.TypeCAA:
-			caaRecord := h.FindCAA(record)
-			if caaRecord != nil {
-				answers = append(answers, h.CAA(qname, caaRecord)...)
+			if len(record.CAA.Data) == 0 && record.ANAME.serves(qtype) {
+				anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+				answers = append(answers, anameAnswers...)
+			}
+			// no aname records, tree climbing is done for owner name (RFC 8659 section 3)
+			if len(anameAnswers) == 0 && res == dns.RcodeSuccess {
+				caaRecord := h.FindCAA(record)
+				if caaRecord != nil {
+					answers = append(answers, h.CAA(qname, caaRecord)...)
+				}
 			}
 		case dns.TypePTR:
 			answers = append(answers, h.PTR(qname, record)...)
 		case dns.TypeTLSA:
 			answers = append(answers, h.TLSA(qname, record)...)
+		case dns.TypeSSHFP:
+			answers = append(answers, h.SSHFP(qname, record)...)
+		case dns.TypeNAPTR:
+			answers = append(answers, h.NAPTR(qname, record)...)
+		case dns.TypeDS:
+			answers = append(answers, h.DS(qname, record)...)
+		case dns.TypeHINFO:
+			answers = append(answers, h.HINFO(qname, record)...)
+		case dns.TypeLOC:
+			answers = append(answers, h.LOC(qname, record)...)
+		case dns.TypeURI:
+			answers = append(answers, h.URI(qname, record)...)
+		case dns.TypeSVCB:
+			answers = append(answers, h.SVCB(qname, record)...)
+		case dns.TypeHTTPS:
+			if len(record.HTTPS.Data) == 0 && record.ANAME.serves(qtype) {
+				anameAnswers, res = h.ANAME(state, qname, record.ANAME, qtype, logData)
+				answers = append(answers, anameAnswers...)
+			} else {
+				answers = append(answers, h.HTTPS(qname, record)...)
+			}
 		case dns.TypeSOA:
 			answers = append(answers, record.Zone.Config.SOA.Data)
 		case dns.TypeDNSKEY:
 			if record.Zone.Config.DnsSec {
-				answers = []dns.RR{record.Zone.ZSK.DnsKey, record.Zone.KSK.DnsKey}
+				answers = append([]dns.RR{}, record.Zone.DnsKeys...)
+			}
+		case dns.TypeCDS:
+			if record.Zone.Config.DnsSec && qname == record.Zone.Name {
+				answers = CDS(record.Zone)
+			}
+		case dns.TypeCDNSKEY:
+			if record.Zone.Config.DnsSec && qname == record.Zone.Name {
+				answers = CDNSKEY(record.Zone)
+			}
+		case dns.TypeNSEC3PARAM:
+			if record.Zone.Config.DnsSec && record.Zone.Config.NSEC3 != nil && qname == record.Zone.Name {
+				answers = []dns.RR{NSec3Param(record.Zone)}
 			}
+		case dns.TypeANY:
+			answers = h.ANY(state, qname, record, logData)
 		default:
 			answers = []dns.RR{}
 			authority = []dns.RR{}
@@ -273,17 +432,44 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 	}
 
 	if 	auth && state.Do() && originalRecord != nil && originalRecord.Zone.Config.DnsSec {
+		nsec3 := originalRecord.Zone.Config.NSEC3 != nil
 		switch res {
 		case dns.RcodeSuccess:
 			if len(answers) == 0 {
-				authority = append(authority, NSec(qname, originalRecord.Zone))
+				if nsec3 {
+					authority = append(authority, h.NSec3(qname, originalRecord, false)...)
+				} else {
+					authority = append(authority, NSec(qname, originalRecord.Zone, h.typeBitMap(originalRecord)))
+				}
 			}
 		case dns.RcodeNameError:
-			authority = append(authority, NSec(qname, originalRecord.Zone))
-			res = dns.RcodeSuccess
+			if nsec3 {
+				authority = append(authority, h.NSec3(qname, originalRecord, true)...)
+			} else {
+				authority = append(authority, NSec(qname, originalRecord.Zone, []uint16{dns.TypeNXNAME}))
+				// nxdomain is restored only for clients understanding compact answers
+				if opt := state.Req.IsEdns0(); opt == nil || !opt.Co() {
+					res = dns.RcodeSuccess
+				}
+			}
 		}
-		answers = Sign(answers, qname, originalRecord)
-		authority = Sign(authority, qname, originalRecord)
+		// wildcard expansions need proof that the next closer name doesn't exist (RFC 4035 section 5.3.4, RFC 5155 section 7.2.6)
+		wildcards := h.wildcardSources(answers, originalRecord.Zone)
+		for owner, source := range wildcards {
+			nextCloser := wildcardNextCloser(owner, source)
+			if nsec3 {
+				authority = append(authority, nsec3Cover(nextCloser, originalRecord.Zone))
+			} else {
+				authority = append(authority, NSecCover(nextCloser, originalRecord.Zone))
+			}
+		}
+		answers = h.Sign(answers, qname, originalRecord, wildcards)
+		authority = h.Sign(authority, qname, originalRecord, nil)
+	}
+
+	var additional [][]dns.RR
+	if auth && res == dns.RcodeSuccess && originalRecord != nil && !originalRecord.Zone.Config.MinimalResponses {
+		additional = h.Additional(state, answers, originalRecord.Zone)
 	}
 
 
@@ -294,12 +480,290 @@ func (h *DnsRequestHandler) HandleRequest(state *request.Request) {
 	m.SetRcode(state.Req, res)
 	m.Answer = append(m.Answer, answers...)
 	m.Ns = append(m.Ns, authority...)
+	m.Extra = append(m.Extra, extra...)
 
 	state.SizeAndDo(m)
+	// additional data is only added if it fits, missing additional data doesn't need truncation (RFC 2181 section 9)
+	for _, set := range additional {
+		m.Extra = append(m.Extra, set...)
+		if m.Len() > state.Size() {
+			m.Extra = m.Extra[:len(m.Extra)-len(set)]
+			break
+		}
+	}
 	m = state.Scrub(m)
+	signResponse(state, m)
 	state.W.WriteMsg(m)
 }
 
+// flattenExternal returns qtype records of target, a name outside our zones, renamed to qname with ttl limited to ttl
+func (h *DnsRequestHandler) flattenExternal(qname string, target string, qtype uint16, ttl uint32) ([]dns.RR, int) {
+	rrs, res := h.upstream.Resolve(target, qtype)
+	switch res {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		// qname exists even if target doesn't
+		return []dns.RR{}, dns.RcodeSuccess
+	default:
+		return []dns.RR{}, res
+	}
+	answers := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr.Header().Name = qname
+		if rr.Header().Ttl > ttl {
+			rr.Header().Ttl = ttl
+		}
+		answers = append(answers, rr)
+	}
+	return answers, dns.RcodeSuccess
+}
+
+func flattenedType(qtype uint16) bool {
+	return qtype == dns.TypeA || qtype == dns.TypeAAAA || qtype == dns.TypeHTTPS
+}
+
+// ANAME returns qtype records of the first aname target having them renamed to qname, addresses are filtered like local records
+func (h *DnsRequestHandler) ANAME(state *request.Request, qname string, aname *ANAME_Record, qtype uint16, logData map[string]interface{}) ([]dns.RR, int) {
+	res := dns.RcodeSuccess
+	for _, target := range anameOrder(aname.targets()) {
+		location := dns.Fqdn(target.Location)
+		var answers []dns.RR
+		if h.Matches(location) != "" {
+			answers = h.anameLocal(state, qname, location, qtype, logData)
+		} else {
+			var targetRes int
+			answers, targetRes = h.flattenExternal(qname, location, qtype, math.MaxUint32)
+			if targetRes != dns.RcodeSuccess {
+				res = targetRes
+				continue
+			}
+			answers = h.anameFilter(state, qname, location, aname, answers, logData)
+		}
+		if len(answers) > 0 {
+			return answers, dns.RcodeSuccess
+		}
+	}
+	return []dns.RR{}, res
+}
+
+// anameOrder sorts targets by priority, the first target of each priority is chosen by weight and others are kept for failover
+func anameOrder(targets []ANAME_Target) []ANAME_Target {
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Priority < targets[j].Priority })
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && targets[end].Priority == targets[start].Priority {
+			end++
+		}
+		if end-start > 1 {
+			weights := make([]IP_RR, end-start)
+			for i := range weights {
+				weights[i].Weight = targets[start+i].Weight
+			}
+			index := start + ChooseIp(weights, true)
+			targets[start], targets[index] = targets[index], targets[start]
+		}
+		start = end
+	}
+	return targets
+}
+
+// anameLocal returns qtype records of location in our zones renamed to qname
+func (h *DnsRequestHandler) anameLocal(state *request.Request, qname string, location string, qtype uint16, logData map[string]interface{}) []dns.RR {
+	record, res := h.FetchRecord(location, logData)
+	if res != dns.RcodeSuccess {
+		return nil
+	}
+	switch qtype {
+	case dns.TypeA:
+		return h.A(qname, record, h.Filter(targetRequest(state, location), &record.A, logData))
+	case dns.TypeAAAA:
+		return h.AAAA(qname, record, h.Filter(targetRequest(state, location), &record.AAAA, logData))
+	case dns.TypeMX:
+		return h.MX(qname, record)
+	case dns.TypeTXT:
+		return h.TXT(qname, record)
+	case dns.TypeCAA:
+		return h.CAA(qname, record)
+	case dns.TypeHTTPS:
+		return h.HTTPS(qname, record)
+	}
+	return nil
+}
+
+// anameFilter passes addresses resolved from upstream through aname filter
+func (h *DnsRequestHandler) anameFilter(state *request.Request, qname string, location string, aname *ANAME_Record, answers []dns.RR, logData map[string]interface{}) []dns.RR {
+	if len(answers) == 0 {
+		return answers
+	}
+	rrset := &IP_RRSet{FilterConfig: aname.Filter, Ttl: answers[0].Header().Ttl}
+	for _, rr := range answers {
+		switch x := rr.(type) {
+		case *dns.A:
+			rrset.Data = append(rrset.Data, IP_RR{Ip: x.A})
+		case *dns.AAAA:
+			rrset.Data = append(rrset.Data, IP_RR{Ip: x.AAAA})
+		default:
+			return answers
+		}
+	}
+	ips := h.Filter(targetRequest(state, location), rrset, logData)
+	record := &Record{RRSets: RRSets{A: *rrset, AAAA: *rrset}}
+	if answers[0].Header().Rrtype == dns.TypeA {
+		return h.A(qname, record, ips)
+	}
+	return h.AAAA(qname, record, ips)
+}
+
+// ANY returns a synthesized HINFO or a single rrset depending on config, all rrsets are returned to allowed clients over tcp (RFC 8482)
+func (h *DnsRequestHandler) ANY(state *request.Request, qname string, record *Record, logData map[string]interface{}) []dns.RR {
+	if record.CNAME != nil {
+		return h.CNAME(qname, record)
+	}
+	if state.Proto() == "tcp" && transferAllowed(state.IP(), h.Config.Any.TcpAllow) {
+		var answers []dns.RR
+		if record.Name == record.Zone.Name {
+			answers = append(answers, record.Zone.Config.SOA.Data)
+		}
+		for _, rr := range h.locationRRs(record) {
+			// wildcard expansion
+			if rr.Header().Name != qname {
+				rr = dns.Copy(rr)
+				rr.Header().Name = qname
+			}
+			answers = append(answers, rr)
+		}
+		return answers
+	}
+	switch h.Config.Any.Response {
+	case "rrset":
+		if len(record.A.Data) > 0 {
+			return h.A(qname, record, h.Filter(state, &record.A, logData))
+		}
+		if len(record.AAAA.Data) > 0 {
+			return h.AAAA(qname, record, h.Filter(state, &record.AAAA, logData))
+		}
+		var answers []dns.RR
+		for _, rr := range h.locationRRs(record) {
+			if len(answers) > 0 && rr.Header().Rrtype != answers[0].Header().Rrtype {
+				break
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = qname
+			answers = append(answers, rr)
+		}
+		return answers
+	default:
+		return []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: h.getTtl(anyHinfoTtl)},
+			Cpu: "RFC8482",
+		}}
+	}
+}
+
+// Referral returns delegation ns set with ds or proof of its absence for signed zones, and glue for in-zone name servers
+func (h *DnsRequestHandler) Referral(state *request.Request, record *Record) ([]dns.RR, []dns.RR) {
+	z := record.Zone
+	authority := h.NS(record.Name, record)
+	var extra []dns.RR
+	for _, ns := range record.NS.Data {
+		host := strings.ToLower(dns.Fqdn(ns.Host))
+		if h.Matches(host) != z.Name {
+			continue
+		}
+		label := "@"
+		if host != z.Name {
+			label = zoneLocation(host, z)
+		}
+		if !keyExists(label, z) {
+			continue
+		}
+		glue := h.LoadLocation(zoneLocation(host, z), z)
+		if glue == nil {
+			continue
+		}
+		extra = append(extra, h.A(host, glue, glue.A.Data)...)
+		extra = append(extra, h.AAAA(host, glue, glue.AAAA.Data)...)
+	}
+	if state.Do() && z.Config.DnsSec {
+		proof := h.DS(record.Name, record)
+		if len(proof) == 0 {
+			if z.Config.NSEC3 != nil {
+				proof = []dns.RR{nsec3Match(record.Name, []uint16{dns.TypeNS}, z)}
+			} else {
+				proof = []dns.RR{NSec(record.Name, z, []uint16{dns.TypeNS})}
+			}
+		}
+		authority = append(authority, h.Sign(proof, record.Name, record, nil)...)
+	}
+	return authority, extra
+}
+
+// Additional returns address sets of in-zone MX, SRV, NS and CNAME targets in answers, signed for dnssec queries
+func (h *DnsRequestHandler) Additional(state *request.Request, answers []dns.RR, z *Zone) [][]dns.RR {
+	owners := make(map[string]bool)
+	for _, rr := range answers {
+		owners[strings.ToLower(rr.Header().Name)] = true
+	}
+	var targets []string
+	for _, rr := range answers {
+		var target string
+		switch x := rr.(type) {
+		case *dns.MX:
+			target = x.Mx
+		case *dns.SRV:
+			target = x.Target
+		case *dns.NS:
+			target = x.Ns
+		case *dns.CNAME:
+			// other query types follow in-zone cnames in answer
+			if state.QType() != dns.TypeCNAME {
+				continue
+			}
+			target = x.Target
+		default:
+			continue
+		}
+		target = strings.ToLower(target)
+		if owners[target] || h.Matches(target) != z.Name {
+			continue
+		}
+		owners[target] = true
+		targets = append(targets, target)
+	}
+
+	var sets [][]dns.RR
+	// lookups for additional data are not logged
+	logData := make(map[string]interface{})
+	for _, target := range targets {
+		record, res := h.FetchRecord(target, logData)
+		// wildcard expansions need a denial proof and are left out
+		if res != dns.RcodeSuccess || record.Name != target || record.CNAME != nil || isDelegation(record) {
+			continue
+		}
+		targetState := targetRequest(state, target)
+		for _, rrs := range [][]dns.RR{
+			h.A(target, record, h.Filter(targetState, &record.A, logData)),
+			h.AAAA(target, record, h.Filter(targetState, &record.AAAA, logData)),
+		} {
+			if len(rrs) == 0 {
+				continue
+			}
+			if state.Do() && z.Config.DnsSec {
+				rrs = h.Sign(rrs, target, record, nil)
+			}
+			sets = append(sets, rrs)
+		}
+	}
+	return sets
+}
+
+// targetRequest returns a copy of state querying name, healthcheck status is kept per name
+func targetRequest(state *request.Request, name string) *request.Request {
+	req := state.Req.Copy()
+	req.Question[0].Name = name
+	return &request.Request{W: state.W, Req: req}
+}
+
 func (h *DnsRequestHandler) Filter(request *request.Request, rrset *IP_RRSet, logData map[string]interface{}) []IP_RR {
 	ips := h.healthcheck.FilterHealthcheck(request.Name(), rrset)
 	switch rrset.FilterConfig.GeoFilter {
@@ -393,7 +857,7 @@ func reverseZone(zone string) string {
 
 func (h *DnsRequestHandler) LoadZones() {
 	h.LastZoneUpdate = time.Now()
-	zones, err := h.Redis.SMembers("redins:zones")
+	zones, err := h.Store.GetZones()
 	if err != nil {
 		logger.Default.Error("cannot load zones : ", err)
 	}
@@ -420,6 +884,16 @@ func (h *DnsRequestHandler) FetchRecord(qname string, logData map[string]interfa
 	}
 }
 
+func (h *DnsRequestHandler) InvalidateZone(zone string) {
+	h.ZoneCache.Delete(zone)
+	h.signatures.InvalidateZone(zone)
+	for key := range h.RecordCache.Items() {
+		if dns.IsSubDomain(zone, key) {
+			h.RecordCache.Delete(key)
+		}
+	}
+}
+
 func (h *DnsRequestHandler) A(name string, record *Record, ips []IP_RR) (answers []dns.RR) {
 	for _, ip := range ips {
 		if ip.Ip == nil {
@@ -460,6 +934,32 @@ func (h *DnsRequestHandler) CNAME(name string, record *Record) (answers []dns.RR
 	return
 }
 
+func (h *DnsRequestHandler) DNAME(name string, record *Record) (answers []dns.RR) {
+	if record.DNAME == nil {
+		return
+	}
+	r := new(dns.DNAME)
+	r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeDNAME,
+		Class: dns.ClassINET, Ttl: h.getTtl(record.DNAME.Ttl)}
+	r.Target = dns.Fqdn(record.DNAME.Target)
+	answers = append(answers, r)
+	return
+}
+
+// synthesizedCNAME returns CNAME from qname to target with dname ttl (RFC 6672 section 3.1)
+func (h *DnsRequestHandler) synthesizedCNAME(qname string, target string, record *Record) dns.RR {
+	return &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.getTtl(record.DNAME.Ttl)},
+		Target: target,
+	}
+}
+
+// dnameTarget replaces dname owner suffix of qname with dname target
+func dnameTarget(qname string, record *Record) string {
+	prefix := strings.TrimSuffix(qname, record.Name)
+	return prefix + dns.Fqdn(record.DNAME.Target)
+}
+
 func (h *DnsRequestHandler) TXT(name string, record *Record) (answers []dns.RR) {
 	for _, txt := range record.TXT.Data {
 		if len(txt.Text) == 0 {
@@ -559,6 +1059,172 @@ func (h *DnsRequestHandler) TLSA(name string, record *Record) (answers []dns.RR)
 	return
 }
 
+func (h *DnsRequestHandler) SSHFP(name string, record *Record) (answers []dns.RR) {
+	for _, sshfp := range record.SSHFP.Data {
+		r := new(dns.SSHFP)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSSHFP,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.SSHFP.Ttl)}
+		r.Algorithm = sshfp.Algorithm
+		r.Type = sshfp.Type
+		r.FingerPrint = sshfp.Fingerprint
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) NAPTR(name string, record *Record) (answers []dns.RR) {
+	for _, naptr := range record.NAPTR.Data {
+		r := new(dns.NAPTR)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeNAPTR,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.NAPTR.Ttl)}
+		r.Order = naptr.Order
+		r.Preference = naptr.Preference
+		r.Flags = naptr.Flags
+		r.Service = naptr.Service
+		r.Regexp = naptr.Regexp
+		r.Replacement = dns.Fqdn(naptr.Replacement)
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) DS(name string, record *Record) (answers []dns.RR) {
+	for _, ds := range record.DS.Data {
+		r := new(dns.DS)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeDS,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.DS.Ttl)}
+		r.KeyTag = ds.KeyTag
+		r.Algorithm = ds.Algorithm
+		r.DigestType = ds.DigestType
+		r.Digest = ds.Digest
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) HINFO(name string, record *Record) (answers []dns.RR) {
+	for _, hinfo := range record.HINFO.Data {
+		r := new(dns.HINFO)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.HINFO.Ttl)}
+		r.Cpu = hinfo.Cpu
+		r.Os = hinfo.Os
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) LOC(name string, record *Record) (answers []dns.RR) {
+	for _, loc := range record.LOC.Data {
+		r := locRR(loc)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeLOC,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.LOC.Ttl)}
+		answers = append(answers, r)
+	}
+	return
+}
+
+// locRR converts loc to wire format values, precisions default to RFC 1876 values
+func locRR(loc LOC_RR) *dns.LOC {
+	return &dns.LOC{
+		Latitude:  uint32(int64(dns.LOC_EQUATOR) + int64(math.Round(loc.Latitude*dns.LOC_DEGREES))),
+		Longitude: uint32(int64(dns.LOC_PRIMEMERIDIAN) + int64(math.Round(loc.Longitude*dns.LOC_DEGREES))),
+		Altitude:  uint32(int64(math.Round(loc.Altitude*100)) + dns.LOC_ALTITUDEBASE*100),
+		Size:      locPrecision(loc.Size, 1),
+		HorizPre:  locPrecision(loc.HorizPre, 10000),
+		VertPre:   locPrecision(loc.VertPre, 10),
+	}
+}
+
+// locPrecision encodes meters as mantissa and exponent of centimeters (RFC 1876 section 2)
+func locPrecision(value *float64, defaultValue float64) uint8 {
+	meters := defaultValue
+	if value != nil {
+		meters = math.Max(*value, 0)
+	}
+	cm := uint64(math.Round(meters * 100))
+	var exponent uint8
+	for cm > 9 && exponent < 9 {
+		cm = (cm + 5) / 10
+		exponent++
+	}
+	if cm > 9 {
+		cm = 9
+	}
+	return uint8(cm)<<4 | exponent
+}
+
+// locMeters decodes precision value created by locPrecision
+func locMeters(precision uint8) *float64 {
+	meters := float64(precision>>4) * math.Pow10(int(precision&0x0f)) / 100
+	return &meters
+}
+
+func (h *DnsRequestHandler) URI(name string, record *Record) (answers []dns.RR) {
+	for _, uri := range record.URI.Data {
+		r := new(dns.URI)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeURI,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.URI.Ttl)}
+		r.Priority = uri.Priority
+		r.Weight = uri.Weight
+		r.Target = uri.Target
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) SVCB(name string, record *Record) []dns.RR {
+	return h.svcb(name, record, &record.SVCB, dns.TypeSVCB)
+}
+
+func (h *DnsRequestHandler) HTTPS(name string, record *Record) []dns.RR {
+	return h.svcb(name, record, &record.HTTPS, dns.TypeHTTPS)
+}
+
+func (h *DnsRequestHandler) svcb(name string, record *Record, rrset *SVCB_RRSet, rrtype uint16) (answers []dns.RR) {
+	data := rrset.Data
+	// ServiceMode records are ignored when AliasMode is present (RFC 9460 section 2.4.2)
+	for _, rr := range rrset.Data {
+		if rr.Priority == 0 {
+			data = []SVCB_RR{rr}
+			break
+		}
+	}
+	for _, rr := range data {
+		if target := dns.Fqdn(rr.Target); rrset.AutoHints && rr.Priority != 0 && (target == "." || target == name) {
+			if len(rr.Ipv4Hint) == 0 {
+				rr.Ipv4Hint = ipHints(record.A.Data)
+			}
+			if len(rr.Ipv6Hint) == 0 {
+				rr.Ipv6Hint = ipHints(record.AAAA.Data)
+			}
+		}
+		svcb, err := svcbRR(rr)
+		if err != nil {
+			logger.Default.Errorf("invalid %s record for %s : %s", dns.TypeToString[rrtype], name, err)
+			continue
+		}
+		svcb.Hdr = dns.RR_Header{Name: name, Rrtype: rrtype,
+			Class: dns.ClassINET, Ttl: h.getTtl(rrset.Ttl)}
+		if rrtype == dns.TypeHTTPS {
+			answers = append(answers, &dns.HTTPS{SVCB: *svcb})
+		} else {
+			answers = append(answers, svcb)
+		}
+	}
+	return
+}
+
+func ipHints(ips []IP_RR) []net.IP {
+	var hints []net.IP
+	for _, ip := range ips {
+		if ip.Ip != nil {
+			hints = append(hints, ip.Ip)
+		}
+	}
+	return hints
+}
+
 func (h *DnsRequestHandler) getTtl(ttl uint32) uint32 {
 	maxTtl := uint32(h.Config.MaxTtl)
 	if ttl == 0 {
@@ -680,12 +1346,19 @@ func (h *DnsRequestHandler) GetRecord(qname string) (record *Record, rcode int)
 		return nil, dns.RcodeNotAuth
 	}
 
+	if h.secondary.Expired(zone) {
+		return nil, dns.RcodeServerFailure
+	}
 	z := h.LoadZone(zone)
 	if z == nil {
 		logger.Default.Errorf("empty zone : %s", zone)
 		return nil, dns.RcodeServerFailure
 	}
 
+	// names below a delegation point or a dname are not answered from zone data (RFC 6672 section 2.4)
+	if record := h.findCut(qname, z); record != nil {
+		return record, dns.RcodeSuccess
+	}
 	location := h.findLocation(qname, z)
 	if len(location) == 0 { // empty, no results
 		return &Record{Name: qname, Zone: z}, dns.RcodeNameError
@@ -700,13 +1373,42 @@ func (h *DnsRequestHandler) GetRecord(qname string) (record *Record, rcode int)
 	return record, dns.RcodeSuccess
 }
 
-func (h *DnsRequestHandler) loadKey(pub string, priv string) *ZoneKey {
-	pubStr, _ := h.Redis.Get(pub)
+// findCut returns the closest to apex ancestor of qname which is a delegation point or has a dname,
+// ancestors are fetched through record cache so lookups of missing names don't hit the store
+func (h *DnsRequestHandler) findCut(qname string, z *Zone) *Record {
+	indexes := dns.Split(qname)
+	for i := len(indexes) - dns.CountLabel(z.Name); i > 0; i-- {
+		name := qname[indexes[i]:]
+		label := "@"
+		if name != z.Name {
+			label = zoneLocation(name, z)
+		}
+		if !keyExists(label, z) {
+			continue
+		}
+		record, res := h.FetchRecord(name, map[string]interface{}{})
+		if res != dns.RcodeSuccess || record.Name != name {
+			continue
+		}
+		if isDelegation(record) || record.DNAME != nil {
+			return record
+		}
+	}
+	return nil
+}
+
+// isDelegation reports whether record is a zone cut, ns records at apex are authoritative
+func isDelegation(record *Record) bool {
+	return record.Name != record.Zone.Name && len(record.NS.Data) > 0
+}
+
+func (h *DnsRequestHandler) loadKey(zone string, pub string, priv string) *ZoneKey {
+	pubStr, _ := h.Store.GetKey(zone, pub)
 	if pubStr == "" {
 		logger.Default.Errorf("key is not set : %s", pub)
 		return nil
 	}
-	privStr, _ := h.Redis.Get(priv)
+	privStr, _ := h.Store.GetKey(zone, priv)
 	if privStr == "" {
 		logger.Default.Errorf("key is not set : %s", priv)
 		return nil
@@ -719,18 +1421,40 @@ func (h *DnsRequestHandler) loadKey(pub string, priv string) *ZoneKey {
 		logger.Default.Errorf("cannot parse zone key : %s", err)
 		return nil
 	}
-	if pk, err := zoneKey.DnsKey.NewPrivateKey(privStr); err == nil {
+	newPrivateKey := zoneKey.DnsKey.NewPrivateKey
+	if zoneKey.DnsKey.Algorithm == dns.ED448 {
+		newPrivateKey = func(s string) (crypto.PrivateKey, error) {
+			return newEd448PrivateKey(zoneKey.DnsKey, s)
+		}
+	}
+	if pk, err := newPrivateKey(privStr); err == nil {
 		zoneKey.PrivateKey = pk
 	} else {
 		logger.Default.Errorf("cannot create private key : %s", err)
 		return nil
 	}
-	now := time.Now()
-	zoneKey.KeyInception = uint32(now.Add(-3 * time.Hour).Unix())
-	zoneKey.KeyExpiration = uint32(now.Add(8 * 24 * time.Hour).Unix())
 	return zoneKey
 }
 
+// loadPublicKey returns published key without private part, nil if key is not set
+func (h *DnsRequestHandler) loadPublicKey(zone string, pub string) *dns.DNSKEY {
+	pubStr, _ := h.Store.GetKey(zone, pub)
+	if pubStr == "" {
+		return nil
+	}
+	rr, err := dns.NewRR(pubStr)
+	if err != nil {
+		logger.Default.Errorf("cannot parse zone key : %s", err)
+		return nil
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		logger.Default.Errorf("invalid zone key : %s", pub)
+		return nil
+	}
+	return key
+}
+
 func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 	cachedZone, found := h.ZoneCache.Get(zone)
 	if found {
@@ -739,7 +1463,7 @@ func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 
 	z := new(Zone)
 	z.Name = zone
-	vals, err := h.Redis.GetHKeys("redins:zones:" + zone)
+	vals, err := h.Store.GetLocations(zone)
 	if err != nil {
 		logger.Default.Errorf("cannot load zone %s locations : %s", zone, err)
 	}
@@ -762,7 +1486,7 @@ func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 			Ttl:     300,
 		},
 	}
-	val, err := h.Redis.Get("redins:zones:" + zone + ":config")
+	val, err := h.Store.GetZoneConfig(zone)
 	if err != nil {
 		logger.Default.Errorf("cannot load zone %s config : %s", zone, err)
 	}
@@ -786,12 +1510,12 @@ func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 
 	z = func() *Zone {
 		if z.Config.DnsSec {
-			z.ZSK = h.loadKey("redins:zones:" + z.Name + ":zsk:pub", "redins:zones:" + z.Name + ":zsk:priv")
+			z.ZSK = h.loadKey(z.Name, "zsk:pub", "zsk:priv")
 			if z.ZSK == nil {
 				z.Config.DnsSec = false
 				return z
 			}
-			z.KSK = h.loadKey("redins:zones:" + z.Name + ":ksk:pub", "redins:zones:" + z.Name + ":ksk:priv")
+			z.KSK = h.loadKey(z.Name, "ksk:pub", "ksk:priv")
 			if z.KSK == nil {
 				z.Config.DnsSec = false
 				return z
@@ -799,16 +1523,62 @@ func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 
 			z.ZSK.DnsKey.Flags = 256
 			z.KSK.DnsKey.Flags = 257
-			if z.ZSK.DnsKey.Hdr.Ttl != z.KSK.DnsKey.Hdr.Ttl {
-				z.ZSK.DnsKey.Hdr.Ttl = z.KSK.DnsKey.Hdr.Ttl
+			z.DnsKeys = []dns.RR{z.ZSK.DnsKey, z.KSK.DnsKey}
+			z.KSKs = []*ZoneKey{z.KSK}
+
+			// keys published during rollovers
+			for _, name := range []string{"zsk:next", "zsk:old"} {
+				if key := h.loadPublicKey(z.Name, name+":pub"); key != nil {
+					key.Flags = 256
+					z.DnsKeys = append(z.DnsKeys, key)
+				}
+			}
+			if pub, _ := h.Store.GetKey(z.Name, "ksk:next:pub"); pub != "" {
+				if key := h.loadKey(z.Name, "ksk:next:pub", "ksk:next:priv"); key != nil {
+					key.DnsKey.Flags = 257
+					z.DnsKeys = append(z.DnsKeys, key.DnsKey)
+					z.KSKs = append(z.KSKs, key)
+				}
+			}
+			for _, key := range z.DnsKeys {
+				key.Header().Ttl = z.KSK.DnsKey.Hdr.Ttl
 			}
 
-			if rrsig, err := sign([]dns.RR{z.ZSK.DnsKey, z.KSK.DnsKey}, z.Name, z.KSK, z.KSK.DnsKey.Hdr.Ttl); err == nil {
-				z.DnsKeySig = rrsig
-			} else {
-				logger.Default.Errorf("cannot create RRSIG for DNSKEY : %s", err)
-				z.Config.DnsSec = false
-				return z
+			if z.Config.NSEC3 != nil {
+				if _, err := hex.DecodeString(z.Config.NSEC3.Salt); err != nil || len(z.Config.NSEC3.Salt) > 510 {
+					logger.Default.Errorf("invalid nsec3 salt for zone %s, using nsec", z.Name)
+					z.Config.NSEC3 = nil
+				} else {
+					z.Config.NSEC3.Salt = strings.ToUpper(z.Config.NSEC3.Salt)
+				}
+			}
+			if z.Config.NSEC3 != nil && z.Config.NSEC3.Iterations > nsec3MaxIterations {
+				logger.Default.Errorf("nsec3 iterations of zone %s exceed %d, using 0", z.Name, nsec3MaxIterations)
+				z.Config.NSEC3.Iterations = 0
+			}
+
+			signature := &z.Config.Signature
+			if signature.Validity == 0 {
+				signature.Validity = defaultSignatureValidity
+			}
+			if signature.Refresh == 0 {
+				signature.Refresh = signature.Validity / 4
+			}
+			if signature.Jitter == 0 {
+				signature.Jitter = signature.Validity / 8
+			}
+			if signature.Validity < 0 || signature.Refresh < 0 || signature.Jitter < 0 || signature.Refresh+signature.Jitter >= signature.Validity {
+				logger.Default.Errorf("invalid signature config for zone %s, using defaults", z.Name)
+				*signature = SignatureConfig{Validity: defaultSignatureValidity, Refresh: defaultSignatureValidity / 4, Jitter: defaultSignatureValidity / 8}
+			}
+
+			// DNSKEY signatures are created to make sure keys are usable
+			for _, key := range z.KSKs {
+				if _, err := h.signatures.Sign(z.DnsKeys, key, z); err != nil {
+					logger.Default.Errorf("cannot create RRSIG for DNSKEY : %s", err)
+					z.Config.DnsSec = false
+					return z
+				}
 			}
 		}
 		return z
@@ -842,8 +1612,8 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 	r.Zone = z
 	r.Name = name
 
-	val, _ := h.Redis.HGet("redins:zones:"+z.Name, label)
-	if val == "" && name == z.Name {
+	val, _ := h.Store.GetLocation(z.Name, label)
+	if val == "" {
 		return r
 	}
 	err := json.Unmarshal([]byte(val), r)
@@ -855,11 +1625,10 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 	return r
 }
 
-func (h *DnsRequestHandler) SetLocation(location string, z *Zone, val *Record) {
+func (h *DnsRequestHandler) SetLocation(location string, z *Zone, val *Record) error {
 	jsonValue, err := json.Marshal(val)
 	if err != nil {
-		logger.Default.Errorf("cannot encode to json : %s", err)
-		return
+		return errors.Wrap(err, "cannot encode to json")
 	}
 	var label string
 	if location == z.Name {
@@ -867,7 +1636,42 @@ func (h *DnsRequestHandler) SetLocation(location string, z *Zone, val *Record) {
 	} else {
 		label = location
 	}
-	h.Redis.HSet(z.Name, label, string(jsonValue))
+	if err := h.Store.SetLocation(z.Name, label, string(jsonValue)); err != nil {
+		return errors.Wrapf(err, "cannot set location %s in zone %s", location, z.Name)
+	}
+	return nil
+}
+
+// UpdateLocations writes records of zone z keyed by label at once, nil records are removed
+func (h *DnsRequestHandler) UpdateLocations(z *Zone, records map[string]*Record) error {
+	locations := make(map[string]string, len(records))
+	for label, record := range records {
+		if record == nil {
+			locations[label] = ""
+			continue
+		}
+		jsonValue, err := json.Marshal(record)
+		if err != nil {
+			return errors.Wrap(err, "cannot encode to json")
+		}
+		locations[label] = string(jsonValue)
+	}
+	if err := h.Store.UpdateLocations(z.Name, locations); err != nil {
+		return errors.Wrapf(err, "cannot update locations of zone %s", z.Name)
+	}
+	return nil
+}
+
+// lockZone waits for the store lock of zone, the lock is shared with other instances using the same store
+func (h *DnsRequestHandler) lockZone(zone string) (func(), error) {
+	deadline := time.Now().Add(zoneLockWait)
+	for {
+		unlock, err := h.Store.LockZone(zone, zoneLockTtl)
+		if err != errZoneLocked || time.Now().After(deadline) {
+			return unlock, err
+		}
+		time.Sleep(zoneLockRetry)
+	}
 }
 
 func ChooseIp(ips []IP_RR, weighted bool) int {
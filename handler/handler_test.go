@@ -3,6 +3,8 @@ package handler
 import (
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"arvancloud/redins/test"
@@ -31,12 +33,14 @@ var lookupConfig = []string{
 }
 var lookupEntries = [][][]string{
 	{
+		{"@",
+			`{"ns":{"ttl":300, "records":[{"host":"ns1.example.com."},{"host":"ns2.example.com."}]}}`,
+		},
 		{"x",
 			`{
             "a":{"ttl":300, "records":[{"ip":"1.2.3.4", "country":"ES"},{"ip":"5.6.7.8", "country":""}]},
             "aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
             "txt":{"ttl":300, "records":[{"text":"foo"},{"text":"bar"}]},
-            "ns":{"ttl":300, "records":[{"host":"ns1.example.com."},{"host":"ns2.example.com."}]},
             "mx":{"ttl":300, "records":[{"host":"mx1.example.com.", "preference":10},{"host":"mx2.example.com.", "preference":10}]},
             "srv":{"ttl":300, "records":[{"target":"sip.example.com.","port":555,"priority":10,"weight":100}]}
             }`,
@@ -70,10 +74,49 @@ var lookupEntries = [][][]string{
 		{"t.u.v.w",
 			`{"a":{"ttl":300, "records":[{"ip":"9.9.9.9"}]}}`,
 		},
+		{"host",
+			`{
+            "sshfp":{"ttl":300, "records":[{"algorithm":4, "type":2, "fingerprint":"123456789abcdef67890123456789abcdef67890123456789abcdef123456789"}]},
+            "hinfo":{"ttl":300, "records":[{"cpu":"INTEL", "os":"LINUX"}]},
+            "loc":{"ttl":300, "records":[{"latitude":52.373, "longitude":-4.8925, "altitude":-2, "size":0}]},
+            "uri":{"ttl":300, "records":[{"priority":10, "weight":1, "target":"ftp://ftp1.example.com/public"}]}
+            }`,
+		},
+		{"enum",
+			`{"naptr":{"ttl":300, "records":[
+                {"order":100, "preference":10, "flags":"S", "service":"SIP+D2U", "regexp":"", "replacement":"_sip._udp.example.com."},
+                {"order":102, "preference":10, "flags":"U", "service":"E2U+sip", "regexp":"!^.*$!sip:info@example.com!", "replacement":"."}
+            ]}}`,
+		},
+		{"web",
+			`{
+            "a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"}]},
+            "aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
+            "https":{"ttl":300, "auto_hints":true, "records":[
+                {"priority":1, "target":".", "mandatory":["alpn"], "alpn":["h2","h3"], "port":8443, "ech":"AEj+DQBE"},
+                {"priority":2, "target":"backup.example.com.", "alpn":["h2"]}
+            ]},
+            "svcb":{"ttl":300, "records":[{"priority":1, "target":"dns.example.com.", "alpn":["dot"], "no_default_alpn":true, "port":853, "ipv4hint":["9.9.9.9"]}]}
+            }`,
+		},
+		{"legacy",
+			`{"dname":{"ttl":300, "target":"current.example.com."},
+            "a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+		},
+		{"www.current",
+			`{"a":{"ttl":300, "records":[{"ip":"10.0.0.1"}]}}`,
+		},
+		{"outside",
+			`{"dname":{"ttl":300, "target":"example.org."}}`,
+		},
+		{"secure",
+			`{"ds":{"ttl":300, "records":[{"key_tag":60485, "algorithm":5, "digest_type":1, "digest":"2BB183AF5F22588179A53B0A98631FAD1A292118"}]}}`,
+		},
 	},
 	{
 		{"@",
-			`{"ns":{"ttl":300, "records":[{"host":"ns1.example.net."},{"host":"ns2.example.net."}]}}`,
+			`{"ns":{"ttl":300, "records":[{"host":"ns1.example.net."},{"host":"ns2.example.net."}]},
+            "https":{"ttl":300, "records":[{"priority":1, "target":".", "alpn":["h2"]},{"priority":0, "target":"cdn.example.org.", "port":443}]}}`,
 		},
 		{"sub.*",
 			`{"txt":{"ttl":300, "records":[{"text":"this is not a wildcard"}]}}`,
@@ -82,7 +125,14 @@ var lookupEntries = [][][]string{
 			`{"a":{"ttl":300, "records":[{"ip":"5.5.5.5"}]}}`,
 		},
 		{"subdel",
-			`{"ns":{"ttl":300, "records":[{"host":"ns1.subdel.example.net."},{"host":"ns2.subdel.example.net."}]}}`,
+			`{"ns":{"ttl":300, "records":[{"host":"ns1.subdel.example.net."},{"host":"ns2.subdel.example.net."},{"host":"ns.example.org."}]},
+            "a":{"ttl":300, "records":[{"ip":"6.6.6.6"}]}}`,
+		},
+		{"ns1.subdel",
+			`{"a":{"ttl":300, "records":[{"ip":"7.7.7.7"}]},"aaaa":{"ttl":300, "records":[{"ip":"::7"}]}}`,
+		},
+		{"ns2.subdel",
+			`{"a":{"ttl":300, "records":[{"ip":"8.8.8.8"}]}}`,
 		},
 		{"*",
 			`{"txt":{"ttl":300, "records":[{"text":"this is a wildcard"}]},
@@ -100,7 +150,6 @@ var lookupEntries = [][][]string{
 			`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
                 "aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
                 "txt":{"ttl":300, "records":[{"text":"foo"},{"text":"bar"}]},
-                "ns":{"ttl":300, "records":[{"host":"ns1.example.aaa."},{"ttl":300, "host":"ns2.example.aaa."}]},
                 "mx":{"ttl":300, "records":[{"host":"mx1.example.aaa.", "preference":10},{"host":"mx2.example.aaa.", "preference":10}]},
                 "srv":{"ttl":300, "records":[{"target":"sip.example.aaa.","port":555,"priority":10,"weight":100}]}}`,
 		},
@@ -132,7 +181,6 @@ var lookupEntries = [][][]string{
 			`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
                 "aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
                 "txt":{"ttl":300, "records":[{"text":"foo"},{"text":"bar"}]},
-                "ns":{"ttl":300, "records":[{"host":"ns1.example.ddd."},{"ttl":300, "host":"ns2.example.ddd."}]},
                 "mx":{"ttl":300, "records":[{"host":"mx1.example.ddd.", "preference":10},{"host":"mx2.example.ddd.", "preference":10}]},
                 "srv":{"ttl":300, "records":[{"target":"sip.example.ddd.","port":555,"priority":10,"weight":100}]}}`,
 		},
@@ -148,6 +196,9 @@ var lookupEntries = [][][]string{
 		{"e",
 			`{"cname":{"ttl":300, "host":"d.example.ddd."}}`,
 		},
+		{"f",
+			`{"ns":{"ttl":300, "records":[{"host":"ns1.example.ddd."},{"ttl":300, "host":"ns2.example.ddd."}]}}`,
+		},
 	},
 	{
 		{"@",
@@ -224,13 +275,22 @@ var lookupTestCases = [][]test.Case{
 			Answer: []dns.RR{
 				test.CNAME("y.example.com. 300 IN CNAME x.example.com."),
 			},
+			Extra: []dns.RR{
+				test.A("x.example.com. 300 IN A 1.2.3.4"),
+				test.A("x.example.com. 300 IN A 5.6.7.8"),
+				test.AAAA("x.example.com. 300 IN AAAA ::1"),
+			},
 		},
 		// NS Test
 		{
-			Qname: "x.example.com.", Qtype: dns.TypeNS,
+			Qname: "example.com.", Qtype: dns.TypeNS,
 			Answer: []dns.RR{
-				test.NS("x.example.com. 300 IN NS ns1.example.com."),
-				test.NS("x.example.com. 300 IN NS ns2.example.com."),
+				test.NS("example.com. 300 IN NS ns1.example.com."),
+				test.NS("example.com. 300 IN NS ns2.example.com."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.example.com. 300 IN A 2.2.2.2"),
+				test.A("ns2.example.com. 300 IN A 3.3.3.3"),
 			},
 		},
 		// MX Test
@@ -247,6 +307,10 @@ var lookupTestCases = [][]test.Case{
 			Answer: []dns.RR{
 				test.SRV("_sip._tcp.example.com. 300 IN SRV 10 100 555 sip.example.com."),
 			},
+			Extra: []dns.RR{
+				test.A("sip.example.com. 300 IN A 7.7.7.7"),
+				test.AAAA("sip.example.com. 300 IN AAAA ::1"),
+			},
 		},
 		// TLSA Test
 		{
@@ -262,6 +326,102 @@ var lookupTestCases = [][]test.Case{
 				test.TLSA("_990._tcp.example.com. 300 IN TLSA 1 1 1 62D5414CD1CC657E3D30"),
 			},
 		},
+		// SSHFP Test
+		{
+			Qname: "host.example.com.", Qtype: dns.TypeSSHFP,
+			Answer: []dns.RR{
+				test.SSHFP("host.example.com. 300 IN SSHFP 4 2 123456789abcdef67890123456789abcdef67890123456789abcdef123456789"),
+			},
+		},
+		// HINFO Test
+		{
+			Qname: "host.example.com.", Qtype: dns.TypeHINFO,
+			Answer: []dns.RR{
+				test.HINFO("host.example.com. 300 IN HINFO INTEL LINUX"),
+			},
+		},
+		// LOC Test
+		{
+			Qname: "host.example.com.", Qtype: dns.TypeLOC,
+			Answer: []dns.RR{
+				test.LOC("host.example.com. 300 IN LOC 52 22 22.800 N 4 53 33.000 W -2.00m 0.00m 10000m 10m"),
+			},
+		},
+		// URI Test
+		{
+			Qname: "host.example.com.", Qtype: dns.TypeURI,
+			Answer: []dns.RR{
+				test.URI("host.example.com. 300 IN URI 10 1 \"ftp://ftp1.example.com/public\""),
+			},
+		},
+		// NAPTR Test
+		{
+			Qname: "enum.example.com.", Qtype: dns.TypeNAPTR,
+			Answer: []dns.RR{
+				test.NAPTR("enum.example.com. 300 IN NAPTR 100 10 \"S\" \"SIP+D2U\" \"\" _sip._udp.example.com."),
+				test.NAPTR("enum.example.com. 300 IN NAPTR 102 10 \"U\" \"E2U+sip\" \"!^.*$!sip:info@example.com!\" ."),
+			},
+		},
+		// DS Test
+		{
+			Qname: "secure.example.com.", Qtype: dns.TypeDS,
+			Answer: []dns.RR{
+				test.DS("secure.example.com. 300 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"),
+			},
+		},
+		// DNAME Test
+		{
+			Qname: "www.legacy.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.DNAME("legacy.example.com. 300 IN DNAME current.example.com."),
+				test.A("www.current.example.com. 300 IN A 10.0.0.1"),
+				test.CNAME("www.legacy.example.com. 300 IN CNAME www.current.example.com."),
+			},
+		},
+		{
+			Qname: "legacy.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("legacy.example.com. 300 IN A 1.1.1.1"),
+			},
+		},
+		{
+			Qname: "legacy.example.com.", Qtype: dns.TypeDNAME,
+			Answer: []dns.RR{
+				test.DNAME("legacy.example.com. 300 IN DNAME current.example.com."),
+			},
+		},
+		{
+			Qname: "www.legacy.example.com.", Qtype: dns.TypeCNAME,
+			Answer: []dns.RR{
+				test.DNAME("legacy.example.com. 300 IN DNAME current.example.com."),
+				test.CNAME("www.legacy.example.com. 300 IN CNAME www.current.example.com."),
+			},
+			Extra: []dns.RR{
+				test.A("www.current.example.com. 300 IN A 10.0.0.1"),
+			},
+		},
+		{
+			Qname: "a.b.outside.example.com.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("a.b.outside.example.com. 300 IN CNAME a.b.example.org."),
+				test.DNAME("outside.example.com. 300 IN DNAME example.org."),
+			},
+		},
+		// HTTPS Test
+		{
+			Qname: "web.example.com.", Qtype: dns.TypeHTTPS,
+			Answer: []dns.RR{
+				test.HTTPS("web.example.com. 300 IN HTTPS 1 . mandatory=alpn alpn=h2,h3 port=8443 ipv4hint=1.2.3.4,5.6.7.8 ech=AEj+DQBE ipv6hint=::1"),
+				test.HTTPS("web.example.com. 300 IN HTTPS 2 backup.example.com. alpn=h2"),
+			},
+		},
+		// SVCB Test
+		{
+			Qname: "web.example.com.", Qtype: dns.TypeSVCB,
+			Answer: []dns.RR{
+				test.SVCB("web.example.com. 300 IN SVCB 1 dns.example.com. alpn=dot no-default-alpn port=853 ipv4hint=9.9.9.9"),
+			},
+		},
 		// NXDOMAIN Test
 		{
 			Qname: "notexists.example.com.", Qtype: dns.TypeA,
@@ -300,6 +460,9 @@ var lookupTestCases = [][]test.Case{
 			Answer: []dns.RR{
 				test.MX("host3.example.net. 300 IN MX 10 host1.example.net."),
 			},
+			Extra: []dns.RR{
+				test.A("host1.example.net. 300 IN A 5.5.5.5"),
+			},
 		},
 		{
 			Qname: "host3.example.net.", Qtype: dns.TypeA,
@@ -319,15 +482,61 @@ var lookupTestCases = [][]test.Case{
 				test.SOA("example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
 			},
 		},
+		// HTTPS AliasMode at apex
+		{
+			Qname: "example.net.", Qtype: dns.TypeHTTPS,
+			Answer: []dns.RR{
+				test.HTTPS("example.net. 300 IN HTTPS 0 cdn.example.org."),
+			},
+		},
 		{
 			Qname: "sub.*.example.net.", Qtype: dns.TypeMX,
 			Ns: []dns.RR{
 				test.SOA("example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
 			},
 		},
+		// delegation tests
 		{
 			Qname: "host.subdel.example.net.", Qtype: dns.TypeA,
-			Rcode: dns.RcodeNameError,
+			Ns: []dns.RR{
+				test.NS("subdel.example.net. 300 IN NS ns.example.org."),
+				test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+				test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.subdel.example.net. 300 IN A 7.7.7.7"),
+				test.AAAA("ns1.subdel.example.net. 300 IN AAAA ::7"),
+				test.A("ns2.subdel.example.net. 300 IN A 8.8.8.8"),
+			},
+		},
+		{
+			Qname: "subdel.example.net.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("subdel.example.net. 300 IN NS ns.example.org."),
+				test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+				test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.subdel.example.net. 300 IN A 7.7.7.7"),
+				test.AAAA("ns1.subdel.example.net. 300 IN AAAA ::7"),
+				test.A("ns2.subdel.example.net. 300 IN A 8.8.8.8"),
+			},
+		},
+		{
+			Qname: "ns1.subdel.example.net.", Qtype: dns.TypeA,
+			Ns: []dns.RR{
+				test.NS("subdel.example.net. 300 IN NS ns.example.org."),
+				test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+				test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
+			},
+			Extra: []dns.RR{
+				test.A("ns1.subdel.example.net. 300 IN A 7.7.7.7"),
+				test.AAAA("ns1.subdel.example.net. 300 IN AAAA ::7"),
+				test.A("ns2.subdel.example.net. 300 IN A 8.8.8.8"),
+			},
+		},
+		{
+			Qname: "subdel.example.net.", Qtype: dns.TypeDS,
 			Ns: []dns.RR{
 				test.SOA("example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
 			},
@@ -353,6 +562,10 @@ var lookupTestCases = [][]test.Case{
 			Answer: []dns.RR{
 				test.CNAME("y.example.aaa. 300 IN CNAME x.example.aaa."),
 			},
+			Extra: []dns.RR{
+				test.A("x.example.aaa. 300 IN A 1.2.3.4"),
+				test.AAAA("x.example.aaa. 300 IN AAAA ::1"),
+			},
 		},
 		{
 			Qname: "z.example.aaa.", Qtype: dns.TypeCNAME,
@@ -494,13 +707,6 @@ var lookupTestCases = [][]test.Case{
 				test.TXT("e.example.ddd. 300 IN TXT \"foo\""),
 			},
 		},
-		{
-			Qname: "e.example.ddd.", Qtype: dns.TypeNS,
-			Answer: []dns.RR{
-				test.NS("e.example.ddd. 300 IN NS ns1.example.ddd."),
-				test.NS("e.example.ddd. 300 IN NS ns2.example.ddd."),
-			},
-		},
 		// MX Test
 		{
 			Qname: "e.example.ddd.", Qtype: dns.TypeMX,
@@ -522,6 +728,14 @@ var lookupTestCases = [][]test.Case{
 				test.CNAME("e.example.ddd. 300 IN CNAME d.example.ddd."),
 			},
 		},
+		// NS of a non-apex name is a delegation, answered with referral
+		{
+			Qname: "f.example.ddd.", Qtype: dns.TypeNS,
+			Ns: []dns.RR{
+				test.NS("f.example.ddd. 300 IN NS ns1.example.ddd."),
+				test.NS("f.example.ddd. 300 IN NS ns2.example.ddd."),
+			},
+		},
 	},
 	// CAA Test
 	{
@@ -603,17 +817,17 @@ func TestLookup(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for i, zone := range lookupZones {
-		h.Redis.SAdd("redins:zones", zone)
+		h.testRedis().SAdd("redins:zones", zone)
 		for _, cmd := range lookupEntries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				log.Printf("[ERROR] cannot connect to redis: %s", err)
 				t.Fail()
 			}
 		}
-		h.Redis.Set("redins:zones:"+zone+":config", lookupConfig[i])
+		h.testRedis().Set("redins:zones:"+zone+":config", lookupConfig[i])
 		h.LoadZones()
 		for j, tc := range lookupTestCases[i] {
 
@@ -783,17 +997,17 @@ func TestANAME(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for i, zone := range anameZones {
-		h.Redis.SAdd("redins:zones", zone)
+		h.testRedis().SAdd("redins:zones", zone)
 		for _, cmd := range anameEntries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				log.Printf("[ERROR] cannot connect to redis: %s", err)
 				t.Fail()
 			}
 		}
-		h.Redis.Set("redins:zones:"+zone+":config", anameConfig[i])
+		h.testRedis().Set("redins:zones:"+zone+":config", anameConfig[i])
 	}
 	h.LoadZones()
 
@@ -816,17 +1030,17 @@ func TestWeightedANAME(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for i, zone := range anameZones {
-		h.Redis.SAdd("redins:zones", zone)
+		h.testRedis().SAdd("redins:zones", zone)
 		for _, cmd := range anameEntries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				log.Printf("[ERROR] cannot connect to redis: %s", err)
 				t.Fail()
 			}
 		}
-		h.Redis.Set("redins:zones:"+zone+":config", anameConfig[i])
+		h.testRedis().Set("redins:zones:"+zone+":config", anameConfig[i])
 	}
 	h.LoadZones()
 
@@ -900,6 +1114,139 @@ func TestWeightedANAME(t *testing.T) {
 	}
 }
 
+func TestANAMETargets(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	records := map[string][]string{
+		"backup.example.org.:AAAA": {"backup.example.org. 60 IN AAAA 2001:db8::10"},
+		"backup.example.org.:CAA":  {`backup.example.org. 60 IN CAA 0 issue "ca.example.net"`},
+		"multi.example.org.:A":     {"multi.example.org. 60 IN A 5.5.5.1", "multi.example.org. 60 IN A 5.5.5.2", "multi.example.org. 60 IN A 5.5.5.3"},
+	}
+	upstream := &dns.Server{Addr: "127.0.0.1:10561", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, s := range records[r.Question[0].Name+":"+dns.TypeToString[r.Question[0].Qtype]] {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ListenAndServe()
+	defer upstream.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	zone := "alias.zon."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	config.Upstream = []UpstreamConfig{{Ip: "127.0.0.1", Port: 10561, Protocol: "udp", Timeout: 1000}}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.alias.zon.","ns":"ns1.alias.zon.","refresh":44,"retry":55,"expire":66}}`)
+	store.SetLocation(zone, "@", `{
+		"txt":{"ttl":300, "records":[{"text":"local"}]},
+		"aname":{"targets":[{"location":"primary.alias.zon."},{"location":"backup.example.org.", "priority":1}], "types":["A","AAAA","MX","TXT","CAA","HTTPS"]}
+		}`)
+	store.SetLocation(zone, "primary", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}, "mx":{"ttl":300, "records":[{"host":"mx.example.org.", "preference":10}]}}`)
+	store.SetLocation(zone, "legacy", `{"aname":{"location":"primary.alias.zon."}}`)
+	store.SetLocation(zone, "failover", `{"aname":{"targets":[{"location":"missing.example.org."},{"location":"primary.alias.zon.", "priority":1}]}}`)
+	store.SetLocation(zone, "lb", `{"aname":{"targets":[{"location":"w1.alias.zon.", "weight":1},{"location":"w2.alias.zon.", "weight":4}]}}`)
+	store.SetLocation(zone, "w1", `{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`)
+	store.SetLocation(zone, "w2", `{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`)
+	store.SetLocation(zone, "ext", `{"aname":{"location":"multi.example.org.", "filter":{"count":"single", "order":"rr"}}}`)
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	soa := test.SOA("alias.zon. 300 IN SOA ns1.alias.zon. hostmaster.alias.zon. 1460498836 44 55 66 100")
+	cases := []test.Case{
+		{
+			Qname: zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("alias.zon. 300 IN A 1.2.3.4")},
+		},
+		// primary has no AAAA, backup is used
+		{
+			Qname: zone, Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{test.AAAA("alias.zon. 60 IN AAAA 2001:db8::10")},
+		},
+		{
+			Qname: zone, Qtype: dns.TypeMX,
+			Answer: []dns.RR{test.MX("alias.zon. 300 IN MX 10 mx.example.org.")},
+		},
+		{
+			Qname: zone, Qtype: dns.TypeCAA,
+			Answer: []dns.RR{test.CAA(`alias.zon. 60 IN CAA 0 issue "ca.example.net"`)},
+		},
+		// local records are preferred
+		{
+			Qname: zone, Qtype: dns.TypeTXT,
+			Answer: []dns.RR{test.TXT(`alias.zon. 300 IN TXT "local"`)},
+		},
+		{
+			Qname: zone, Qtype: dns.TypeHTTPS,
+			Ns: []dns.RR{soa},
+		},
+		// only A and AAAA by default
+		{
+			Qname: "legacy." + zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("legacy.alias.zon. 300 IN A 1.2.3.4")},
+		},
+		{
+			Qname: "legacy." + zone, Qtype: dns.TypeMX,
+			Ns: []dns.RR{soa},
+		},
+		{
+			Qname: "failover." + zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("failover.alias.zon. 300 IN A 1.2.3.4")},
+		},
+	}
+	for i, tc := range cases {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		if err := test.SortAndCheck(w.Msg, tc); err != nil {
+			fmt.Println(i, err, w.Msg)
+			t.Fail()
+		}
+	}
+
+	// upstream addresses are filtered using aname filter
+	seen := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		tc := test.Case{Qname: "ext." + zone, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		if len(w.Msg.Answer) != 1 {
+			fmt.Println("unexpected answer : ", w.Msg)
+			t.FailNow()
+		}
+		seen[w.Msg.Answer[0].(*dns.A).A.String()]++
+	}
+	if len(seen) != 3 {
+		fmt.Println("addresses not rotated : ", seen)
+		t.Fail()
+	}
+
+	// targets with the same priority are chosen by weight
+	ip1, ip2 := 0, 0
+	for i := 0; i < 1000; i++ {
+		tc := test.Case{Qname: "lb." + zone, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		if len(w.Msg.Answer) != 1 {
+			fmt.Println("unexpected answer : ", w.Msg)
+			t.FailNow()
+		}
+		switch w.Msg.Answer[0].(*dns.A).A.String() {
+		case "1.1.1.1":
+			ip1++
+		case "2.2.2.2":
+			ip2++
+		}
+	}
+	if ip1 == 0 || ip1 >= ip2 {
+		fmt.Println("unexpected distribution : ", ip1, ip2)
+		t.Fail()
+	}
+}
+
 var filterGeoZone = "filtergeo.com."
 
 var filterGeoConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.filter.com.","ns":"ns1.filter.com.","refresh":44,"retry":55,"expire":66}}`
@@ -1117,16 +1464,16 @@ func TestGeoFilter(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{Target: "file", Enable: true, Path: "/tmp/rtest.log", Format: "txt"})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", filterGeoZone)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", filterGeoZone)
 	for _, cmd := range filterGeoEntries {
-		err := h.Redis.HSet("redins:zones:"+filterGeoZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+filterGeoZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+filterGeoZone+":config", filterGeoConfig)
+	h.testRedis().Set("redins:zones:"+filterGeoZone+":config", filterGeoConfig)
 	h.LoadZones()
 	for i, tc := range filterGeoTestCases {
 		sa := filterGeoSourceIps[i]
@@ -1218,17 +1565,17 @@ func TestMultiFilter(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", filterMultiZone)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", filterMultiZone)
 	for _, cmd := range filterMultiEntries {
-		err := h.Redis.HSet("redins:zones:"+filterMultiZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+filterMultiZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			log.Println("1")
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+filterMultiZone+":config", filterMultiConfig)
+	h.testRedis().Set("redins:zones:"+filterMultiZone+":config", filterMultiConfig)
 	h.LoadZones()
 
 	for i := 0; i < 10; i++ {
@@ -1372,17 +1719,17 @@ func TestSingleFilter(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", filterSingleZone)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", filterSingleZone)
 	for _, cmd := range filterSingleEntries {
-		err := h.Redis.HSet("redins:zones:"+filterSingleZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+filterSingleZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			log.Println("1")
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+filterSingleZone+":config", filterSingleConfig)
+	h.testRedis().Set("redins:zones:"+filterSingleZone+":config", filterSingleConfig)
 	h.LoadZones()
 
 	for i := 0; i < 10; i++ {
@@ -1490,17 +1837,17 @@ func TestUpstreamCNAME(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", upstreamCNAMEZone)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", upstreamCNAMEZone)
 	for _, cmd := range upstreamCNAME {
-		err := h.Redis.HSet("redins:zones:"+upstreamCNAMEZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+upstreamCNAMEZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			log.Println("1")
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+upstreamCNAMEZone+":config", upstreamCNAMEConfig)
+	h.testRedis().Set("redins:zones:"+upstreamCNAMEZone+":config", upstreamCNAMEConfig)
 	h.LoadZones()
 
 	h.Config.UpstreamFallback = false
@@ -1577,11 +1924,11 @@ func TestCNameOutsideZone(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for i, zone := range cnameOutsideZones {
-		h.Redis.SAdd("redins:zones", zone)
+		h.testRedis().SAdd("redins:zones", zone)
 		for _, cmd := range cnameOutsideEntries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				log.Printf("[ERROR] cannot connect to redis: %s", err)
 				t.Fail()
@@ -1628,10 +1975,10 @@ func TestCNameLoop(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", cnameLoopZone)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", cnameLoopZone)
 	for _, cmd := range cnameLoopEntries {
-		err := h.Redis.HSet("redins:zones:"+cnameLoopZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+cnameLoopZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
@@ -1720,17 +2067,17 @@ func TestFindZone(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for i, zone := range findZoneZones {
-		h.Redis.SAdd("redins:zones", zone)
+		h.testRedis().SAdd("redins:zones", zone)
 		for _, cmd := range findZoneEntries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				log.Printf("[ERROR] cannot connect to redis: %s", err)
 				t.Fail()
 			}
 		}
-		h.Redis.Set("redins:zones:"+zone+":config", lookupConfig[i])
+		h.testRedis().Set("redins:zones:"+zone+":config", lookupConfig[i])
 		h.LoadZones()
 	}
 	for _, tc := range findZoneTests {
@@ -1803,9 +2150,9 @@ func TestSubscribeZones(t *testing.T) {
 	time.Sleep(time.Second)
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
+	h.testRedis().Del("*")
 	for _, cmd := range subsEntries {
-		err := h.Redis.HSet("redins:zones:"+subsZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+subsZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			log.Println("1")
@@ -1813,7 +2160,7 @@ func TestSubscribeZones(t *testing.T) {
 		}
 	}
 
-	h.Redis.SAdd("redins:zones", subsZone)
+	h.testRedis().SAdd("redins:zones", subsZone)
 	time.Sleep(time.Millisecond * 10)
 	tc := subsTestCases[0]
 	r := tc.Msg()
@@ -1827,7 +2174,7 @@ func TestSubscribeZones(t *testing.T) {
 		t.Fail()
 	}
 
-	h.Redis.SRem("redins:zones", subsZone)
+	h.testRedis().SRem("redins:zones", subsZone)
 	time.Sleep(time.Millisecond * 1500)
 	tc = subsTestCases[0]
 	r = tc.Msg()
@@ -1868,11 +2215,11 @@ func TestCNameNoAuth(t *testing.T) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
 
 	h := NewHandler(&handlerTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", cnameNoAuthZone)
-	h.Redis.Set("redins:zones:" + cnameNoAuthZone + ":config", "{\"cname_flattening\": false}")
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", cnameNoAuthZone)
+	h.testRedis().Set("redins:zones:" + cnameNoAuthZone + ":config", "{\"cname_flattening\": false}")
 	for _, cmd := range cnameNoAuthEntries {
-		err := h.Redis.HSet("redins:zones:"+cnameNoAuthZone, cmd[0], cmd[1])
+		err := h.testRedis().HSet("redins:zones:"+cnameNoAuthZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
@@ -1896,3 +2243,273 @@ func TestCNameNoAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestAdditional(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "additional.zon."
+	zoneConfig := `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.additional.zon.","ns":"ns1.additional.zon.","refresh":44,"retry":55,"expire":66}%s}`
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, ""))
+	var mx string
+	for i := 0; i < 10; i++ {
+		mx += fmt.Sprintf(`,{"host":"mail%d.additional.zon.", "preference":%d}`, i, i)
+		store.SetLocation(zone, fmt.Sprintf("mail%d", i), `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"1.2.3.5"},{"ip":"1.2.3.6"}]},
+			"aaaa":{"ttl":300, "records":[{"ip":"::1"},{"ip":"::2"},{"ip":"::3"}]}}`)
+	}
+	store.SetLocation(zone, "@", `{"mx":{"ttl":300, "records":[`+mx[1:]+`,{"host":"mail.example.com.", "preference":20}]}}`)
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	query := func(size uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(zone, dns.TypeMX)
+		if size > 0 {
+			r.SetEdns0(size, false)
+		}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: r})
+		return w.Msg
+	}
+
+	// all targets fit in edns buffer
+	resp := query(4096)
+	if len(resp.Answer) != 11 || len(resp.Extra) != 61 {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+	// additional data is dropped without truncation
+	resp = query(0)
+	if resp.Truncated || len(resp.Answer) != 11 || len(resp.Extra) == 0 || len(resp.Extra) >= 60 || resp.Len() > dns.MinMsgSize {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+
+	store.SetZoneConfig(zone, fmt.Sprintf(zoneConfig, `,"minimal_responses":true`))
+	h.InvalidateZone(zone)
+	if resp = query(4096); len(resp.Answer) != 11 || len(resp.Extra) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+}
+
+func TestANY(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "any.zon."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.any.zon.","ns":"ns1.any.zon.","refresh":44,"retry":55,"expire":66}}`)
+	store.SetLocation(zone, "@", `{"ns":{"ttl":300, "records":[{"host":"ns1.example.com."}]}}`)
+	store.SetLocation(zone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"1.2.3.5"}]},
+		"aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
+		"txt":{"ttl":300, "records":[{"text":"foo"}]},
+		"mx":{"ttl":300, "records":[{"host":"mx.example.com.", "preference":10}]}}`)
+	store.SetLocation(zone, "text", `{"txt":{"ttl":300, "records":[{"text":"foo"},{"text":"bar"}]}}`)
+	store.SetLocation(zone, "alias", `{"cname":{"ttl":300, "host":"www.any.zon."}}`)
+	store.SetLocation(zone, "*", `{"txt":{"ttl":300, "records":[{"text":"wildcard"}]}}`)
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	query := func(qname string, tcp bool) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeANY}
+		w := test.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+	check := func(resp *dns.Msg, types ...uint16) {
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != len(types) {
+			fmt.Println("unexpected response : ", resp)
+			t.Fail()
+			return
+		}
+		for i, rr := range resp.Answer {
+			if rr.Header().Rrtype != types[i] || rr.Header().Name != resp.Question[0].Name {
+				fmt.Println("unexpected answer : ", rr)
+				t.Fail()
+			}
+		}
+	}
+
+	// synthesized hinfo by default
+	resp := query("www."+zone, false)
+	check(resp, dns.TypeHINFO)
+	if hinfo, ok := resp.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+		fmt.Println("unexpected hinfo : ", resp)
+		t.Fail()
+	}
+	check(query("alias."+zone, false), dns.TypeCNAME)
+	if resp := query("nxdomain.www."+zone, false); resp.Rcode != dns.RcodeNameError {
+		fmt.Println("expected nxdomain : ", resp)
+		t.Fail()
+	}
+
+	// single rrset
+	h.Config.Any.Response = "rrset"
+	check(query("www."+zone, false), dns.TypeA, dns.TypeA)
+	check(query("text."+zone, false), dns.TypeTXT, dns.TypeTXT)
+	check(query("x.wild."+zone, false), dns.TypeTXT)
+
+	// all rrsets over tcp for allowed clients
+	check(query("www."+zone, true), dns.TypeA, dns.TypeA)
+	h.Config.Any.TcpAllow = []string{"10.240.0.0/16"}
+	check(query("www."+zone, false), dns.TypeA, dns.TypeA)
+	check(query("www."+zone, true), dns.TypeA, dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX)
+	check(query(zone, true), dns.TypeSOA, dns.TypeNS)
+	check(query("x.wild."+zone, true), dns.TypeTXT)
+}
+
+func TestExternalFlattening(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	queries := make(map[string]int)
+	var lock sync.Mutex
+	records := map[string][]string{
+		"cdn.example.org.:A":         {"cdn.example.org. 60 IN CNAME edge.cdn.example.net.", "edge.cdn.example.net. 120 IN A 5.5.5.5"},
+		"cdn.example.org.:AAAA":      {"cdn.example.org. 60 IN CNAME edge.cdn.example.net."},
+		"cdn.example.org.:HTTPS":     {"cdn.example.org. 60 IN HTTPS 1 . alpn=h2"},
+		"chain.example.org.:A":       {"chain.example.org. 600 IN CNAME edge.cdn.example.net."},
+		"edge.cdn.example.net.:A":    {"edge.cdn.example.net. 120 IN A 5.5.5.5"},
+		"edge.cdn.example.net.:AAAA": {},
+	}
+	upstream := &dns.Server{Addr: "127.0.0.1:10560", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		key := r.Question[0].Name + ":" + dns.TypeToString[r.Question[0].Qtype]
+		lock.Lock()
+		queries[key]++
+		lock.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, s := range records[key] {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ListenAndServe()
+	defer upstream.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	zone := "flat.zon."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	config.Upstream = []UpstreamConfig{{Ip: "127.0.0.1", Port: 10560, Protocol: "udp", Timeout: 1000}}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(zone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.flat.zon.","ns":"ns1.flat.zon.","refresh":44,"retry":55,"expire":66},"cname_flattening":true}`)
+	store.SetLocation(zone, "@", `{"cname":{"ttl":300, "host":"cdn.example.org."}}`)
+	store.SetLocation(zone, "www", `{"cname":{"ttl":20, "host":"chain.flat.zon."}}`)
+	store.SetLocation(zone, "chain", `{"cname":{"ttl":300, "host":"chain.example.org."}}`)
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	cases := []test.Case{
+		{
+			Qname: zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("flat.zon. 60 IN A 5.5.5.5")},
+		},
+		{
+			Qname: zone, Qtype: dns.TypeHTTPS,
+			Answer: []dns.RR{test.HTTPS("flat.zon. 60 IN HTTPS 1 . alpn=h2")},
+		},
+		{
+			Qname: zone, Qtype: dns.TypeAAAA,
+			Ns: []dns.RR{test.SOA("flat.zon. 300 IN SOA ns1.flat.zon. hostmaster.flat.zon. 1460498836 44 55 66 100")},
+		},
+		// minimum ttl of both zone and upstream chains
+		{
+			Qname: "chain." + zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("chain.flat.zon. 120 IN A 5.5.5.5")},
+		},
+		{
+			Qname: "www." + zone, Qtype: dns.TypeA,
+			Answer: []dns.RR{test.A("www.flat.zon. 20 IN A 5.5.5.5")},
+		},
+	}
+	for i, tc := range cases {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		resp := w.Msg
+		if err := test.SortAndCheck(resp, tc); err != nil {
+			fmt.Println(i, err, resp)
+			t.Fail()
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl != tc.Answer[0].Header().Ttl {
+				fmt.Println(i, "unexpected ttl : ", rr)
+				t.Fail()
+			}
+		}
+	}
+
+	// flattened results are cached
+	for i := 0; i < 3; i++ {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: cases[0].Msg()})
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if queries["cdn.example.org.:A"] != 1 || queries["edge.cdn.example.net.:A"] != 1 {
+		fmt.Println("unexpected upstream queries : ", queries)
+		t.Fail()
+	}
+}
+
+// countingStore counts location reads
+type countingStore struct {
+	*MemoryStore
+	reads int32
+}
+
+func (s *countingStore) GetLocation(zone string, label string) (string, error) {
+	atomic.AddInt32(&s.reads, 1)
+	return s.MemoryStore.GetLocation(zone, label)
+}
+
+func TestCutLookups(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	zone := "cut.zon."
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := &countingStore{MemoryStore: h.Store.(*MemoryStore)}
+	h.Store = store
+	store.SetZoneConfig(zone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.cut.zon.","ns":"ns1.cut.zon.","refresh":44,"retry":55,"expire":66}}`)
+	store.SetLocation(zone, "@", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	store.SetLocation(zone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	store.SetLocation(zone, "sub", `{"ns":{"ttl":300, "records":[{"host":"ns.example.org."}]}}`)
+	store.AddZone(zone)
+	time.Sleep(time.Millisecond * 100)
+
+	query := func(qname string) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+	query("www." + zone)
+	query("host.sub." + zone)
+
+	// ancestors are served from cache, missing names don't read the store
+	atomic.StoreInt32(&store.reads, 0)
+	for i := 0; i < 10; i++ {
+		if resp := query(fmt.Sprintf("rnd%d.www.%s", i, zone)); resp.Rcode != dns.RcodeNameError {
+			fmt.Println("expected nxdomain : ", resp)
+			t.Fail()
+		}
+		if resp := query(fmt.Sprintf("rnd%d.sub.%s", i, zone)); len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeNS {
+			fmt.Println("expected referral : ", resp)
+			t.Fail()
+		}
+	}
+	if reads := atomic.LoadInt32(&store.reads); reads != 0 {
+		fmt.Println("unexpected store reads : ", reads)
+		t.Fail()
+	}
+}
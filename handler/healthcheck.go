@@ -42,7 +42,7 @@ type Healthcheck struct {
 	maxPendingRequests int
 	updateInterval     time.Duration
 	checkInterval      time.Duration
-	redisConfigServer  *uperdis.Redis
+	configStore        ZoneStore
 	redisStatusServer  *uperdis.Redis
 	logger             *logger.EventLogger
 	cachedItems        *cache.Cache
@@ -169,7 +169,7 @@ type HealthcheckConfig struct {
 	Log                logger.LogConfig    `json:"log,omitempty"`
 }
 
-func NewHealthcheck(config *HealthcheckConfig, redisConfigServer *uperdis.Redis) *Healthcheck {
+func NewHealthcheck(config *HealthcheckConfig, configStore ZoneStore) *Healthcheck {
 	h := &Healthcheck{
 		Enable:             config.Enable,
 		maxRequests:        config.MaxRequests,
@@ -180,7 +180,7 @@ func NewHealthcheck(config *HealthcheckConfig, redisConfigServer *uperdis.Redis)
 
 	if h.Enable {
 
-		h.redisConfigServer = redisConfigServer
+		h.configStore = configStore
 		h.redisStatusServer = uperdis.NewRedis(&config.RedisStatusServer)
 		h.cachedItems = cache.New(h.updateInterval, h.updateInterval*10)
 		h.dispatcher = workerpool.NewDispatcher(config.MaxPendingRequests, config.MaxRequests)
@@ -260,7 +260,7 @@ func (h *Healthcheck) storeItem(item *HealthCheckItem) {
 
 func (h *Healthcheck) getDomainId(zone string) string {
 	var cfg ZoneConfig
-	val, err := h.redisConfigServer.Get("redins:zones:" + zone + ":config")
+	val, err := h.configStore.GetZoneConfig(zone)
 	if err != nil {
 		logger.Default.Errorf("cannot load zone %s config : %s", zone, err)
 	}
@@ -389,15 +389,15 @@ func (h *Healthcheck) Transfer() {
 
 	limiter := time.Tick(time.Millisecond * 50)
 	for {
-		domains, err := h.redisConfigServer.SMembers("redins:zones")
+		domains, err := h.configStore.GetZones()
 		if err != nil {
-			logger.Default.Errorf("cannot get members of redins:zones : %s", err)
+			logger.Default.Errorf("cannot get zones : %s", err)
 		}
 		for _, domain := range domains {
 			domainId := h.getDomainId(domain)
-			subdomains, err := h.redisConfigServer.GetHKeys("redins:zones:" + domain)
+			subdomains, err := h.configStore.GetLocations(domain)
 			if err != nil {
-				logger.Default.Errorf("cannot get keys of %s : %s", domain, err)
+				logger.Default.Errorf("cannot get locations of %s : %s", domain, err)
 			}
 			for _, subdomain := range subdomains {
 				select {
@@ -405,7 +405,7 @@ func (h *Healthcheck) Transfer() {
 					h.quitWG.Done()
 					return
 				case <-limiter:
-					recordStr, err := h.redisConfigServer.HGet("redins:zones:"+domain, subdomain)
+					recordStr, err := h.configStore.GetLocation(domain, subdomain)
 					if err != nil {
 						logger.Default.Errorf("cannot get record of %s.%s : %s", subdomain, domain, err)
 					}
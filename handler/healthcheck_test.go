@@ -108,11 +108,11 @@ var configRedisConf = uperdis.RedisConfig{
 func TestGet(t *testing.T) {
 	log.Println("TestGet")
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	h := NewHealthcheck(&config, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	h := NewHealthcheck(&config, configStore)
 
 	h.redisStatusServer.Del("*")
-	h.redisConfigServer.Del("*")
+	testRedis(&configRedisConf).Del("*")
 	for _, entry := range healthcheckGetEntries {
 		h.redisStatusServer.Set("redins:healthcheck:"+entry[0], entry[1])
 	}
@@ -132,11 +132,11 @@ func TestGet(t *testing.T) {
 func TestFilter(t *testing.T) {
 	log.Println("TestFilter")
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	h := NewHealthcheck(&config, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	h := NewHealthcheck(&config, configStore)
 
 	h.redisStatusServer.Del("*")
-	h.redisConfigServer.Del("*")
+	testRedis(&configRedisConf).Del("*")
 	for _, entry := range healthcheckGetEntries {
 		h.redisStatusServer.Set("redins:healthcheck:"+entry[0], entry[1])
 	}
@@ -268,14 +268,14 @@ func TestFilter(t *testing.T) {
 func TestSet(t *testing.T) {
 	log.Println("TestSet")
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	h := NewHealthcheck(&config, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	h := NewHealthcheck(&config, configStore)
 
-	h.redisConfigServer.Del("*")
+	testRedis(&configRedisConf).Del("*")
 	h.redisStatusServer.Del("*")
 	for _, str := range healthCheckSetEntries {
 		a := fmt.Sprintf("{\"a\":{\"ttl\":300, \"records\":[{\"ip\":\"%s\"}],\"health_check\":%s}}", str[1], str[2])
-		h.redisConfigServer.HSet("redins:zones:healthcheck.com.", str[0], a)
+		testRedis(&configRedisConf).HSet("redins:zones:healthcheck.com.", str[0], a)
 		var key string
 		if str[0] == "@" {
 			key = fmt.Sprintf("arvancloud.com.:%s", str[1])
@@ -295,16 +295,16 @@ func TestSet(t *testing.T) {
 func TestTransfer(t *testing.T) {
 	log.Printf("TestTransfer")
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	h := NewHealthcheck(&config, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	h := NewHealthcheck(&config, configStore)
 
-	h.redisConfigServer.Del("*")
+	testRedis(&configRedisConf).Del("*")
 	h.redisStatusServer.Del("*")
-	h.redisConfigServer.SAdd("redins:zones", "healthcheck.com.")
+	testRedis(&configRedisConf).SAdd("redins:zones", "healthcheck.com.")
 	for _, str := range healthcheckTransferItems {
 		if str[2] != "" {
 			a := fmt.Sprintf("{\"a\":{\"ttl\":300, \"records\":[{\"ip\":\"%s\"}],\"health_check\":%s}}", str[1], str[2])
-			h.redisConfigServer.HSet("redins:zones:healthcheck.com.", str[0], a)
+			testRedis(&configRedisConf).HSet("redins:zones:healthcheck.com.", str[0], a)
 		}
 		if str[3] != "" {
 			key := fmt.Sprintf("%s.healthcheck.com.:%s", str[0], str[1])
@@ -396,15 +396,15 @@ func TestHealthCheck(t *testing.T) {
 	log.Println("TestHealthCheck")
 	logger.Default = logger.NewLogger(&logger.LogConfig{Enable: true, Target: "stdout", Format: "text"})
 
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	hc := NewHealthcheck(&healthcheckConfig, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	hc := NewHealthcheck(&healthcheckConfig, configStore)
 	hc.redisStatusServer.Del("*")
-	hc.redisConfigServer.Del("*")
-	hc.redisConfigServer.SAdd("redins:zones", "google.com.")
+	testRedis(&configRedisConf).Del("*")
+	testRedis(&configRedisConf).SAdd("redins:zones", "google.com.")
 	for _, entry := range hcEntries {
-		configRedis.HSet("redins:zones:google.com.", entry[0], entry[1])
+		testRedis(&configRedisConf).HSet("redins:zones:google.com.", entry[0], entry[1])
 	}
-	configRedis.Set("redins:zones:google.com.:config", hcConfig)
+	testRedis(&configRedisConf).Set("redins:zones:google.com.:config", hcConfig)
 
 	go hc.Start()
 	time.Sleep(10 * time.Second)
@@ -456,10 +456,10 @@ func TestExpire(t *testing.T) {
 
 	log.Printf("TestExpire")
 	logger.Default = logger.NewLogger(&logger.LogConfig{})
-	configRedis := uperdis.NewRedis(&configRedisConf)
-	h := NewHealthcheck(&config, configRedis)
+	configStore := NewRedisStore(&configRedisConf)
+	h := NewHealthcheck(&config, configStore)
 
-	h.redisConfigServer.Del("*")
+	testRedis(&configRedisConf).Del("*")
 	h.redisStatusServer.Del("*")
 
 	expireItem := []string{
@@ -470,8 +470,8 @@ func TestExpire(t *testing.T) {
 
 	a := fmt.Sprintf("{\"a\":{\"ttl\":300, \"records\":[{\"ip\":\"%s\"}],\"health_check\":%s}}", expireItem[1], expireItem[2])
 	log.Println(a)
-	h.redisConfigServer.SAdd("redins:zones", "healthcheck.exp.")
-	h.redisConfigServer.HSet("redins:zones:healthcheck.exp.", expireItem[0], a)
+	testRedis(&configRedisConf).SAdd("redins:zones", "healthcheck.exp.")
+	testRedis(&configRedisConf).HSet("redins:zones:healthcheck.exp.", expireItem[0], a)
 	key := fmt.Sprintf("%s.healthcheck.exp.:%s", expireItem[0], expireItem[1])
 	h.redisStatusServer.Set("redins:healthcheck:"+key, expireItem[2])
 
@@ -485,7 +485,7 @@ func TestExpire(t *testing.T) {
 
 	a = fmt.Sprintf("{\"a\":{\"ttl\":300, \"records\":[{\"ip\":\"%s\"}],\"health_check\":%s}}", expireItem[1], expireItem[3])
 	log.Println(a)
-	h.redisConfigServer.HSet("redins:zones:healthcheck.exp.", expireItem[0], a)
+	testRedis(&configRedisConf).HSet("redins:zones:healthcheck.exp.", expireItem[0], a)
 
 	time.Sleep(time.Second * 5)
 	status = h.getStatus("w0.healthcheck.exp.", net.ParseIP("1.2.3.4"))
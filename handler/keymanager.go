@@ -0,0 +1,437 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/sign/ed448"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultZskLifetime       = 30 * 24 * 3600
+	defaultKskLifetime       = 365 * 24 * 3600
+	defaultPublishDelay      = 2 * 24 * 3600
+	defaultKskRolloverPeriod = 7 * 24 * 3600
+	defaultKeyCheckInterval  = 3600
+	defaultRsaKeySize        = 2048
+	dnskeyTtl                = 3600
+	keyLockTtl               = time.Minute
+	dsPropagationMargin      = 3600
+)
+
+type KeyManagerConfig struct {
+	Enable            bool   `json:"enable,omitempty"`
+	Algorithm         string `json:"algorithm,omitempty"`
+	KeySize           int    `json:"key_size,omitempty"`
+	ZskLifetime       int    `json:"zsk_lifetime,omitempty"`
+	KskLifetime       int    `json:"ksk_lifetime,omitempty"`
+	PublishDelay      int    `json:"publish_delay,omitempty"`
+	KskRolloverPeriod int    `json:"ksk_rollover_period,omitempty"`
+	CheckInterval     int    `json:"check_interval,omitempty"`
+	SkipDsCheck       bool   `json:"skip_ds_check,omitempty"`
+}
+
+// KeyManager generates zone keys and performs rollovers, keys are kept in zone store:
+// zsk:pub, zsk:priv : active zsk
+// zsk:next:pub, zsk:next:priv : pre-published zsk, not used for signing
+// zsk:old:pub : retired zsk, still published
+// ksk:pub, ksk:priv : active ksk
+// ksk:next:pub, ksk:next:priv : new ksk, signs DNSKEY set together with active ksk
+// keys:state : rollover timestamps
+// ds : DS records of ksks
+type KeyManager struct {
+	handler *DnsRequestHandler
+	config  *KeyManagerConfig
+	lock    sync.Mutex
+	quit    chan struct{}
+	quitWG  sync.WaitGroup
+}
+
+type keyState struct {
+	ZskActivated int64 `json:"zsk_activated,omitempty"`
+	ZskPublished int64 `json:"zsk_published,omitempty"`
+	ZskRetired   int64 `json:"zsk_retired,omitempty"`
+	KskActivated int64 `json:"ksk_activated,omitempty"`
+	KskPublished int64 `json:"ksk_published,omitempty"`
+	KskDsSeen    int64 `json:"ksk_ds_seen,omitempty"`
+	KskDsTtl     int64 `json:"ksk_ds_ttl,omitempty"`
+}
+
+func NewKeyManager(config *KeyManagerConfig, h *DnsRequestHandler) *KeyManager {
+	if config.ZskLifetime == 0 {
+		config.ZskLifetime = defaultZskLifetime
+	}
+	if config.KskLifetime == 0 {
+		config.KskLifetime = defaultKskLifetime
+	}
+	if config.PublishDelay == 0 {
+		config.PublishDelay = defaultPublishDelay
+	}
+	if config.KskRolloverPeriod == 0 {
+		config.KskRolloverPeriod = defaultKskRolloverPeriod
+	}
+	if config.CheckInterval == 0 {
+		config.CheckInterval = defaultKeyCheckInterval
+	}
+	return &KeyManager{
+		handler: h,
+		config:  config,
+		quit:    make(chan struct{}),
+	}
+}
+
+func (km *KeyManager) Start() {
+	if !km.config.Enable {
+		return
+	}
+	km.quitWG.Add(1)
+	go func() {
+		defer km.quitWG.Done()
+		for {
+			km.CheckZones()
+			select {
+			case <-km.quit:
+				return
+			case <-time.After(time.Duration(km.config.CheckInterval) * time.Second):
+			}
+		}
+	}()
+}
+
+func (km *KeyManager) ShutDown() {
+	if !km.config.Enable {
+		return
+	}
+	close(km.quit)
+	km.quitWG.Wait()
+}
+
+// CheckZones generates missing keys and performs due rollovers for all dnssec enabled zones
+func (km *KeyManager) CheckZones() {
+	zones, err := km.handler.Store.GetZones()
+	if err != nil {
+		logger.Default.Errorf("cannot get zones : %s", err)
+		return
+	}
+	now := time.Now()
+	for _, zone := range zones {
+		if err := km.CheckZone(zone, now); err != nil {
+			logger.Default.Errorf("key management failed for zone %s : %s", zone, err)
+		}
+	}
+}
+
+// CheckZone updates zone keys as of now
+func (km *KeyManager) CheckZone(zone string, now time.Time) error {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	// instances sharing a zone store may run key manager at the same time
+	unlock, err := km.handler.Store.LockZone(zone, keyLockTtl)
+	if err == errZoneLocked {
+		logger.Default.Debugf("keys of zone %s are checked by another instance", zone)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot lock zone")
+	}
+	defer unlock()
+
+	config := ZoneConfig{}
+	if val, _ := km.handler.Store.GetZoneConfig(zone); len(val) > 0 {
+		if err := json.Unmarshal([]byte(val), &config); err != nil {
+			return errors.Wrap(err, "cannot parse zone config")
+		}
+	}
+	if !config.DnsSec {
+		return nil
+	}
+
+	state := keyState{}
+	if val := km.getKey(zone, "keys:state"); val != "" {
+		if err := json.Unmarshal([]byte(val), &state); err != nil {
+			return errors.Wrap(err, "cannot parse key state")
+		}
+	}
+	oldState := state
+	t := now.Unix()
+	changed := false
+
+	if km.getKey(zone, "zsk:pub") == "" {
+		if err := km.generateKey(zone, "zsk", false); err != nil {
+			return err
+		}
+		state.ZskActivated = t
+		changed = true
+	}
+	if km.getKey(zone, "ksk:pub") == "" {
+		if err := km.generateKey(zone, "ksk", true); err != nil {
+			return err
+		}
+		state.KskActivated = t
+		changed = true
+	}
+	// keys created outside key manager start their lifetime now
+	if state.ZskActivated == 0 {
+		state.ZskActivated = t
+	}
+	if state.KskActivated == 0 {
+		state.KskActivated = t
+	}
+
+	// zsk pre-publish rollover (RFC 6781 section 4.1.1.1)
+	delay := int64(km.config.PublishDelay)
+	if km.getKey(zone, "zsk:old:pub") != "" && t >= state.ZskRetired+delay {
+		if err := km.setKey(zone, "zsk:old:pub", ""); err != nil {
+			return err
+		}
+		logger.Default.Infof("old zsk of zone %s removed", zone)
+		changed = true
+	}
+	if km.getKey(zone, "zsk:next:pub") == "" {
+		if t >= state.ZskActivated+int64(km.config.ZskLifetime)-delay {
+			if err := km.generateKey(zone, "zsk:next", false); err != nil {
+				return err
+			}
+			state.ZskPublished = t
+			logger.Default.Infof("new zsk of zone %s published", zone)
+			changed = true
+		}
+	} else if t >= state.ZskPublished+delay && km.getKey(zone, "zsk:old:pub") == "" {
+		keys := make(map[string]string)
+		km.moveKey(keys, zone, "zsk", "zsk:old", false)
+		km.moveKey(keys, zone, "zsk:next", "zsk", true)
+		if err := km.setKeys(zone, keys); err != nil {
+			return err
+		}
+		state.ZskActivated = t
+		state.ZskRetired = t
+		logger.Default.Infof("new zsk of zone %s activated", zone)
+		changed = true
+	}
+
+	// ksk double-signature rollover (RFC 6781 section 4.1.2)
+	if km.getKey(zone, "ksk:next:pub") == "" {
+		if t >= state.KskActivated+int64(km.config.KskLifetime) {
+			if err := km.generateKey(zone, "ksk:next", true); err != nil {
+				return err
+			}
+			state.KskPublished = t
+			changed = true
+			ds, _ := ZoneDS(km.handler.Store, zone, dns.SHA256)
+			logger.Default.Infof("new ksk of zone %s introduced, parent DS should be updated to : %v", zone, ds)
+		}
+	} else if t >= state.KskPublished+int64(km.config.KskRolloverPeriod) {
+		// removing old ksk before resolvers see DS of the new one makes zone bogus,
+		// old DS set may stay in caches for its ttl after parent publishes the new one
+		activate := km.config.SkipDsCheck
+		if !activate {
+			if found, ttl := km.parentHasDs(zone, "ksk:next:pub"); !found {
+				logger.Default.Warningf("new ksk of zone %s is not activated, parent has no DS for it", zone)
+				state.KskDsSeen = 0
+				state.KskDsTtl = 0
+			} else if state.KskDsSeen == 0 {
+				logger.Default.Infof("parent of zone %s published DS of new ksk, old ksk is removed after %d seconds", zone, int64(ttl)+dsPropagationMargin)
+				state.KskDsSeen = t
+				state.KskDsTtl = int64(ttl)
+			} else {
+				if int64(ttl) > state.KskDsTtl {
+					state.KskDsTtl = int64(ttl)
+				}
+				activate = t >= state.KskDsSeen+state.KskDsTtl+dsPropagationMargin
+			}
+		}
+		if activate {
+			keys := make(map[string]string)
+			km.moveKey(keys, zone, "ksk:next", "ksk", true)
+			if err := km.setKeys(zone, keys); err != nil {
+				return err
+			}
+			state.KskActivated = t
+			state.KskDsSeen = 0
+			state.KskDsTtl = 0
+			logger.Default.Infof("new ksk of zone %s activated, old ksk removed", zone)
+			changed = true
+		}
+	}
+
+	if changed || state != oldState {
+		value, _ := json.Marshal(state)
+		if err := km.setKey(zone, "keys:state", string(value)); err != nil {
+			return err
+		}
+	}
+	if changed {
+		ds, err := ZoneDS(km.handler.Store, zone, dns.SHA256)
+		if err != nil {
+			return err
+		}
+		var dsStrs []string
+		for _, rr := range ds {
+			dsStrs = append(dsStrs, rr.String())
+		}
+		if err := km.setKey(zone, "ds", strings.Join(dsStrs, "\n")); err != nil {
+			return err
+		}
+		km.handler.InvalidateZone(zone)
+		// DNSKEY set is changed, secondaries should be notified
+		km.handler.notifier.ZoneEvent(zone, false)
+	}
+	return nil
+}
+
+// parentHasDs reports whether DS set of zone, queried through upstream, contains a DS of public key name
+// and returns ttl of the DS set
+func (km *KeyManager) parentHasDs(zone string, name string) (bool, uint32) {
+	rr, err := dns.NewRR(km.getKey(zone, name))
+	if err != nil || rr == nil {
+		return false, 0
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return false, 0
+	}
+	key.Flags = 257
+	rrs, res := km.handler.upstream.Query(zone, dns.TypeDS)
+	if res != dns.RcodeSuccess {
+		return false, 0
+	}
+	for _, rr := range rrs {
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			continue
+		}
+		if expected := key.ToDS(ds.DigestType); expected != nil && expected.KeyTag == ds.KeyTag &&
+			expected.Algorithm == ds.Algorithm && strings.EqualFold(expected.Digest, ds.Digest) {
+			return true, ds.Hdr.Ttl
+		}
+	}
+	return false, 0
+}
+
+func (km *KeyManager) getKey(zone string, name string) string {
+	val, _ := km.handler.Store.GetKey(zone, name)
+	return val
+}
+
+func (km *KeyManager) setKey(zone string, name string, value string) error {
+	if err := km.handler.Store.SetKey(zone, name, value); err != nil {
+		return errors.Wrapf(err, "cannot set key %s", name)
+	}
+	return nil
+}
+
+func (km *KeyManager) setKeys(zone string, keys map[string]string) error {
+	if err := km.handler.Store.SetKeys(zone, keys); err != nil {
+		return errors.Wrap(err, "cannot set keys")
+	}
+	return nil
+}
+
+// moveKey adds renaming of key pair from to to keys, only public key is moved if private is false
+func (km *KeyManager) moveKey(keys map[string]string, zone string, from string, to string, private bool) {
+	get := func(name string) string {
+		if value, ok := keys[name]; ok {
+			return value
+		}
+		return km.getKey(zone, name)
+	}
+	suffixes := []string{":pub"}
+	if private {
+		suffixes = append(suffixes, ":priv")
+	}
+	values := make(map[string]string)
+	for _, suffix := range suffixes {
+		values[suffix] = get(from + suffix)
+	}
+	for _, suffix := range []string{":pub", ":priv"} {
+		keys[from+suffix] = ""
+	}
+	for suffix, value := range values {
+		keys[to+suffix] = value
+	}
+}
+
+func (km *KeyManager) generateKey(zone string, name string, ksk bool) error {
+	pub, priv, err := GenerateZoneKey(zone, km.config.Algorithm, km.config.KeySize, ksk)
+	if err != nil {
+		return err
+	}
+	return km.setKeys(zone, map[string]string{name + ":pub": pub, name + ":priv": priv})
+}
+
+// GenerateZoneKey returns a new key pair in the format used by zone store, algorithm is one of ecdsa (default), ed25519, ed448 and rsa
+func GenerateZoneKey(zone string, algorithm string, keySize int, ksk bool) (string, string, error) {
+	key := &dns.DNSKEY{
+		Hdr:      dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyTtl},
+		Flags:    256,
+		Protocol: 3,
+	}
+	if ksk {
+		key.Flags = 257
+	}
+	bits := 256
+	switch strings.ToLower(algorithm) {
+	case "", "ecdsa", "ecdsap256sha256":
+		key.Algorithm = dns.ECDSAP256SHA256
+	case "ed25519":
+		key.Algorithm = dns.ED25519
+	case "ed448":
+		key.Algorithm = dns.ED448
+		pub, priv, err := ed448.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", errors.Wrap(err, "cannot generate key")
+		}
+		key.PublicKey = base64.StdEncoding.EncodeToString(pub)
+		return key.String(), fmt.Sprintf("Private-key-format: v1.3\nAlgorithm: %d (ED448)\nPrivateKey: %s\n", dns.ED448, base64.StdEncoding.EncodeToString(priv.Seed())), nil
+	case "rsa", "rsasha256":
+		key.Algorithm = dns.RSASHA256
+		bits = keySize
+		if bits == 0 {
+			bits = defaultRsaKeySize
+		}
+	default:
+		return "", "", errors.Errorf("unsupported key algorithm %s", algorithm)
+	}
+	priv, err := key.Generate(bits)
+	if err != nil {
+		return "", "", errors.Wrap(err, "cannot generate key")
+	}
+	return key.String(), key.PrivateKeyString(priv), nil
+}
+
+// ZoneDS returns DS records of zone ksks, including new ksk during rollover
+func ZoneDS(store ZoneStore, zone string, digestType uint8) ([]*dns.DS, error) {
+	var res []*dns.DS
+	for _, name := range []string{"ksk:pub", "ksk:next:pub"} {
+		val, err := store.GetKey(zone, name)
+		if err != nil {
+			return nil, err
+		}
+		if val == "" {
+			continue
+		}
+		rr, err := dns.NewRR(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse %s", name)
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, errors.Errorf("%s is not a DNSKEY", name)
+		}
+		key.Flags = 257
+		ds := key.ToDS(digestType)
+		if ds == nil {
+			return nil, errors.Errorf("cannot create DS for %s", name)
+		}
+		res = append(res, ds)
+	}
+	return res, nil
+}
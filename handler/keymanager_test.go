@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var keyZone = "keys.zon."
+
+var keyZoneConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.keys.zon.","ns":"ns1.keys.zon.","refresh":44,"retry":55,"expire":66,"serial":10},"dnssec":true}`
+
+func TestKeyManager(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	// parent DS set served by upstream
+	var parentDs []dns.RR
+	var lock sync.Mutex
+	upstream := &dns.Server{Addr: "127.0.0.1:10563", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		lock.Lock()
+		if r.Question[0].Qtype == dns.TypeDS {
+			m.Answer = parentDs
+		}
+		lock.Unlock()
+		w.WriteMsg(m)
+	})}
+	go upstream.ListenAndServe()
+	defer upstream.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	config.Upstream = []UpstreamConfig{{Ip: "127.0.0.1", Port: 10563, Protocol: "udp", Timeout: 1000}}
+	h := NewHandler(&config)
+	defer h.ShutDown()
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(keyZone, keyZoneConfig)
+	store.SetLocation(keyZone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	store.AddZone(keyZone)
+	time.Sleep(time.Millisecond * 100)
+
+	km := NewKeyManager(&KeyManagerConfig{ZskLifetime: 100, KskLifetime: 1000, PublishDelay: 10, KskRolloverPeriod: 50}, h)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+	// checkKeys verifies DNSKEY set is signed by all ksks and returns number of zsks and ksks, and A record signer
+	checkKeys := func(step string) (int, int, uint16) {
+		resp := query(keyZone, dns.TypeDNSKEY)
+		var keys []dns.RR
+		var sigs []*dns.RRSIG
+		zsks := make(map[uint16]*dns.DNSKEY)
+		ksks := 0
+		for _, rr := range resp.Answer {
+			switch x := rr.(type) {
+			case *dns.DNSKEY:
+				keys = append(keys, x)
+				if x.Flags == 257 {
+					ksks++
+				} else {
+					zsks[x.KeyTag()] = x
+				}
+			case *dns.RRSIG:
+				sigs = append(sigs, x)
+			}
+		}
+		if len(sigs) != ksks {
+			fmt.Println(step, "DNSKEY set is not signed by all ksks : ", resp)
+			t.Fail()
+		}
+		for _, sig := range sigs {
+			verified := false
+			for _, key := range keys {
+				if key.(*dns.DNSKEY).KeyTag() == sig.KeyTag && sig.Verify(key.(*dns.DNSKEY), keys) == nil {
+					verified = true
+				}
+			}
+			if !verified {
+				fmt.Println(step, "invalid DNSKEY signature : ", sig)
+				t.Fail()
+			}
+		}
+		resp = query("www."+keyZone, dns.TypeA)
+		if len(resp.Answer) != 2 {
+			fmt.Println(step, "unexpected answer : ", resp)
+			t.FailNow()
+		}
+		sig := resp.Answer[1].(*dns.RRSIG)
+		if key, ok := zsks[sig.KeyTag]; !ok || sig.Verify(key, resp.Answer[:1]) != nil {
+			fmt.Println(step, "answer is not signed by a published zsk : ", resp)
+			t.Fail()
+		}
+		return len(zsks), ksks, sig.KeyTag
+	}
+
+	now := time.Now()
+	at := func(d int64) time.Time { return now.Add(time.Duration(d) * time.Second) }
+
+	// keys are generated for new zones
+	if err := km.CheckZone(keyZone, now); err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	zsks, ksks, signer := checkKeys("initial")
+	if zsks != 1 || ksks != 1 {
+		fmt.Println("unexpected keys : ", zsks, ksks)
+		t.Fail()
+	}
+	ds, _ := ZoneDS(store, keyZone, dns.SHA256)
+	if val, _ := store.GetKey(keyZone, "ds"); len(ds) != 1 || val != ds[0].String() {
+		fmt.Println("unexpected ds : ", val, ds)
+		t.Fail()
+	}
+
+	// zsk pre-publish : new zsk is published before use
+	km.CheckZone(keyZone, at(90))
+	if zsks, _, tag := checkKeys("pre-publish"); zsks != 2 || tag != signer {
+		fmt.Println("new zsk not pre-published : ", zsks, tag, signer)
+		t.Fail()
+	}
+	km.CheckZone(keyZone, at(100))
+	zsks, _, tag := checkKeys("zsk rollover")
+	if zsks != 2 || tag == signer {
+		fmt.Println("new zsk not activated : ", zsks, tag, signer)
+		t.Fail()
+	}
+	km.CheckZone(keyZone, at(110))
+	if zsks, _, _ := checkKeys("zsk removal"); zsks != 1 {
+		fmt.Println("old zsk not removed : ", zsks)
+		t.Fail()
+	}
+
+	// ksk double-signature : both ksks sign DNSKEY set until the old one is removed
+	km.CheckZone(keyZone, at(1000))
+	if _, ksks, _ := checkKeys("ksk rollover"); ksks != 2 {
+		fmt.Println("new ksk not introduced : ", ksks)
+		t.Fail()
+	}
+	if ds, _ := ZoneDS(store, keyZone, dns.SHA256); len(ds) != 2 {
+		fmt.Println("unexpected ds : ", ds)
+		t.Fail()
+	}
+	// old ksk is kept until parent publishes DS of the new one
+	km.CheckZone(keyZone, at(1050))
+	if _, ksks, _ := checkKeys("ksk without ds"); ksks != 2 {
+		fmt.Println("old ksk removed before parent ds update : ", ksks)
+		t.Fail()
+	}
+	ds, _ = ZoneDS(store, keyZone, dns.SHA256)
+	lock.Lock()
+	for _, rr := range ds {
+		rr.Hdr.Ttl = 1
+		parentDs = append(parentDs, rr)
+	}
+	lock.Unlock()
+	// old ksk is kept until old DS set expires from caches
+	km.CheckZone(keyZone, at(1060))
+	if _, ksks, _ := checkKeys("ksk with new ds"); ksks != 2 {
+		fmt.Println("old ksk removed when parent ds first seen : ", ksks)
+		t.Fail()
+	}
+	km.CheckZone(keyZone, at(1060+dsPropagationMargin))
+	if _, ksks, _ := checkKeys("ksk before ds expiry"); ksks != 2 {
+		fmt.Println("old ksk removed before parent ds expiry : ", ksks)
+		t.Fail()
+	}
+	km.CheckZone(keyZone, at(1061+dsPropagationMargin))
+	if _, ksks, _ := checkKeys("ksk removal"); ksks != 1 {
+		fmt.Println("old ksk not removed : ", ksks)
+		t.Fail()
+	}
+	newDs, _ := ZoneDS(store, keyZone, dns.SHA256)
+	if len(newDs) != 1 || newDs[0].KeyTag == ds[0].KeyTag {
+		fmt.Println("unexpected ds : ", newDs)
+		t.Fail()
+	}
+
+	// keys are not changed while another instance holds zone lock
+	lockedZone := "locked." + keyZone
+	store.SetZoneConfig(lockedZone, keyZoneConfig)
+	unlock, err := store.LockZone(lockedZone, time.Minute)
+	if err != nil {
+		fmt.Println("cannot lock zone : ", err)
+		t.FailNow()
+	}
+	if _, err := store.LockZone(lockedZone, time.Minute); err != errZoneLocked {
+		fmt.Println("zone locked twice : ", err)
+		t.Fail()
+	}
+	km.CheckZone(lockedZone, now)
+	if val, _ := store.GetKey(lockedZone, "ksk:pub"); val != "" {
+		fmt.Println("keys generated for locked zone")
+		t.Fail()
+	}
+	unlock()
+	km.CheckZone(lockedZone, now)
+	pub, _ := store.GetKey(lockedZone, "zsk:pub")
+	priv, _ := store.GetKey(lockedZone, "zsk:priv")
+	if pub == "" || priv == "" {
+		fmt.Println("keys not generated after unlock")
+		t.Fail()
+	}
+
+	for _, algorithm := range []string{"ed25519", "rsa"} {
+		pub, priv, err := GenerateZoneKey(keyZone, algorithm, 1024, false)
+		if err != nil || pub == "" || priv == "" {
+			fmt.Println("cannot generate key : ", algorithm, err)
+			t.Fail()
+		}
+	}
+	if _, _, err := GenerateZoneKey(keyZone, "dsa", 0, false); err == nil {
+		fmt.Println("unsupported algorithm accepted")
+		t.Fail()
+	}
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryZone struct {
+	listed    bool
+	config    string
+	locations map[string]string
+	keys      map[string]string
+}
+
+// MemoryStore keeps zones in memory, used for tests and nodes getting zones only from primaries
+type MemoryStore struct {
+	lock             sync.RWMutex
+	zones            map[string]*memoryZone
+	tsigKeys         map[string]string
+	zonesSubscribers []func()
+	zoneSubscribers  []func(zone string, configChanged bool)
+	zoneLocks        map[string]time.Time // zone -> lock expiration
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		zones:     make(map[string]*memoryZone),
+		tsigKeys:  make(map[string]string),
+		zoneLocks: make(map[string]time.Time),
+	}
+}
+
+// zone should be called with lock held
+func (s *MemoryStore) zone(zone string) *memoryZone {
+	z, ok := s.zones[zone]
+	if !ok {
+		z = &memoryZone{
+			locations: make(map[string]string),
+			keys:      make(map[string]string),
+		}
+		s.zones[zone] = z
+	}
+	return z
+}
+
+func (s *MemoryStore) zonesChanged() {
+	for _, f := range s.zonesSubscribers {
+		go f()
+	}
+}
+
+func (s *MemoryStore) zoneChanged(zone string, configChanged bool) {
+	for _, f := range s.zoneSubscribers {
+		go f(zone, configChanged)
+	}
+}
+
+func (s *MemoryStore) GetZones() ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var zones []string
+	for zone, z := range s.zones {
+		if z.listed {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+func (s *MemoryStore) AddZone(zone string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	z := s.zone(zone)
+	if !z.listed {
+		z.listed = true
+		s.zonesChanged()
+	}
+	return nil
+}
+
+func (s *MemoryStore) RemoveZone(zone string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if z, ok := s.zones[zone]; ok && z.listed {
+		delete(s.zones, zone)
+		s.zonesChanged()
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetZoneConfig(zone string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if z, ok := s.zones[zone]; ok {
+		return z.config, nil
+	}
+	return "", nil
+}
+
+func (s *MemoryStore) SetZoneConfig(zone string, config string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.zone(zone).config = config
+	s.zoneChanged(zone, true)
+	return nil
+}
+
+func (s *MemoryStore) GetLocations(zone string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	z, ok := s.zones[zone]
+	if !ok {
+		return nil, nil
+	}
+	labels := make([]string, 0, len(z.locations))
+	for label := range z.locations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+func (s *MemoryStore) GetLocation(zone string, label string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if z, ok := s.zones[zone]; ok {
+		return z.locations[label], nil
+	}
+	return "", nil
+}
+
+func (s *MemoryStore) SetLocation(zone string, label string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.zone(zone).locations[label] = value
+	s.zoneChanged(zone, false)
+	return nil
+}
+
+func (s *MemoryStore) RemoveLocation(zone string, label string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if z, ok := s.zones[zone]; ok {
+		delete(z.locations, label)
+		s.zoneChanged(zone, false)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetLocations(zone string, locations map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	z := s.zone(zone)
+	z.locations = make(map[string]string)
+	for label, value := range locations {
+		z.locations[label] = value
+	}
+	s.zoneChanged(zone, false)
+	return nil
+}
+
+func (s *MemoryStore) UpdateLocations(zone string, locations map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	z := s.zone(zone)
+	for label, value := range locations {
+		if value == "" {
+			delete(z.locations, label)
+		} else {
+			z.locations[label] = value
+		}
+	}
+	s.zoneChanged(zone, false)
+	return nil
+}
+
+func (s *MemoryStore) GetKey(zone string, name string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if z, ok := s.zones[zone]; ok {
+		return z.keys[name], nil
+	}
+	return "", nil
+}
+
+func (s *MemoryStore) SetKey(zone string, name string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if value == "" {
+		delete(s.zone(zone).keys, name)
+	} else {
+		s.zone(zone).keys[name] = value
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetKeys(zone string, keys map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	z := s.zone(zone)
+	for name, value := range keys {
+		if value == "" {
+			delete(z.keys, name)
+		} else {
+			z.keys[name] = value
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) LockZone(zone string, ttl time.Duration) (func(), error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if expiration, ok := s.zoneLocks[zone]; ok && time.Now().Before(expiration) {
+		return nil, errZoneLocked
+	}
+	expiration := time.Now().Add(ttl)
+	s.zoneLocks[zone] = expiration
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.zoneLocks[zone] == expiration {
+			delete(s.zoneLocks, zone)
+		}
+	}, nil
+}
+
+func (s *MemoryStore) GetTsigKey(name string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tsigKeys[name], nil
+}
+
+func (s *MemoryStore) SetTsigKey(name string, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tsigKeys[name] = value
+	return nil
+}
+
+func (s *MemoryStore) SubscribeZones(f func()) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.zonesSubscribers = append(s.zonesSubscribers, f)
+	return nil
+}
+
+func (s *MemoryStore) SubscribeZoneChanges(f func(zone string, configChanged bool)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.zoneSubscribers = append(s.zoneSubscribers, f)
+	return nil
+}
+
+func (s *MemoryStore) ShutDown() {}
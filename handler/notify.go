@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	notifyDelay    = time.Second
+	notifyRetries  = 5
+	notifyInterval = 2 * time.Second
+	notifyTimeout  = 2 * time.Second
+)
+
+// notifiedSerialKey keeps the last serial notified by any instance sharing the store
+const notifiedSerialKey = "notify:serial"
+
+type Notifier struct {
+	handler *DnsRequestHandler
+	lock    sync.Mutex
+	pending map[string]*pendingNotify
+	updated map[string]bool // zones with serial already bumped by dynamic update
+}
+
+type pendingNotify struct {
+	timer      *time.Timer
+	configOnly bool
+	serial     uint32 // zone serial when the first change was seen
+}
+
+func NewNotifier(h *DnsRequestHandler) *Notifier {
+	return &Notifier{
+		handler: h,
+		pending: make(map[string]*pendingNotify),
+		updated: make(map[string]bool),
+	}
+}
+
+func (n *Notifier) ShutDown() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for zone, p := range n.pending {
+		p.timer.Stop()
+		delete(n.pending, zone)
+	}
+}
+
+// ZoneEvent handles zone change events from store, events are delayed so a batch of changes leads to a single notify
+func (n *Notifier) ZoneEvent(zone string, configChanged bool) {
+	if n.handler.Matches(zone) != zone {
+		return
+	}
+	logger.Default.Debugf("zone %s changed, config changed : %t", zone, configChanged)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if p, ok := n.pending[zone]; ok {
+		p.timer.Reset(notifyDelay)
+		p.configOnly = p.configOnly && configChanged
+		return
+	}
+	p := &pendingNotify{configOnly: configChanged}
+	if z := n.handler.LoadZone(zone); z != nil {
+		p.serial = z.Config.SOA.Serial
+	}
+	p.timer = time.AfterFunc(notifyDelay, func() {
+		n.lock.Lock()
+		if n.pending[zone] != p {
+			n.lock.Unlock()
+			return
+		}
+		delete(n.pending, zone)
+		configOnly := p.configOnly
+		n.lock.Unlock()
+		n.zoneChanged(zone, configOnly, p.serial)
+	})
+	n.pending[zone] = p
+}
+
+// zoneChanged bumps serial of zone if it's not changed since serial was seen and notifies secondaries,
+// all instances sharing the store get the same events and only one of them bumps and notifies
+func (n *Notifier) zoneChanged(zone string, configOnly bool, serial uint32) {
+	h := n.handler
+	n.lock.Lock()
+	updated := n.updated[zone]
+	delete(n.updated, zone)
+	n.lock.Unlock()
+	h.InvalidateZone(zone)
+	z := h.LoadZone(zone)
+	if z == nil || len(z.Config.Notify.Targets) == 0 {
+		return
+	}
+
+	unlock, err := h.lockZone(zone)
+	if err != nil {
+		logger.Default.Errorf("cannot lock zone %s for notify : %s", zone, err)
+		return
+	}
+	defer unlock()
+	current, found, err := n.storedSerial(zone)
+	if err != nil {
+		logger.Default.Errorf("cannot load zone %s serial : %s", zone, err)
+		return
+	}
+	if !configOnly && !updated && (!found || current == serial) && !h.secondary.IsSecondary(zone) {
+		if current, err = n.bumpSerial(z); err != nil {
+			logger.Default.Errorf("cannot update zone %s serial : %s", zone, err)
+			return
+		}
+	} else if !found {
+		current = z.Config.SOA.Serial
+	}
+
+	value := strconv.FormatUint(uint64(current), 10)
+	if notified, _ := h.Store.GetKey(zone, notifiedSerialKey); notified == value {
+		return
+	}
+	if err := h.Store.SetKey(zone, notifiedSerialKey, value); err != nil {
+		logger.Default.Errorf("cannot store zone %s notified serial : %s", zone, err)
+	}
+
+	soa := *z.Config.SOA.Data
+	soa.Serial = current
+	for _, target := range z.Config.Notify.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+		go n.send(zone, &soa, target, z.Config.Notify.Keys)
+	}
+}
+
+// updateSerial bumps serial of a zone changed by dynamic update, following change event doesn't bump it again
+func (n *Notifier) updateSerial(z *Zone) (uint32, error) {
+	n.lock.Lock()
+	n.updated[z.Name] = true
+	n.lock.Unlock()
+	serial, err := n.bumpSerial(z)
+	if err != nil {
+		n.lock.Lock()
+		delete(n.updated, z.Name)
+		n.lock.Unlock()
+	}
+	return serial, err
+}
+
+// storedSerial returns serial set in stored zone config
+func (n *Notifier) storedSerial(zone string) (uint32, bool, error) {
+	config, soa, err := n.loadSOA(zone)
+	if err != nil || config == nil {
+		return 0, false, err
+	}
+	var serial uint32
+	raw, found := soa["serial"]
+	if found {
+		if err := json.Unmarshal(raw, &serial); err != nil {
+			return 0, false, errors.Wrap(err, "invalid serial")
+		}
+	}
+	return serial, found, nil
+}
+
+// loadSOA returns stored zone config and its soa as raw json fields, so fields not known here are kept on write
+func (n *Notifier) loadSOA(zone string) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	val, err := n.handler.Store.GetZoneConfig(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := make(map[string]json.RawMessage)
+	soa := make(map[string]json.RawMessage)
+	if len(val) == 0 {
+		return config, soa, nil
+	}
+	if err := json.Unmarshal([]byte(val), &config); err != nil {
+		return nil, nil, errors.Wrap(err, "cannot parse zone config")
+	}
+	if raw, ok := config["soa"]; ok {
+		if err := json.Unmarshal(raw, &soa); err != nil {
+			return nil, nil, errors.Wrap(err, "cannot parse zone soa")
+		}
+	}
+	return config, soa, nil
+}
+
+// bumpSerial increments serial in stored config of zone z, caller should hold the zone lock
+func (n *Notifier) bumpSerial(z *Zone) (uint32, error) {
+	h := n.handler
+	config, soa, err := n.loadSOA(z.Name)
+	if err != nil {
+		return 0, err
+	}
+	serial := z.Config.SOA.Serial
+	if raw, ok := soa["serial"]; ok {
+		if err := json.Unmarshal(raw, &serial); err != nil {
+			return 0, errors.Wrap(err, "invalid serial")
+		}
+	}
+	serial++
+	soa["serial"], _ = json.Marshal(serial)
+	if config["soa"], err = json.Marshal(soa); err != nil {
+		return 0, errors.Wrap(err, "cannot encode to json")
+	}
+	jsonValue, err := json.Marshal(config)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot encode to json")
+	}
+	if err := h.Store.SetZoneConfig(z.Name, string(jsonValue)); err != nil {
+		return 0, err
+	}
+	h.InvalidateZone(z.Name)
+	return serial, nil
+}
+
+func (n *Notifier) send(zone string, soa *dns.SOA, target string, keys []string) {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = []dns.RR{soa}
+	client := &dns.Client{Net: "udp", Timeout: notifyTimeout}
+	if len(keys) > 0 {
+		client.TsigProvider = n.handler.tsig
+	}
+	interval := notifyInterval
+	for i := 0; i < notifyRetries; i++ {
+		if len(keys) > 0 {
+			if err := n.handler.tsig.Sign(m, keys[0]); err != nil {
+				logger.Default.Errorf("cannot sign notify for %s with key %s : %s", zone, keys[0], err)
+				return
+			}
+		}
+		r, _, err := client.Exchange(m, target)
+		if err == nil {
+			if r.Rcode == dns.RcodeSuccess && r.Opcode == dns.OpcodeNotify {
+				logger.Default.Infof("notify for %s serial %d acknowledged by %s", zone, soa.Serial, target)
+			} else {
+				logger.Default.Warningf("notify for %s serial %d rejected by %s : %s", zone, soa.Serial, target, dns.RcodeToString[r.Rcode])
+			}
+			return
+		}
+		logger.Default.Debugf("notify for %s to %s failed : %s", zone, target, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+	logger.Default.Errorf("notify for %s serial %d to %s failed after %d attempts", zone, soa.Serial, target, notifyRetries)
+}
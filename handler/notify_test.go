@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var notifyZone = "notify.zon."
+
+var notifyConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.notify.zon.","ns":"ns1.notify.zon.","refresh":44,"retry":55,"expire":66,"serial":100},"notify":{"targets":["127.0.0.1:10554"]}}`
+
+var notifyEntries = [][]string{
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+	},
+}
+
+func TestNotify(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	received := make(chan *dns.Msg, 10)
+	secondary := &dns.Server{Addr: "127.0.0.1:10554", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	h := NewHandler(&handlerTestConfig)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", notifyZone)
+	for _, cmd := range notifyEntries {
+		h.testRedis().HSet("redins:zones:"+notifyZone, cmd[0], cmd[1])
+	}
+	h.testRedis().Set("redins:zones:"+notifyZone+":config", notifyConfig)
+	h.LoadZones()
+
+	// a batch of changes results in a single notify with increased serial
+	h.notifier.ZoneEvent(notifyZone, false)
+	h.notifier.ZoneEvent(notifyZone, false)
+	select {
+	case m := <-received:
+		if m.Opcode != dns.OpcodeNotify || m.Question[0].Name != notifyZone {
+			fmt.Println("invalid notify message : ", m)
+			t.Fail()
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 101 {
+			fmt.Println("unexpected serial : ", m.Answer)
+			t.Fail()
+		}
+	case <-time.After(3 * time.Second):
+		fmt.Println("notify not received")
+		t.Fail()
+	}
+
+	val, _ := h.testRedis().Get("redins:zones:" + notifyZone + ":config")
+	config := ZoneConfig{}
+	json.Unmarshal([]byte(val), &config)
+	if config.SOA.Serial != 101 || len(config.Notify.Targets) != 1 {
+		fmt.Println("unexpected config : ", val)
+		t.Fail()
+	}
+
+	// serial update by the notifier itself is not notified again
+	h.notifier.ZoneEvent(notifyZone, true)
+	select {
+	case m := <-received:
+		fmt.Println("unexpected notify : ", m)
+		t.Fail()
+	case <-time.After(2 * time.Second):
+	}
+}
+
+func TestNotifySharedStore(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	received := make(chan *dns.Msg, 10)
+	secondary := &dns.Server{Addr: "127.0.0.1:10566", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(notifyZone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.notify.zon.","ns":"ns1.notify.zon.","refresh":44,"retry":55,"expire":66,"serial":100},"notify":{"targets":["127.0.0.1:10566"]},"custom":{"owner":"ops"}}`)
+	store.SetLocation(notifyZone, "www", notifyEntries[0][1])
+	store.AddZone(notifyZone)
+	time.Sleep(100 * time.Millisecond)
+
+	// a second instance sharing the store gets the same change events
+	other := NewHandler(&config)
+	other.Store = store
+	store.SubscribeZoneChanges(other.notifier.ZoneEvent)
+	other.LoadZones()
+	h.LoadZone(notifyZone)
+	other.LoadZone(notifyZone)
+
+	store.SetLocation(notifyZone, "www2", notifyEntries[0][1])
+	select {
+	case m := <-received:
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 101 {
+			fmt.Println("unexpected serial : ", m.Answer)
+			t.Fail()
+		}
+	case <-time.After(3 * time.Second):
+		fmt.Println("notify not received")
+		t.Fail()
+	}
+	select {
+	case m := <-received:
+		fmt.Println("unexpected notify : ", m)
+		t.Fail()
+	case <-time.After(2 * time.Second):
+	}
+
+	val, _ := store.GetZoneConfig(notifyZone)
+	raw := make(map[string]json.RawMessage)
+	json.Unmarshal([]byte(val), &raw)
+	zoneConfig := ZoneConfig{}
+	json.Unmarshal([]byte(val), &zoneConfig)
+	if zoneConfig.SOA.Serial != 101 || raw["custom"] == nil {
+		fmt.Println("unexpected config : ", val)
+		t.Fail()
+	}
+	h.notifier.ShutDown()
+	other.notifier.ShutDown()
+}
@@ -0,0 +1,449 @@
+package handler
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+type SecondaryZoneConfig struct {
+	Zone      string   `json:"zone"`
+	Primaries []string `json:"primaries"`
+	Timeout   int      `json:"timeout,omitempty"`
+	Key       string   `json:"key,omitempty"`
+}
+
+type secondaryZone struct {
+	config    SecondaryZoneConfig
+	primaries []string
+	soa       *dns.SOA
+	rrs       []dns.RR
+	notify    chan struct{}
+	expired   bool
+}
+
+type Secondary struct {
+	Enable  bool
+	handler *DnsRequestHandler
+	zones   map[string]*secondaryZone
+	lock    sync.RWMutex
+	quit    chan struct{}
+	quitWG  sync.WaitGroup
+}
+
+const (
+	defaultSecondaryTimeout = 2000
+	defaultSecondaryRetry   = 60
+)
+
+func NewSecondary(config []SecondaryZoneConfig, h *DnsRequestHandler) *Secondary {
+	s := &Secondary{
+		Enable:  len(config) > 0,
+		handler: h,
+		zones:   make(map[string]*secondaryZone),
+		quit:    make(chan struct{}, 1),
+	}
+	for _, zoneConfig := range config {
+		zone := &secondaryZone{
+			config: zoneConfig,
+			notify: make(chan struct{}, 1),
+		}
+		zone.config.Zone = dns.Fqdn(zoneConfig.Zone)
+		if zone.config.Timeout == 0 {
+			zone.config.Timeout = defaultSecondaryTimeout
+		}
+		for _, primary := range zoneConfig.Primaries {
+			if _, _, err := net.SplitHostPort(primary); err != nil {
+				primary = net.JoinHostPort(primary, "53")
+			}
+			zone.primaries = append(zone.primaries, primary)
+		}
+		s.zones[zone.config.Zone] = zone
+	}
+	return s
+}
+
+func (s *Secondary) Start() {
+	for _, zone := range s.zones {
+		go s.run(zone)
+	}
+}
+
+func (s *Secondary) ShutDown() {
+	if !s.Enable {
+		return
+	}
+	s.quitWG.Add(len(s.zones))
+	close(s.quit)
+	s.quitWG.Wait()
+}
+
+func (s *Secondary) run(zone *secondaryZone) {
+	// zone data loaded from store is assumed to be fresh at startup
+	refreshed := time.Now()
+	for {
+		wait := time.Duration(defaultSecondaryRetry) * time.Second
+		if err := s.refresh(zone); err != nil {
+			logger.Default.Errorf("refreshing secondary zone %s failed : %s", zone.config.Zone, err)
+			if zone.soa != nil {
+				wait = time.Duration(zone.soa.Retry) * time.Second
+			}
+			if expire := s.expire(zone); expire > 0 && time.Since(refreshed) >= expire {
+				s.setExpired(zone, true)
+			}
+		} else {
+			refreshed = time.Now()
+			s.setExpired(zone, false)
+			if zone.soa != nil {
+				wait = time.Duration(zone.soa.Refresh) * time.Second
+			}
+		}
+		select {
+		case <-s.quit:
+			s.quitWG.Done()
+			return
+		case <-zone.notify:
+			logger.Default.Debugf("notify received for %s", zone.config.Zone)
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (s *Secondary) IsSecondary(zone string) bool {
+	_, ok := s.zones[zone]
+	return ok
+}
+
+// Expired reports whether zone is not refreshed from its primaries for soa expire seconds, expired zones are not served (RFC 1035 section 4.3.5)
+func (s *Secondary) Expired(zone string) bool {
+	if s == nil {
+		return false
+	}
+	z, ok := s.zones[zone]
+	if !ok {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return z.expired
+}
+
+func (s *Secondary) setExpired(zone *secondaryZone, expired bool) {
+	s.lock.Lock()
+	changed := zone.expired != expired
+	zone.expired = expired
+	s.lock.Unlock()
+	if !changed {
+		return
+	}
+	if expired {
+		logger.Default.Errorf("secondary zone %s expired", zone.config.Zone)
+	} else {
+		logger.Default.Infof("secondary zone %s is served again", zone.config.Zone)
+	}
+	s.handler.InvalidateZone(zone.config.Zone)
+}
+
+// expire returns soa expire of zone, either from the last transfer or from stored zone data
+func (s *Secondary) expire(zone *secondaryZone) time.Duration {
+	if zone.soa != nil {
+		return time.Duration(zone.soa.Expire) * time.Second
+	}
+	if s.handler.Matches(zone.config.Zone) != zone.config.Zone {
+		return 0
+	}
+	if z := s.handler.LoadZone(zone.config.Zone); z != nil {
+		return time.Duration(z.Config.SOA.Expire) * time.Second
+	}
+	return 0
+}
+
+// Notify schedules an immediate refresh of zone if the source is one of its primaries
+func (s *Secondary) Notify(zoneName string, source string) int {
+	zone, ok := s.zones[dns.Fqdn(zoneName)]
+	if !ok {
+		return dns.RcodeNotAuth
+	}
+	allowed := false
+	for _, primary := range zone.primaries {
+		if host, _, err := net.SplitHostPort(primary); err == nil && net.ParseIP(host).Equal(net.ParseIP(source)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		logger.Default.Warningf("notify for %s from unknown primary %s", zone.config.Zone, source)
+		return dns.RcodeRefused
+	}
+	select {
+	case zone.notify <- struct{}{}:
+	default:
+	}
+	return dns.RcodeSuccess
+}
+
+func (s *Secondary) refresh(zone *secondaryZone) error {
+	var lastErr error
+	for _, primary := range zone.primaries {
+		soa, err := s.primarySoa(zone, primary)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if zone.soa != nil && !serialGreater(soa.Serial, zone.soa.Serial) {
+			logger.Default.Debugf("secondary zone %s is up to date : %d", zone.config.Zone, zone.soa.Serial)
+			return nil
+		}
+		rrs, err := s.transfer(zone, primary)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := s.store(zone, rrs); err != nil {
+			return err
+		}
+		logger.Default.Infof("secondary zone %s updated from %s, serial : %d", zone.config.Zone, primary, zone.soa.Serial)
+		return nil
+	}
+	return lastErr
+}
+
+func (s *Secondary) primarySoa(zone *secondaryZone, primary string) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone.config.Zone, dns.TypeSOA)
+	if err := s.sign(zone, m); err != nil {
+		return nil, err
+	}
+	client := &dns.Client{Net: "udp", Timeout: time.Duration(zone.config.Timeout) * time.Millisecond}
+	if zone.config.Key != "" {
+		client.TsigProvider = s.handler.tsig
+	}
+	r, _, err := client.Exchange(m, primary)
+	if err == nil && r.Truncated {
+		client.Net = "tcp"
+		r, _, err = client.Exchange(m, primary)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, errors.Errorf("%s returned %s for soa query", primary, dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, errors.Errorf("%s returned no soa record", primary)
+}
+
+func (s *Secondary) transfer(zone *secondaryZone, primary string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	if zone.soa != nil && zone.rrs != nil {
+		m.SetIxfr(zone.config.Zone, zone.soa.Serial, zone.soa.Ns, zone.soa.Mbox)
+	} else {
+		m.SetAxfr(zone.config.Zone)
+	}
+	if err := s.sign(zone, m); err != nil {
+		return nil, err
+	}
+	tr := &dns.Transfer{
+		DialTimeout: time.Duration(zone.config.Timeout) * time.Millisecond,
+		ReadTimeout: time.Duration(zone.config.Timeout) * time.Millisecond,
+	}
+	if zone.config.Key != "" {
+		// responses are verified only when requests are signed
+		tr.TsigProvider = s.handler.tsig
+	}
+	ch, err := tr.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	if len(rrs) == 0 {
+		return nil, errors.Errorf("empty transfer from %s", primary)
+	}
+	if _, ok := rrs[0].(*dns.SOA); !ok {
+		return nil, errors.Errorf("transfer from %s does not start with soa", primary)
+	}
+	if len(rrs) > 2 {
+		if _, ok := rrs[1].(*dns.SOA); ok && zone.rrs != nil {
+			return applyIxfr(zone.rrs, rrs), nil
+		}
+	}
+	if len(rrs) == 1 {
+		// primary has nothing newer for us
+		return zone.rrs, nil
+	}
+	return rrs[:len(rrs)-1], nil
+}
+
+func (s *Secondary) sign(zone *secondaryZone, m *dns.Msg) error {
+	if zone.config.Key == "" {
+		return nil
+	}
+	if err := s.handler.tsig.Sign(m, zone.config.Key); err != nil {
+		return errors.Wrapf(err, "cannot sign request with key %s", zone.config.Key)
+	}
+	return nil
+}
+
+// applyIxfr applies the difference sequences of an incremental transfer (RFC 1995) to current zone data
+func applyIxfr(current []dns.RR, ixfr []dns.RR) []dns.RR {
+	rrs := make(map[string]dns.RR)
+	for _, rr := range current[1:] {
+		rrs[rr.String()] = rr
+	}
+	// each difference sequence starts with the old soa followed by deleted records
+	adding := true
+	for _, rr := range ixfr[1 : len(ixfr)-1] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			adding = !adding
+			continue
+		}
+		if adding {
+			rrs[rr.String()] = rr
+		} else {
+			delete(rrs, rr.String())
+		}
+	}
+	result := []dns.RR{ixfr[0]}
+	for _, rr := range rrs {
+		result = append(result, rr)
+	}
+	return result
+}
+
+func (s *Secondary) store(zone *secondaryZone, rrs []dns.RR) error {
+	h := s.handler
+	soa := rrs[0].(*dns.SOA)
+	records, skipped := zoneRecords(zone.config.Zone, rrs[1:])
+	for _, rr := range skipped {
+		logger.Default.Debugf("skipping unsupported record in %s : %s", zone.config.Zone, rr.String())
+	}
+	if err := saveZone(h.Store, zone.config.Zone, soa, records); err != nil {
+		return err
+	}
+	h.LoadZones()
+	h.InvalidateZone(zone.config.Zone)
+
+	zone.soa = soa
+	zone.rrs = rrs
+	return nil
+}
+
+func (h *DnsRequestHandler) HandleNotify(state *request.Request) int {
+	res := dns.RcodeSuccess
+	if h.secondary.IsSecondary(state.Name()) {
+		if z := h.LoadZone(state.Name()); z != nil {
+			res = checkTsig(state, z.Config.Notify.Keys)
+		}
+	}
+	if res == dns.RcodeSuccess {
+		res = h.secondary.Notify(state.Name(), state.IP())
+	} else {
+		logger.Default.Warningf("notify for %s from %s refused : %s", state.Name(), state.IP(), dns.RcodeToString[res])
+	}
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, res)
+	m.Authoritative = res == dns.RcodeSuccess
+	signResponse(state, m)
+	state.W.WriteMsg(m)
+	return res
+}
+
+// addRR converts rr into json storage format and adds it to record
+func addRR(record *Record, rr dns.RR) bool {
+	ttl := rr.Header().Ttl
+	switch r := rr.(type) {
+	case *dns.A:
+		record.A.Ttl = ttl
+		record.A.Data = append(record.A.Data, IP_RR{Ip: r.A})
+	case *dns.AAAA:
+		record.AAAA.Ttl = ttl
+		record.AAAA.Data = append(record.AAAA.Data, IP_RR{Ip: r.AAAA})
+	case *dns.CNAME:
+		record.CNAME = &CNAME_RRSet{Host: r.Target, Ttl: ttl}
+	case *dns.DNAME:
+		record.DNAME = &DNAME_RRSet{Target: r.Target, Ttl: ttl}
+	case *dns.TXT:
+		record.TXT.Ttl = ttl
+		record.TXT.Data = append(record.TXT.Data, TXT_RR{Text: strings.Join(r.Txt, "")})
+	case *dns.NS:
+		record.NS.Ttl = ttl
+		record.NS.Data = append(record.NS.Data, NS_RR{Host: r.Ns})
+	case *dns.MX:
+		record.MX.Ttl = ttl
+		record.MX.Data = append(record.MX.Data, MX_RR{Host: r.Mx, Preference: r.Preference})
+	case *dns.SRV:
+		record.SRV.Ttl = ttl
+		record.SRV.Data = append(record.SRV.Data, SRV_RR{Target: r.Target, Priority: r.Priority, Weight: r.Weight, Port: r.Port})
+	case *dns.CAA:
+		record.CAA.Ttl = ttl
+		record.CAA.Data = append(record.CAA.Data, CAA_RR{Tag: r.Tag, Value: r.Value, Flag: r.Flag})
+	case *dns.PTR:
+		record.PTR = &PTR_RRSet{Domain: r.Ptr, Ttl: ttl}
+	case *dns.TLSA:
+		record.TLSA.Ttl = ttl
+		record.TLSA.Data = append(record.TLSA.Data, TLSA_RR{Usage: r.Usage, Selector: r.Selector, MatchingType: r.MatchingType, Certificate: r.Certificate})
+	case *dns.SSHFP:
+		record.SSHFP.Ttl = ttl
+		record.SSHFP.Data = append(record.SSHFP.Data, SSHFP_RR{Algorithm: r.Algorithm, Type: r.Type, Fingerprint: r.FingerPrint})
+	case *dns.NAPTR:
+		record.NAPTR.Ttl = ttl
+		record.NAPTR.Data = append(record.NAPTR.Data, NAPTR_RR{Order: r.Order, Preference: r.Preference, Flags: r.Flags, Service: r.Service, Regexp: r.Regexp, Replacement: r.Replacement})
+	case *dns.DS:
+		record.DS.Ttl = ttl
+		record.DS.Data = append(record.DS.Data, DS_RR{KeyTag: r.KeyTag, Algorithm: r.Algorithm, DigestType: r.DigestType, Digest: r.Digest})
+	case *dns.HINFO:
+		record.HINFO.Ttl = ttl
+		record.HINFO.Data = append(record.HINFO.Data, HINFO_RR{Cpu: r.Cpu, Os: r.Os})
+	case *dns.LOC:
+		record.LOC.Ttl = ttl
+		record.LOC.Data = append(record.LOC.Data, LOC_RR{
+			Latitude:  float64(int64(r.Latitude)-dns.LOC_EQUATOR) / dns.LOC_DEGREES,
+			Longitude: float64(int64(r.Longitude)-dns.LOC_PRIMEMERIDIAN) / dns.LOC_DEGREES,
+			Altitude:  float64(int64(r.Altitude)-dns.LOC_ALTITUDEBASE*100) / 100,
+			Size:      locMeters(r.Size),
+			HorizPre:  locMeters(r.HorizPre),
+			VertPre:   locMeters(r.VertPre),
+		})
+	case *dns.URI:
+		record.URI.Ttl = ttl
+		record.URI.Data = append(record.URI.Data, URI_RR{Priority: r.Priority, Weight: r.Weight, Target: r.Target})
+	case *dns.SVCB:
+		svcb, ok := svcbData(r)
+		if !ok {
+			return false
+		}
+		record.SVCB.Ttl = ttl
+		record.SVCB.Data = append(record.SVCB.Data, svcb)
+	case *dns.HTTPS:
+		svcb, ok := svcbData(&r.SVCB)
+		if !ok {
+			return false
+		}
+		record.HTTPS.Ttl = ttl
+		record.HTTPS.Data = append(record.HTTPS.Data, svcb)
+	default:
+		return false
+	}
+	return true
+}
+
+// serialGreater compares serials using serial number arithmetic (RFC 1982)
+func serialGreater(s1, s2 uint32) bool {
+	return s1 != s2 && (s1-s2) < 1<<31
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/hawell/uperdis"
+	"github.com/miekg/dns"
+)
+
+var secondaryZoneName = "secondary.zon."
+
+var secondaryPrimaryData = [][]string{
+	{
+		"secondary.zon. 300 IN SOA ns1.secondary.zon. hostmaster.secondary.zon. 1 44 55 66 100",
+		"secondary.zon. 300 IN NS ns1.secondary.zon.",
+		"ns1.secondary.zon. 300 IN A 1.1.1.1",
+		"www.secondary.zon. 300 IN A 2.2.2.2",
+		"www.secondary.zon. 300 IN TXT \"foo\"",
+	},
+	{
+		"secondary.zon. 300 IN SOA ns1.secondary.zon. hostmaster.secondary.zon. 2 44 55 66 100",
+		"secondary.zon. 300 IN NS ns1.secondary.zon.",
+		"ns1.secondary.zon. 300 IN A 1.1.1.1",
+		"www.secondary.zon. 300 IN A 3.3.3.3",
+		"mail.secondary.zon. 300 IN MX 10 www.secondary.zon.",
+	},
+}
+
+var secondaryTestCases = [][]test.Case{
+	{
+		{
+			Qname: "www.secondary.zon.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("www.secondary.zon. 300 IN A 2.2.2.2"),
+			},
+		},
+		{
+			Qname: "www.secondary.zon.", Qtype: dns.TypeTXT,
+			Answer: []dns.RR{
+				test.TXT("www.secondary.zon. 300 IN TXT \"foo\""),
+			},
+		},
+	},
+	{
+		{
+			Qname: "www.secondary.zon.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("www.secondary.zon. 300 IN A 3.3.3.3"),
+			},
+		},
+		{
+			Qname: "mail.secondary.zon.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{
+				test.MX("mail.secondary.zon. 300 IN MX 10 www.secondary.zon."),
+			},
+			Extra: []dns.RR{
+				test.A("www.secondary.zon. 300 IN A 3.3.3.3"),
+			},
+		},
+		{
+			Qname: "www.secondary.zon.", Qtype: dns.TypeTXT,
+			Ns: []dns.RR{
+				test.SOA("secondary.zon. 300 IN SOA ns1.secondary.zon. hostmaster.secondary.zon. 2 44 55 66 100"),
+			},
+		},
+	},
+}
+
+type testPrimary struct {
+	sync.Mutex
+	rrs         []dns.RR
+	history     [][]dns.RR
+	incremental int
+}
+
+func (p *testPrimary) setVersion(version int) {
+	p.setData(secondaryPrimaryData[version])
+}
+
+func (p *testPrimary) setData(data []string) {
+	p.Lock()
+	defer p.Unlock()
+	p.rrs = nil
+	for _, rr := range data {
+		r, _ := dns.NewRR(rr)
+		p.rrs = append(p.rrs, r)
+	}
+	p.history = append(p.history, p.rrs)
+}
+
+// ixfr returns difference sequence from client version to current version (RFC 1995 section 4), nil if client version is unknown
+func (p *testPrimary) ixfr(r *dns.Msg) []dns.RR {
+	if len(r.Ns) == 0 {
+		return nil
+	}
+	clientSoa, ok := r.Ns[0].(*dns.SOA)
+	if !ok {
+		return nil
+	}
+	for _, old := range p.history {
+		if old[0].(*dns.SOA).Serial != clientSoa.Serial || old[0].(*dns.SOA).Serial == p.rrs[0].(*dns.SOA).Serial {
+			continue
+		}
+		contains := func(rrs []dns.RR, rr dns.RR) bool {
+			for _, x := range rrs[1:] {
+				if x.String() == rr.String() {
+					return true
+				}
+			}
+			return false
+		}
+		diff := []dns.RR{p.rrs[0], old[0]}
+		for _, rr := range old[1:] {
+			if !contains(p.rrs, rr) {
+				diff = append(diff, rr)
+			}
+		}
+		diff = append(diff, p.rrs[0])
+		for _, rr := range p.rrs[1:] {
+			if !contains(old, rr) {
+				diff = append(diff, rr)
+			}
+		}
+		return append(diff, p.rrs[0])
+	}
+	return nil
+}
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	p.Lock()
+	rrs := append(append([]dns.RR{}, p.rrs...), p.rrs[0])
+	if r.Question[0].Qtype == dns.TypeIXFR {
+		if diff := p.ixfr(r); diff != nil {
+			rrs = diff
+			p.incremental++
+		}
+	}
+	p.Unlock()
+	switch r.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		ch := make(chan *dns.Envelope)
+		tr := new(dns.Transfer)
+		go func() {
+			ch <- &dns.Envelope{RR: rrs}
+			close(ch)
+		}()
+		tr.Out(w, r, ch)
+	default:
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{rrs[0]}
+		w.WriteMsg(m)
+	}
+}
+
+// notifyResponseWriter pretends notify messages come from the local primary
+type notifyResponseWriter struct {
+	test.ResponseWriter
+}
+
+func (w *notifyResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40212}
+}
+
+func TestSecondary(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	primary := &testPrimary{}
+	primary.setVersion(0)
+	udp := &dns.Server{Addr: "127.0.0.1:10553", Net: "udp", Handler: primary}
+	tcp := &dns.Server{Addr: "127.0.0.1:10553", Net: "tcp", Handler: primary}
+	go udp.ListenAndServe()
+	go tcp.ListenAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	config := handlerTestConfig
+	config.Secondary = []SecondaryZoneConfig{
+		{
+			Zone:      secondaryZoneName,
+			Primaries: []string{"127.0.0.1:10553"},
+		},
+	}
+	rd := uperdis.NewRedis(&config.Redis)
+	rd.Del("*")
+
+	h := NewHandler(&config)
+	defer h.ShutDown()
+
+	check := func(version int) {
+		for i, tc := range secondaryTestCases[version] {
+			r := tc.Msg()
+			w := test.NewRecorder(&test.ResponseWriter{})
+			state := request.Request{W: w, Req: r}
+			h.HandleRequest(&state)
+
+			resp := w.Msg
+			if err := test.SortAndCheck(resp, tc); err != nil {
+				fmt.Println(version, i, err, tc.Answer, resp.Answer)
+				t.Fail()
+			}
+		}
+	}
+
+	time.Sleep(time.Second)
+	check(0)
+
+	primary.setVersion(1)
+	m := new(dns.Msg)
+	m.SetNotify(secondaryZoneName)
+	w := test.NewRecorder(&notifyResponseWriter{})
+	state := request.Request{W: w, Req: m}
+	h.HandleRequest(&state)
+	if w.Msg.Rcode != dns.RcodeSuccess || !w.Msg.Authoritative {
+		fmt.Println("notify failed : ", w.Msg.Rcode)
+		t.Fail()
+	}
+	time.Sleep(time.Second)
+	check(1)
+
+	// notify from unknown source is refused
+	m = new(dns.Msg)
+	m.SetNotify(secondaryZoneName)
+	w = test.NewRecorder(&test.ResponseWriter{})
+	state = request.Request{W: w, Req: m}
+	h.HandleRequest(&state)
+	if w.Msg.Rcode != dns.RcodeRefused {
+		fmt.Println("unexpected notify response : ", w.Msg.Rcode)
+		t.Fail()
+	}
+}
+
+func TestSecondaryIxfr(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	primary := &testPrimary{}
+	primary.setVersion(0)
+	listen := func() (*dns.Server, *dns.Server) {
+		udp := &dns.Server{Addr: "127.0.0.1:10562", Net: "udp", Handler: primary}
+		tcp := &dns.Server{Addr: "127.0.0.1:10562", Net: "tcp", Handler: primary}
+		go udp.ListenAndServe()
+		go tcp.ListenAndServe()
+		time.Sleep(time.Millisecond * 200)
+		return udp, tcp
+	}
+	udp, tcp := listen()
+
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	config.Secondary = []SecondaryZoneConfig{
+		{
+			Zone:      secondaryZoneName,
+			Primaries: []string{"127.0.0.1:10562"},
+			Timeout:   500,
+		},
+	}
+	h := NewHandler(&config)
+	defer h.ShutDown()
+
+	check := func(version int) {
+		for i, tc := range secondaryTestCases[version] {
+			w := test.NewRecorder(&test.ResponseWriter{})
+			h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+			if err := test.SortAndCheck(w.Msg, tc); err != nil {
+				fmt.Println(version, i, err, w.Msg)
+				t.Fail()
+			}
+		}
+	}
+	notify := func() {
+		m := new(dns.Msg)
+		m.SetNotify(secondaryZoneName)
+		h.HandleRequest(&request.Request{W: test.NewRecorder(&notifyResponseWriter{}), Req: m})
+		time.Sleep(time.Second)
+	}
+
+	time.Sleep(time.Second)
+	check(0)
+
+	// changes are applied from an incremental transfer
+	primary.setVersion(1)
+	notify()
+	check(1)
+	primary.Lock()
+	incremental := primary.incremental
+	primary.Unlock()
+	if incremental != 1 {
+		fmt.Println("incremental transfer not used : ", incremental)
+		t.Fail()
+	}
+
+	// zone is not served when primary is unreachable for soa expire seconds
+	primary.setData([]string{
+		"secondary.zon. 300 IN SOA ns1.secondary.zon. hostmaster.secondary.zon. 3 1 1 2 100",
+		"secondary.zon. 300 IN NS ns1.secondary.zon.",
+		"www.secondary.zon. 300 IN A 3.3.3.3",
+	})
+	notify()
+	udp.Shutdown()
+	tcp.Shutdown()
+	query := func() *dns.Msg {
+		tc := test.Case{Qname: "www.secondary.zon.", Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+		return w.Msg
+	}
+	if resp := query(); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+	time.Sleep(4 * time.Second)
+	if resp := query(); resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("expired zone served : ", resp)
+		t.Fail()
+	}
+
+	// zone is served again after a successful refresh
+	udp, tcp = listen()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+	time.Sleep(2 * time.Second)
+	if resp := query(); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("zone not served after refresh : ", resp)
+		t.Fail()
+	}
+}
@@ -1,68 +1,282 @@
 package handler
 
 import (
-	"strconv"
-
-	"github.com/miekg/dns"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 )
 
 type TlsConfig struct {
-	Enable   bool `json:"enable"`
-	CertPath string `json:"cert_path"`
-	KeyPath  string `json:"key_path"`
-	CaPath   string `json:"ca_path"`
+	Enable         bool   `json:"enable"`
+	CertPath       string `json:"cert_path"`
+	KeyPath        string `json:"key_path"`
+	CaPath         string `json:"ca_path"`
+	ReloadInterval int    `json:"reload_interval,omitempty"`
 }
 
 type ServerConfig struct {
-	Ip       string `json:"ip,omitempty"`
-	Port     int    `json:"port,omitempty"`
-	Protocol string `json:"protocol,omitempty"`
-	Tls      TlsConfig `json:"tls,omitempty"`
+	Ip             string    `json:"ip,omitempty"`
+	Port           int       `json:"port,omitempty"`
+	Protocol       string    `json:"protocol,omitempty"`
+	Tls            TlsConfig `json:"tls,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	TrustedProxies []string  `json:"trusted_proxies,omitempty"`
 }
 
-func loadRoots(caPath string) *x509.CertPool {
-	if caPath == "" {
-		return nil
-	}
+type Server interface {
+	ListenAndServe() error
+	Shutdown() error
+}
 
+const defaultCertReloadInterval = 60
+
+func loadRoots(caPath string) (*x509.CertPool, error) {
 	roots := x509.NewCertPool()
 	pem, err := ioutil.ReadFile(caPath)
 	if err != nil {
-		return nil
+		return nil, errors.Wrapf(err, "cannot read ca file %s", caPath)
 	}
-	ok := roots.AppendCertsFromPEM(pem)
-	if !ok {
-		return nil
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no valid certificate in ca file %s", caPath)
 	}
-	return roots
+	return roots, nil
 }
 
-func loadTlsConfig(cfg TlsConfig) *tls.Config {
-	root := loadRoots(cfg.CaPath)
-	if cfg.KeyPath == "" || cfg.CertPath == "" {
-		return &tls.Config{RootCAs: root}
+func loadTlsConfig(cfg TlsConfig) (*tls.Config, error) {
+	if cfg.CertPath == "" || cfg.KeyPath == "" {
+		return nil, errors.New("tls is enabled but cert_path or key_path is not set")
 	}
-	cert, err := tls.LoadX509KeyPair(cfg.CertPath, cfg.KeyPath)
+	reloader, err := newCertReloader(cfg)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.CaPath != "" {
+		roots, err := loadRoots(cfg.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = roots
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: root}
+	return tlsConfig, nil
 }
 
-func NewServer(config []ServerConfig) []dns.Server {
-	var servers []dns.Server
-	for _, cfg := range config {
-		server := dns.Server{
-			Addr: cfg.Ip + ":" + strconv.Itoa(cfg.Port),
-			Net:  cfg.Protocol,
+// certReloader reloads certificate when cert or key files change
+type certReloader struct {
+	sync.Mutex
+	certPath  string
+	keyPath   string
+	interval  time.Duration
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(cfg TlsConfig) (*certReloader, error) {
+	r := &certReloader{
+		certPath: cfg.CertPath,
+		keyPath:  cfg.KeyPath,
+		interval: time.Duration(cfg.ReloadInterval) * time.Second,
+	}
+	if cfg.ReloadInterval == 0 {
+		r.interval = defaultCertReloadInterval * time.Second
+	}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTime, errors.Wrapf(err, "cannot access %s", path)
 		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot load certificate %s", r.certPath)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.lastCheck) < r.interval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	modTime, err := r.filesModTime()
+	if err != nil {
+		logger.Default.Errorf("cannot check certificate files : %s", err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	// keep serving old certificate if new files are not ready yet
+	if err := r.load(modTime); err != nil {
+		logger.Default.Errorf("cannot reload certificate : %s", err)
+		return r.cert, nil
+	}
+	logger.Default.Infof("certificate %s reloaded", r.certPath)
+	return r.cert, nil
+}
+
+// msgAcceptFunc accepts dynamic updates which are rejected by dns.DefaultMsgAcceptFunc
+func msgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	isResponse := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if !isResponse && opcode == dns.OpcodeUpdate && dh.Qdcount == 1 {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func NewServer(config []ServerConfig, tsigProvider dns.TsigProvider) ([]Server, error) {
+	var servers []Server
+	for _, cfg := range config {
+		addr := cfg.Ip + ":" + strconv.Itoa(cfg.Port)
+		var tlsConfig *tls.Config
 		if cfg.Tls.Enable {
-			server.TLSConfig = loadTlsConfig(cfg.Tls)
+			var err error
+			if tlsConfig, err = loadTlsConfig(cfg.Tls); err != nil {
+				return nil, errors.Wrapf(err, "invalid tls config for %s", addr)
+			}
+		}
+		switch cfg.Protocol {
+		case "https":
+			servers = append(servers, NewDohServer(cfg, tlsConfig, tsigProvider))
+		case "quic":
+			if tlsConfig == nil {
+				return nil, errors.Errorf("tls is not enabled for quic listener on %s", addr)
+			}
+			servers = append(servers, NewDoqServer(cfg, tlsConfig, tsigProvider))
+		case "udp", "tcp", "tls", "tcp-tls":
+			network := cfg.Protocol
+			if network == "tls" {
+				network = "tcp-tls"
+			}
+			// dns over tls is served only when asked for explicitly
+			if network == "tcp" && cfg.Tls.Enable {
+				return nil, errors.Errorf("tls is enabled for tcp listener on %s, use tls protocol for dns over tls", addr)
+			}
+			if network == "tcp-tls" && tlsConfig == nil {
+				return nil, errors.Errorf("tls is not enabled for %s listener on %s", cfg.Protocol, addr)
+			}
+			servers = append(servers, &dns.Server{
+				Addr:          addr,
+				Net:           network,
+				TLSConfig:     tlsConfig,
+				TsigProvider:  tsigProvider,
+				MsgAcceptFunc: msgAcceptFunc,
+			})
+		default:
+			return nil, errors.Errorf("unsupported protocol %s for %s", cfg.Protocol, addr)
 		}
-		servers = append(servers, server)
 	}
-	return servers
+	return servers, nil
+}
+
+// msgResponseWriter keeps response of a single request for listeners not based on dns.Server
+type msgResponseWriter struct {
+	localAddr      net.Addr
+	remoteAddr     net.Addr
+	tsigProvider   dns.TsigProvider
+	tsigStatus     error
+	tsigRequestMAC string
+	msg            []byte
 }
+
+func newMsgResponseWriter(localAddr net.Addr, remoteAddr net.Addr, tsigProvider dns.TsigProvider, req *dns.Msg, buf []byte) *msgResponseWriter {
+	w := &msgResponseWriter{
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		tsigProvider: tsigProvider,
+	}
+	if tsig := req.IsTsig(); tsig != nil {
+		if tsigProvider == nil {
+			w.tsigStatus = dns.ErrSecret
+		} else {
+			w.tsigStatus = dns.TsigVerifyWithProvider(buf, tsigProvider, "", false)
+			w.tsigRequestMAC = tsig.MAC
+		}
+	}
+	return w
+}
+
+// refuseTransfer answers zone transfer requests with refused, msgResponseWriter keeps a single message
+// while transfers may take several
+func refuseTransfer(w dns.ResponseWriter, req *dns.Msg) bool {
+	if len(req.Question) == 0 {
+		return false
+	}
+	if qtype := req.Question[0].Qtype; qtype != dns.TypeAXFR && qtype != dns.TypeIXFR {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	w.WriteMsg(m)
+	return true
+}
+
+func (w *msgResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *msgResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *msgResponseWriter) WriteMsg(m *dns.Msg) error {
+	var (
+		data []byte
+		err  error
+	)
+	if w.tsigProvider != nil && m.IsTsig() != nil {
+		data, _, err = dns.TsigGenerateWithProvider(m, w.tsigProvider, w.tsigRequestMAC, false)
+	} else {
+		data, err = m.Pack()
+	}
+	if err != nil {
+		logger.Default.Errorf("cannot pack response : %s", err)
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *msgResponseWriter) Write(buf []byte) (int, error) {
+	w.msg = append([]byte(nil), buf...)
+	return len(buf), nil
+}
+
+func (w *msgResponseWriter) Close() error        { return nil }
+func (w *msgResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *msgResponseWriter) TsigTimersOnly(bool) {}
+func (w *msgResponseWriter) Hijack()             {}
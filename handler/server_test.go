@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir
+func writeTestCert(dir string, name string, serial int64) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+func TestServerConfig(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	dir, _ := ioutil.TempDir("", "redins")
+	defer os.RemoveAll(dir)
+	certPath, keyPath, err := writeTestCert(dir, "server", 1)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	invalid := []ServerConfig{
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tls"},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tls", Tls: TlsConfig{Enable: true}},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tls", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: filepath.Join(dir, "missing.key")}},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tls", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath, CaPath: filepath.Join(dir, "missing.crt")}},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "sctp"},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tcp", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath}},
+	}
+	for i, cfg := range invalid {
+		if _, err := NewServer([]ServerConfig{cfg}, nil); err == nil {
+			fmt.Println(i, "invalid config accepted")
+			t.Fail()
+		}
+	}
+
+	servers, err := NewServer([]ServerConfig{
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "udp"},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tcp"},
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tcp-tls", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath}},
+	}, nil)
+	if err != nil || servers[1].(*dns.Server).Net != "tcp" || servers[2].(*dns.Server).Net != "tcp-tls" {
+		fmt.Println("valid config rejected : ", err)
+		t.Fail()
+	}
+}
+
+func dotPeerSerial(addr string, clientCert *tls.Certificate) (int64, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: tlsConfig, Timeout: time.Second}
+	conn, err := client.Dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := client.ExchangeWithConn(m, conn); err != nil {
+		return 0, err
+	}
+	return conn.Conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestDot(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	dir, _ := ioutil.TempDir("", "redins")
+	defer os.RemoveAll(dir)
+	certPath, keyPath, err := writeTestCert(dir, "server", 1)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	clientCertPath, clientKeyPath, err := writeTestCert(dir, "client", 100)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	clientCert, _ := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+
+	servers, err := NewServer([]ServerConfig{
+		{Ip: "127.0.0.1", Port: 10557, Protocol: "tls", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath, ReloadInterval: 1}},
+		{Ip: "127.0.0.1", Port: 10558, Protocol: "tls", Tls: TlsConfig{Enable: true, CertPath: certPath, KeyPath: keyPath, CaPath: clientCertPath}},
+	}, nil)
+	if err != nil {
+		fmt.Println("cannot create servers : ", err)
+		t.FailNow()
+	}
+	for i := range servers {
+		servers[i].(*dns.Server).Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+		})
+		go servers[i].ListenAndServe()
+		defer servers[i].Shutdown()
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	if serial, err := dotPeerSerial("127.0.0.1:10557", nil); err != nil || serial != 1 {
+		fmt.Println("dot query failed : ", serial, err)
+		t.Fail()
+	}
+
+	// certificate is reloaded when files change
+	if _, _, err := writeTestCert(dir, "server", 2); err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	time.Sleep(time.Millisecond * 1100)
+	if serial, err := dotPeerSerial("127.0.0.1:10557", nil); err != nil || serial != 2 {
+		fmt.Println("certificate not reloaded : ", serial, err)
+		t.Fail()
+	}
+
+	// client certificate is required when ca is set
+	if _, err := dotPeerSerial("127.0.0.1:10558", nil); err == nil {
+		fmt.Println("connection without client certificate accepted")
+		t.Fail()
+	}
+	if _, err := dotPeerSerial("127.0.0.1:10558", &clientCert); err != nil {
+		fmt.Println("connection with client certificate failed : ", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/hawell/logger"
+	"github.com/hawell/uperdis"
+	"github.com/pkg/errors"
+)
+
+// ZoneStore is the storage backend of zones, values are json encoded in the same format as in redis
+type ZoneStore interface {
+	// GetZones returns list of served zones
+	GetZones() ([]string, error)
+	AddZone(zone string) error
+	GetZoneConfig(zone string) (string, error)
+	SetZoneConfig(zone string, config string) error
+	// GetLocations returns labels of zone locations, "@" is used for zone apex
+	GetLocations(zone string) ([]string, error)
+	GetLocation(zone string, label string) (string, error)
+	SetLocation(zone string, label string, value string) error
+	RemoveLocation(zone string, label string) error
+	// SetLocations replaces all locations of zone
+	SetLocations(zone string, locations map[string]string) error
+	// UpdateLocations changes several locations of zone at once, empty values remove locations
+	UpdateLocations(zone string, locations map[string]string) error
+	// GetKey returns zone dnssec keys, e.g. zsk:pub
+	GetKey(zone string, name string) (string, error)
+	// SetKey stores zone dnssec keys, empty value removes the key
+	SetKey(zone string, name string, value string) error
+	// SetKeys stores several zone keys at once, empty values remove keys
+	SetKeys(zone string, keys map[string]string) error
+	// LockZone takes a lock on zone shared by all users of store, lock is released by calling unlock or after ttl.
+	// errZoneLocked is returned if zone is already locked
+	LockZone(zone string, ttl time.Duration) (unlock func(), err error)
+	GetTsigKey(name string) (string, error)
+	// SubscribeZones calls f when list of zones changes
+	SubscribeZones(f func()) error
+	// SubscribeZoneChanges calls f when locations or config of a zone changes
+	SubscribeZoneChanges(f func(zone string, configChanged bool)) error
+	ShutDown()
+}
+
+var errZoneLocked = errors.New("zone is locked")
+
+type StoreConfig struct {
+	Backend        string `json:"backend,omitempty"`
+	Path           string `json:"path,omitempty"`
+	ReloadInterval int    `json:"reload_interval,omitempty"`
+}
+
+func NewZoneStore(config *StoreConfig, redisConfig *uperdis.RedisConfig) (ZoneStore, error) {
+	switch config.Backend {
+	case "", "redis":
+		return NewRedisStore(redisConfig), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(config.Path, config.ReloadInterval)
+	default:
+		return nil, errors.Errorf("unsupported store backend %s", config.Backend)
+	}
+}
+
+// RedisStore keeps zones in redis:
+// redins:zones : set of zones
+// redins:zones:<zone> : hash of locations
+// redins:zones:<zone>:config : zone config
+// redins:zones:<zone>:<key> : dnssec keys
+// redins:zones:<zone>:lock : zone lock
+// redins:tsig:<name> : tsig keys
+// keys are stored with configured prefix and suffix, e.g. <prefix>redins:zones<suffix>
+type RedisStore struct {
+	pool   *redis.Pool
+	db     int
+	prefix string
+	suffix string
+	quit   chan struct{}
+}
+
+// time between attempts to restore a failed subscription
+const redisSubscribeRetry = time.Second
+
+func NewRedisStore(config *uperdis.RedisConfig) *RedisStore {
+	return &RedisStore{
+		pool:   newRedisPool(config),
+		db:     config.DB,
+		prefix: config.Prefix,
+		suffix: config.Suffix,
+		quit:   make(chan struct{}),
+	}
+}
+
+func newRedisPool(config *uperdis.RedisConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     2,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", net.JoinHostPort(config.Ip, strconv.Itoa(config.Port)),
+				redis.DialDatabase(config.DB),
+				redis.DialPassword(config.Password),
+				redis.DialConnectTimeout(time.Duration(config.ConnectTimeout)*time.Millisecond),
+				redis.DialReadTimeout(time.Duration(config.ReadTimeout)*time.Millisecond),
+			)
+		},
+	}
+}
+
+func (s *RedisStore) key(key string) string {
+	return s.prefix + key + s.suffix
+}
+
+func (s *RedisStore) do(command string, args ...interface{}) (interface{}, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+// getString returns value of a string or hash field reply, missing values are returned as empty strings
+func getString(reply interface{}, err error) (string, error) {
+	val, err := redis.String(reply, err)
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return val, err
+}
+
+func (s *RedisStore) GetZones() ([]string, error) {
+	return redis.Strings(s.do("SMEMBERS", s.key("redins:zones")))
+}
+
+func (s *RedisStore) AddZone(zone string) error {
+	_, err := s.do("SADD", s.key("redins:zones"), zone)
+	return err
+}
+
+func (s *RedisStore) GetZoneConfig(zone string) (string, error) {
+	return getString(s.do("GET", s.key("redins:zones:"+zone+":config")))
+}
+
+func (s *RedisStore) SetZoneConfig(zone string, config string) error {
+	_, err := s.do("SET", s.key("redins:zones:"+zone+":config"), config)
+	return err
+}
+
+func (s *RedisStore) GetLocations(zone string) ([]string, error) {
+	return redis.Strings(s.do("HKEYS", s.key("redins:zones:"+zone)))
+}
+
+func (s *RedisStore) GetLocation(zone string, label string) (string, error) {
+	return getString(s.do("HGET", s.key("redins:zones:"+zone), label))
+}
+
+func (s *RedisStore) SetLocation(zone string, label string, value string) error {
+	_, err := s.do("HSET", s.key("redins:zones:"+zone), label, value)
+	return err
+}
+
+func (s *RedisStore) RemoveLocation(zone string, label string) error {
+	_, err := s.do("HDEL", s.key("redins:zones:"+zone), label)
+	return err
+}
+
+// SetLocations replaces locations in a transaction, readers never see an empty or partial zone
+func (s *RedisStore) SetLocations(zone string, locations map[string]string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	key := s.key("redins:zones:" + zone)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	if err := conn.Send("DEL", key); err != nil {
+		return err
+	}
+	if len(locations) > 0 {
+		args := redis.Args{}.Add(key)
+		for label, value := range locations {
+			args = args.Add(label, value)
+		}
+		if err := conn.Send("HSET", args...); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// UpdateLocations writes locations in a transaction, readers never see a partial change
+func (s *RedisStore) UpdateLocations(zone string, locations map[string]string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	key := s.key("redins:zones:" + zone)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for label, value := range locations {
+		var err error
+		if value == "" {
+			err = conn.Send("HDEL", key, label)
+		} else {
+			err = conn.Send("HSET", key, label, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *RedisStore) GetKey(zone string, name string) (string, error) {
+	return getString(s.do("GET", s.key("redins:zones:"+zone+":"+name)))
+}
+
+func (s *RedisStore) SetKey(zone string, name string, value string) error {
+	var err error
+	if value == "" {
+		_, err = s.do("DEL", s.key("redins:zones:"+zone+":"+name))
+	} else {
+		_, err = s.do("SET", s.key("redins:zones:"+zone+":"+name), value)
+	}
+	return err
+}
+
+// SetKeys writes keys in a transaction, readers never see half of a key pair
+func (s *RedisStore) SetKeys(zone string, keys map[string]string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for name, value := range keys {
+		var err error
+		if value == "" {
+			err = conn.Send("DEL", s.key("redins:zones:"+zone+":"+name))
+		} else {
+			err = conn.Send("SET", s.key("redins:zones:"+zone+":"+name), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// unlockScript removes lock only if it is still held by the same owner
+var unlockScript = redis.NewScript(1, `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+
+func (s *RedisStore) LockZone(zone string, ttl time.Duration) (func(), error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	owner := hex.EncodeToString(token)
+	key := s.key("redins:zones:" + zone + ":lock")
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", key, owner, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return nil, errZoneLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		conn := s.pool.Get()
+		defer conn.Close()
+		if _, err := unlockScript.Do(conn, key, owner); err != nil {
+			logger.Default.Errorf("cannot unlock zone %s : %s", zone, err)
+		}
+	}, nil
+}
+
+func (s *RedisStore) GetTsigKey(name string) (string, error) {
+	return getString(s.do("GET", s.key("redins:tsig:"+name)))
+}
+
+// SubscribeZones uses redis keyspace events, notify-keyspace-events should be enabled
+func (s *RedisStore) SubscribeZones(f func()) error {
+	return s.subscribe("redins:zones", func(channel string) {
+		f()
+	})
+}
+
+// SubscribeZoneChanges uses redis keyspace events, notify-keyspace-events should be enabled
+func (s *RedisStore) SubscribeZoneChanges(f func(zone string, configChanged bool)) error {
+	return s.subscribe("redins:zones:*", func(channel string) {
+		idx := strings.Index(channel, "redins:zones:")
+		if idx < 0 {
+			return
+		}
+		key := strings.TrimSuffix(channel[idx+len("redins:zones:"):], s.suffix)
+		if strings.HasSuffix(key, ":config") {
+			f(strings.TrimSuffix(key, ":config"), true)
+		} else if !strings.Contains(key, ":") {
+			// dnssec keys and other zone metadata are ignored
+			f(key, false)
+		}
+	})
+}
+
+// subscribe calls f with channel of keyspace events of keys matching pattern,
+// subscription is restored after connection failures until store is shut down
+func (s *RedisStore) subscribe(pattern string, f func(channel string)) error {
+	channel := "__keyspace@" + strconv.Itoa(s.db) + "__:" + s.key(pattern)
+	psc, err := s.psubscribe(channel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				f(v.Channel)
+			case error:
+				psc.Close()
+				logger.Default.Errorf("redis subscription to %s failed : %s", pattern, v)
+				if psc = s.resubscribe(channel); psc == nil {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// resubscribe retries subscription until it succeeds or store is shut down
+func (s *RedisStore) resubscribe(channel string) *redis.PubSubConn {
+	for {
+		select {
+		case <-s.quit:
+			return nil
+		case <-time.After(redisSubscribeRetry):
+		}
+		if psc, err := s.psubscribe(channel); err == nil {
+			return psc
+		}
+	}
+}
+
+// psubscribe returns after redis confirms the subscription, so no event after it is missed
+func (s *RedisStore) psubscribe(channel string) (*redis.PubSubConn, error) {
+	psc := &redis.PubSubConn{Conn: s.pool.Get()}
+	if err := psc.PSubscribe(channel); err != nil {
+		psc.Close()
+		return nil, err
+	}
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+		return psc, nil
+	case error:
+		psc.Close()
+		return nil, v
+	default:
+		psc.Close()
+		return nil, errors.Errorf("unexpected reply to subscription : %v", v)
+	}
+}
+
+func (s *RedisStore) ShutDown() {
+	close(s.quit)
+	s.pool.Close()
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/hawell/uperdis"
+	"github.com/miekg/dns"
+)
+
+var (
+	testRedisLock    sync.Mutex
+	testRedisClients = make(map[uperdis.RedisConfig]*uperdis.Redis)
+)
+
+// testRedis returns a client for setting up redis data of tests
+func testRedis(config *uperdis.RedisConfig) *uperdis.Redis {
+	testRedisLock.Lock()
+	defer testRedisLock.Unlock()
+	r, ok := testRedisClients[*config]
+	if !ok {
+		r = uperdis.NewRedis(config)
+		testRedisClients[*config] = r
+	}
+	return r
+}
+
+// testRedis returns a client for setting up data of redis store used by handler
+func (h *DnsRequestHandler) testRedis() *uperdis.Redis {
+	return testRedis(&h.Config.Redis)
+}
+
+var storeZone = "store.zon."
+
+var storeConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.store.zon.","ns":"ns1.store.zon.","refresh":44,"retry":55,"expire":66,"serial":10}}`
+
+func storeQuery(h *DnsRequestHandler, qname string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	w := test.NewRecorder(&test.ResponseWriter{})
+	state := request.Request{W: w, Req: r}
+	h.HandleRequest(&state)
+	return w.Msg
+}
+
+func storeAnswer(resp *dns.Msg) string {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		return ""
+	}
+	if a, ok := resp.Answer[0].(*dns.A); ok {
+		return a.A.String()
+	}
+	return ""
+}
+
+func TestMemoryStore(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	config := handlerTestConfig
+	config.CacheTimeout = 1
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	defer h.ShutDown()
+	store, ok := h.Store.(*MemoryStore)
+	if !ok {
+		fmt.Println("memory store is not used")
+		t.FailNow()
+	}
+	store.SetZoneConfig(storeZone, storeConfig)
+	store.SetLocation(storeZone, "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	store.AddZone(storeZone)
+	time.Sleep(time.Millisecond * 100)
+
+	if ip := storeAnswer(storeQuery(h, "www.store.zon.", dns.TypeA)); ip != "1.2.3.4" {
+		fmt.Println("unexpected answer : ", ip)
+		t.Fail()
+	}
+	if resp := storeQuery(h, "store.zon.", dns.TypeSOA); resp == nil || len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != 10 {
+		fmt.Println("unexpected soa : ", resp)
+		t.Fail()
+	}
+
+	store.RemoveZone(storeZone)
+	time.Sleep(time.Millisecond * 1500)
+	if resp := storeQuery(h, "www.store.zon.", dns.TypeA); storeAnswer(resp) != "" {
+		fmt.Println("removed zone is served : ", resp)
+		t.Fail()
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	dir, _ := ioutil.TempDir("", "redins")
+	defer os.RemoveAll(dir)
+	zoneFile := filepath.Join(dir, "store.zon.json")
+	writeZone := func(ip string) {
+		content := `{"config":` + storeConfig + `,"locations":{"www":{"a":{"ttl":300, "records":[{"ip":"` + ip + `"}]}}}}`
+		if err := ioutil.WriteFile(zoneFile, []byte(content), 0600); err != nil {
+			fmt.Println(err)
+			t.FailNow()
+		}
+	}
+	writeZone("1.2.3.4")
+
+	if _, err := NewFileStore(filepath.Join(dir, "missing"), 0); err == nil {
+		fmt.Println("missing directory accepted")
+		t.Fail()
+	}
+
+	config := handlerTestConfig
+	config.CacheTimeout = 1
+	config.Store = StoreConfig{Backend: "file", Path: dir, ReloadInterval: 1}
+	h := NewHandler(&config)
+	defer h.ShutDown()
+
+	if ip := storeAnswer(storeQuery(h, "www.store.zon.", dns.TypeA)); ip != "1.2.3.4" {
+		fmt.Println("unexpected answer : ", ip)
+		t.Fail()
+	}
+
+	// changed files are reloaded
+	writeZone("5.6.7.8")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(zoneFile, future, future)
+	time.Sleep(time.Millisecond * 2500)
+	if ip := storeAnswer(storeQuery(h, "www.store.zon.", dns.TypeA)); ip != "5.6.7.8" {
+		fmt.Println("zone file not reloaded : ", ip)
+		t.Fail()
+	}
+
+	// changes are written back to files
+	if err := h.Store.SetLocation(storeZone, "mail", `{"a":{"ttl":300, "records":[{"ip":"9.9.9.9"}]}}`); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+	store, err := NewFileStore(dir, 0)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	defer store.ShutDown()
+	if zones, _ := store.GetZones(); len(zones) != 1 || zones[0] != storeZone {
+		fmt.Println("unexpected zones : ", zones)
+		t.Fail()
+	}
+	if labels, _ := store.GetLocations(storeZone); len(labels) != 2 || labels[0] != "mail" || labels[1] != "www" {
+		fmt.Println("unexpected locations : ", labels)
+		t.Fail()
+	}
+	zoneConfig := ZoneConfig{}
+	val, _ := store.GetZoneConfig(storeZone)
+	if err := json.Unmarshal([]byte(val), &zoneConfig); err != nil || zoneConfig.SOA == nil || zoneConfig.SOA.Serial != 10 {
+		fmt.Println("unexpected config : ", val, err)
+		t.Fail()
+	}
+
+	// master files are loaded but not changed
+	masterFile := `$ORIGIN master.zon.
+@ 300 IN SOA ns1.master.zon. hostmaster.master.zon. 20 44 55 66 100
+www 300 IN A 10.0.0.1
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "master.zon.zone"), []byte(masterFile), 0600); err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 2500)
+	if ip := storeAnswer(storeQuery(h, "www.master.zon.", dns.TypeA)); ip != "10.0.0.1" {
+		fmt.Println("master file not loaded : ", ip)
+		t.Fail()
+	}
+	if resp := storeQuery(h, "master.zon.", dns.TypeSOA); resp == nil || len(resp.Answer) != 1 || resp.Answer[0].(*dns.SOA).Serial != 20 {
+		fmt.Println("unexpected soa : ", resp)
+		t.Fail()
+	}
+	if err := h.Store.SetLocation("master.zon.", "mail", `{"a":{"ttl":300, "records":[{"ip":"9.9.9.9"}]}}`); err == nil {
+		fmt.Println("zone loaded from master file changed")
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "master.zon.json")); !os.IsNotExist(err) {
+		fmt.Println("zone loaded from master file written back : ", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+const (
+	transferChunkSize = 16000
+)
+
+func (h *DnsRequestHandler) HandleTransfer(state *request.Request) int {
+	zone := h.Matches(state.Name())
+	if zone == "" || zone != dns.Fqdn(state.Name()) {
+		return h.transferError(state, dns.RcodeNotAuth)
+	}
+	if h.secondary.Expired(zone) {
+		return h.transferError(state, dns.RcodeServerFailure)
+	}
+	z := h.LoadZone(zone)
+	if z == nil {
+		return h.transferError(state, dns.RcodeServerFailure)
+	}
+	if len(z.Config.Transfer.Allow) == 0 && len(z.Config.Transfer.Keys) == 0 {
+		logger.Default.Warningf("transfer of %s refused for %s, transfer is not enabled", zone, state.IP())
+		return h.transferError(state, dns.RcodeRefused)
+	}
+	if len(z.Config.Transfer.Allow) > 0 && !transferAllowed(state.IP(), z.Config.Transfer.Allow) {
+		logger.Default.Warningf("transfer of %s refused for %s", zone, state.IP())
+		return h.transferError(state, dns.RcodeRefused)
+	}
+	if res := checkTsig(state, z.Config.Transfer.Keys); res != dns.RcodeSuccess {
+		logger.Default.Warningf("transfer of %s refused for %s : %s", zone, state.IP(), dns.RcodeToString[res])
+		return h.transferError(state, res)
+	}
+
+	soa := z.Config.SOA.Data
+	if state.QType() == dns.TypeIXFR {
+		// we don't keep zone history, so the only incremental answer we can give
+		// is "up to date"; everything else falls back to a full transfer (RFC 1995 section 4)
+		if len(state.Req.Ns) > 0 {
+			if clientSoa, ok := state.Req.Ns[0].(*dns.SOA); ok && clientSoa.Serial == soa.Serial {
+				return h.transferSoaOnly(state, soa)
+			}
+		}
+		if state.Proto() != "tcp" {
+			return h.transferSoaOnly(state, soa)
+		}
+	} else if state.Proto() != "tcp" {
+		return h.transferError(state, dns.RcodeRefused)
+	}
+
+	rrs := []dns.RR{soa}
+	rrs = append(rrs, h.zoneRRs(z)...)
+	rrs = append(rrs, soa)
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		if err := tr.Out(state.W, state.Req, ch); err != nil {
+			logger.Default.Errorf("transfer of %s to %s failed : %s", zone, state.IP(), err)
+		}
+		wg.Done()
+	}()
+	var chunk []dns.RR
+	size := 0
+	for _, rr := range rrs {
+		l := dns.Len(rr)
+		if size+l > transferChunkSize && len(chunk) > 0 {
+			ch <- &dns.Envelope{RR: chunk}
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, rr)
+		size += l
+	}
+	ch <- &dns.Envelope{RR: chunk}
+	close(ch)
+	wg.Wait()
+
+	logger.Default.Debugf("zone %s transferred to %s : %d records", zone, state.IP(), len(rrs))
+	return dns.RcodeSuccess
+}
+
+func (h *DnsRequestHandler) transferSoaOnly(state *request.Request, soa *dns.SOA) int {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{soa}
+	signResponse(state, m)
+	state.W.WriteMsg(m)
+	return dns.RcodeSuccess
+}
+
+func (h *DnsRequestHandler) transferError(state *request.Request, rcode int) int {
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, rcode)
+	signResponse(state, m)
+	state.W.WriteMsg(m)
+	return rcode
+}
+
+func transferAllowed(ip string, allow []string) bool {
+	clientIp := net.ParseIP(ip)
+	if clientIp == nil {
+		return false
+	}
+	for _, a := range allow {
+		if _, network, err := net.ParseCIDR(a); err == nil {
+			if network.Contains(clientIp) {
+				return true
+			}
+		} else if allowedIp := net.ParseIP(a); allowedIp != nil && allowedIp.Equal(clientIp) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *DnsRequestHandler) zoneRRs(z *Zone) []dns.RR {
+	var labels []string
+	for label := range z.Locations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var rrs []dns.RR
+	for _, label := range labels {
+		location := label
+		if label == "@" {
+			location = z.Name
+		}
+		record := h.LoadLocation(location, z)
+		if record == nil {
+			continue
+		}
+		rrs = append(rrs, h.locationRRs(record)...)
+	}
+	return rrs
+}
+
+func (h *DnsRequestHandler) locationRRs(record *Record) []dns.RR {
+	var rrs []dns.RR
+	name := record.Name
+	rrs = append(rrs, h.A(name, record, record.A.Data)...)
+	rrs = append(rrs, h.AAAA(name, record, record.AAAA.Data)...)
+	rrs = append(rrs, h.CNAME(name, record)...)
+	rrs = append(rrs, h.DNAME(name, record)...)
+	rrs = append(rrs, h.TXT(name, record)...)
+	rrs = append(rrs, h.NS(name, record)...)
+	rrs = append(rrs, h.MX(name, record)...)
+	rrs = append(rrs, h.SRV(name, record)...)
+	rrs = append(rrs, h.CAA(name, record)...)
+	rrs = append(rrs, h.PTR(name, record)...)
+	rrs = append(rrs, h.TLSA(name, record)...)
+	rrs = append(rrs, h.SSHFP(name, record)...)
+	rrs = append(rrs, h.NAPTR(name, record)...)
+	rrs = append(rrs, h.DS(name, record)...)
+	rrs = append(rrs, h.HINFO(name, record)...)
+	rrs = append(rrs, h.LOC(name, record)...)
+	rrs = append(rrs, h.URI(name, record)...)
+	rrs = append(rrs, h.SVCB(name, record)...)
+	rrs = append(rrs, h.HTTPS(name, record)...)
+	return rrs
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"testing"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var transferZones = []string{"transfer.zon.", "notransfer.zon."}
+
+var transferConfig = []string{
+	`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.transfer.zon.","ns":"ns1.transfer.zon.","refresh":44,"retry":55,"expire":66,"serial":1000},"transfer":{"allow":["10.240.0.0/24"]}}`,
+	`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.notransfer.zon.","ns":"ns1.notransfer.zon.","refresh":44,"retry":55,"expire":66,"serial":1000},"transfer":{"allow":["10.10.10.10"]}}`,
+}
+
+var transferEntries = [][]string{
+	{"@",
+		`{"ns":{"ttl":300, "records":[{"host":"ns1.transfer.zon."},{"host":"ns2.transfer.zon."}]}}`,
+	},
+	{"ns1",
+		`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+	},
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"},{"ip":"3.3.3.3"}]},"txt":{"ttl":300, "records":[{"text":"foo"}]}}`,
+	},
+	{"mail",
+		`{"cname":{"ttl":300, "host":"www.transfer.zon."}}`,
+	},
+}
+
+var transferTestCases = []test.Case{
+	{
+		Qname: "transfer.zon.", Qtype: dns.TypeAXFR,
+		Answer: []dns.RR{
+			test.SOA("transfer.zon. 300 IN SOA ns1.transfer.zon. hostmaster.transfer.zon. 1000 44 55 66 100"),
+			test.NS("transfer.zon. 300 IN NS ns1.transfer.zon."),
+			test.NS("transfer.zon. 300 IN NS ns2.transfer.zon."),
+			test.CNAME("mail.transfer.zon. 300 IN CNAME www.transfer.zon."),
+			test.A("ns1.transfer.zon. 300 IN A 1.1.1.1"),
+			test.A("www.transfer.zon. 300 IN A 2.2.2.2"),
+			test.A("www.transfer.zon. 300 IN A 3.3.3.3"),
+			test.TXT("www.transfer.zon. 300 IN TXT foo"),
+			test.SOA("transfer.zon. 300 IN SOA ns1.transfer.zon. hostmaster.transfer.zon. 1000 44 55 66 100"),
+		},
+	},
+	{
+		Qname: "notransfer.zon.", Qtype: dns.TypeAXFR,
+		Rcode: dns.RcodeRefused,
+	},
+	{
+		Qname: "www.transfer.zon.", Qtype: dns.TypeAXFR,
+		Rcode: dns.RcodeNotAuth,
+	},
+}
+
+func TestZoneTransfer(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	h := NewHandler(&handlerTestConfig)
+	h.testRedis().Del("*")
+	for i, zone := range transferZones {
+		h.testRedis().SAdd("redins:zones", zone)
+		for _, cmd := range transferEntries {
+			err := h.testRedis().HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			if err != nil {
+				log.Printf("[ERROR] cannot connect to redis: %s", err)
+				t.Fail()
+			}
+		}
+		h.testRedis().Set("redins:zones:"+zone+":config", transferConfig[i])
+	}
+	h.LoadZones()
+
+	for i, tc := range transferTestCases {
+		r := tc.Msg()
+		w := test.NewRecorder(&test.ResponseWriter{TCP: true})
+		state := request.Request{W: w, Req: r}
+		h.HandleRequest(&state)
+
+		resp := w.Msg
+		if resp.Rcode != tc.Rcode {
+			fmt.Println(i, "unexpected rcode", resp.Rcode)
+			t.Fail()
+			continue
+		}
+		if len(resp.Answer) != len(tc.Answer) {
+			fmt.Println(i, tc.Answer, resp.Answer)
+			t.Fail()
+			continue
+		}
+		for j := range tc.Answer {
+			if resp.Answer[j].String() != tc.Answer[j].String() {
+				fmt.Println(i, j, tc.Answer[j], resp.Answer[j])
+				t.Fail()
+			}
+		}
+	}
+
+	// axfr over udp is not allowed
+	r := transferTestCases[0].Msg()
+	w := test.NewRecorder(&test.ResponseWriter{})
+	state := request.Request{W: w, Req: r}
+	h.HandleRequest(&state)
+	if w.Msg.Rcode != dns.RcodeRefused {
+		fmt.Println("axfr over udp : ", w.Msg.Rcode)
+		t.Fail()
+	}
+
+	// ixfr with current serial gets a single soa
+	r = new(dns.Msg)
+	r.SetIxfr("transfer.zon.", 1000, "ns1.transfer.zon.", "hostmaster.transfer.zon.")
+	w = test.NewRecorder(&test.ResponseWriter{})
+	state = request.Request{W: w, Req: r}
+	h.HandleRequest(&state)
+	if len(w.Msg.Answer) != 1 || w.Msg.Answer[0].Header().Rrtype != dns.TypeSOA {
+		fmt.Println("ixfr : ", w.Msg.Answer)
+		t.Fail()
+	}
+}
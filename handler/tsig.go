@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+type TsigKey struct {
+	Name      string `json:"name,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+const tsigFudge = 300
+
+// TsigKeyStore keeps tsig keys from config and zone store (redins:tsig:<name> in redis) and implements dns.TsigProvider
+type TsigKeyStore struct {
+	keys         map[string]*TsigKey
+	store        ZoneStore
+	cache        *cache.Cache
+	cacheTimeout time.Duration
+}
+
+func NewTsigKeyStore(keys []TsigKey, store ZoneStore, cacheTimeout int) *TsigKeyStore {
+	s := &TsigKeyStore{
+		keys:         make(map[string]*TsigKey),
+		store:        store,
+		cacheTimeout: time.Duration(cacheTimeout) * time.Second,
+	}
+	s.cache = cache.New(s.cacheTimeout, s.cacheTimeout*10)
+	for i := range keys {
+		key := keys[i]
+		if err := key.normalize(); err != nil {
+			logger.Default.Errorf("invalid tsig key %s : %s", key.Name, err)
+			continue
+		}
+		s.keys[key.Name] = &key
+	}
+	return s
+}
+
+func (k *TsigKey) normalize() error {
+	k.Name = dns.CanonicalName(k.Name)
+	if k.Algorithm == "" {
+		k.Algorithm = dns.HmacSHA256
+	}
+	k.Algorithm = dns.CanonicalName(k.Algorithm)
+	if k.Algorithm != dns.HmacSHA256 && k.Algorithm != dns.HmacSHA512 {
+		return errors.Errorf("unsupported algorithm %s", k.Algorithm)
+	}
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+		return errors.Wrap(err, "invalid secret")
+	}
+	return nil
+}
+
+// Key returns tsig key by name, keys in config take precedence over keys in zone store
+func (s *TsigKeyStore) Key(name string) (*TsigKey, error) {
+	name = dns.CanonicalName(name)
+	if key, ok := s.keys[name]; ok {
+		return key, nil
+	}
+	if key, found := s.cache.Get(name); found {
+		return key.(*TsigKey), nil
+	}
+	val, err := s.store.GetTsigKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, dns.ErrSecret
+	}
+	key := new(TsigKey)
+	if err := json.Unmarshal([]byte(val), key); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse tsig key %s", name)
+	}
+	key.Name = name
+	if err := key.normalize(); err != nil {
+		return nil, errors.Wrapf(err, "invalid tsig key %s", name)
+	}
+	s.cache.Set(name, key, s.cacheTimeout)
+	return key, nil
+}
+
+func (s *TsigKeyStore) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key, err := s.Key(t.Hdr.Name)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, _ := base64.StdEncoding.DecodeString(key.Secret)
+	var h hash.Hash
+	switch key.Algorithm {
+	case dns.HmacSHA256:
+		h = hmac.New(sha256.New, secret)
+	case dns.HmacSHA512:
+		h = hmac.New(sha512.New, secret)
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (s *TsigKeyStore) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := s.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
+
+// Sign adds a tsig record to m using key name, m is signed when it is written or sent
+func (s *TsigKeyStore) Sign(m *dns.Msg, name string) error {
+	key, err := s.Key(name)
+	if err != nil {
+		return err
+	}
+	m.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	return nil
+}
+
+func (h *DnsRequestHandler) TsigProvider() dns.TsigProvider {
+	return h.tsig
+}
+
+// checkTsig checks request signature against allowed keys of an operation, empty list means no signature is required
+func checkTsig(state *request.Request, keys []string) int {
+	if len(keys) == 0 {
+		return dns.RcodeSuccess
+	}
+	tsig := state.Req.IsTsig()
+	if tsig == nil {
+		return dns.RcodeRefused
+	}
+	if state.W.TsigStatus() != nil {
+		return dns.RcodeNotAuth
+	}
+	if !keyAllowed(tsig.Hdr.Name, keys) {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+func keyAllowed(name string, keys []string) bool {
+	for _, key := range keys {
+		if dns.CanonicalName(key) == dns.CanonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signResponse signs m with the key used in request, if any
+func signResponse(state *request.Request, m *dns.Msg) {
+	if tsig := state.Req.IsTsig(); tsig != nil && state.W.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	}
+}
+
+// tsigError responds to requests failing tsig verification (RFC 8945 section 5.2)
+func (h *DnsRequestHandler) tsigError(state *request.Request) int {
+	tsig := state.Req.IsTsig()
+	err := state.W.TsigStatus()
+	logger.Default.Warningf("tsig verification for %s from %s with key %s failed : %s", state.Name(), state.IP(), tsig.Hdr.Name, err)
+
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeNotAuth)
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	t := m.IsTsig()
+	switch {
+	case err == dns.ErrTime:
+		t.Error = dns.RcodeBadTime
+		t.TimeSigned = tsig.TimeSigned
+	case err == dns.ErrSig:
+		t.Error = dns.RcodeBadSig
+	case err == dns.ErrSecret, err == dns.ErrKeyAlg:
+		t.Error = dns.RcodeBadKey
+	default:
+		t.Error = dns.RcodeBadSig
+	}
+	state.W.WriteMsg(m)
+	return dns.RcodeNotAuth
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var tsigZone = "tsig.zon."
+
+var tsigConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.tsig.zon.","ns":"ns1.tsig.zon.","refresh":44,"retry":55,"expire":66,"serial":100},"transfer":{"keys":["redis.key."]},"update":{"keys":["config.key."]}}`
+
+var tsigEntries = [][]string{
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+	},
+}
+
+func TestTsig(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	config := handlerTestConfig
+	config.TsigKeys = []TsigKey{
+		{Name: "config.key", Secret: "Y29uZmlnIHNlY3JldA=="},
+	}
+	h := NewHandler(&config)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", tsigZone)
+	for _, cmd := range tsigEntries {
+		h.testRedis().HSet("redins:zones:"+tsigZone, cmd[0], cmd[1])
+	}
+	h.testRedis().Set("redins:zones:"+tsigZone+":config", tsigConfig)
+	h.testRedis().Set("redins:tsig:redis.key.", `{"algorithm":"hmac-sha512","secret":"cmVkaXMgc2VjcmV0"}`)
+	h.LoadZones()
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		state := request.Request{W: w, Req: r}
+		h.HandleRequest(&state)
+	})
+	servers, err := NewServer([]ServerConfig{
+		{Ip: "127.0.0.1", Port: 10555, Protocol: "udp"},
+		{Ip: "127.0.0.1", Port: 10555, Protocol: "tcp"},
+	}, h.TsigProvider())
+	if err != nil {
+		fmt.Println("cannot create servers : ", err)
+		t.FailNow()
+	}
+	for i := range servers {
+		servers[i].(*dns.Server).Handler = handler
+		go servers[i].ListenAndServe()
+		defer servers[i].Shutdown()
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	// signed query gets a signed response
+	m := new(dns.Msg)
+	m.SetQuestion("www.tsig.zon.", dns.TypeA)
+	m.SetTsig("config.key.", dns.HmacSHA256, 300, time.Now().Unix())
+	client := &dns.Client{Net: "udp", TsigSecret: map[string]string{"config.key.": "Y29uZmlnIHNlY3JldA=="}}
+	r, _, err := client.Exchange(m, "127.0.0.1:10555")
+	if err != nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 || r.IsTsig() == nil {
+		fmt.Println("signed query failed : ", err, r)
+		t.Fail()
+	}
+
+	// wrong secret
+	m = new(dns.Msg)
+	m.SetQuestion("www.tsig.zon.", dns.TypeA)
+	m.SetTsig("config.key.", dns.HmacSHA256, 300, time.Now().Unix())
+	client = &dns.Client{Net: "udp", TsigSecret: map[string]string{"config.key.": "d3Jvbmc="}}
+	r, _, _ = client.Exchange(m, "127.0.0.1:10555")
+	if r == nil || r.Rcode != dns.RcodeNotAuth || r.IsTsig() == nil || r.IsTsig().Error != dns.RcodeBadSig {
+		fmt.Println("expected badsig : ", r)
+		t.Fail()
+	}
+
+	// unknown key
+	m = new(dns.Msg)
+	m.SetQuestion("www.tsig.zon.", dns.TypeA)
+	m.SetTsig("unknown.key.", dns.HmacSHA256, 300, time.Now().Unix())
+	client = &dns.Client{Net: "udp", TsigSecret: map[string]string{"unknown.key.": "d3Jvbmc="}}
+	r, _, _ = client.Exchange(m, "127.0.0.1:10555")
+	if r == nil || r.Rcode != dns.RcodeNotAuth || r.IsTsig() == nil || r.IsTsig().Error != dns.RcodeBadKey {
+		fmt.Println("expected badkey : ", r)
+		t.Fail()
+	}
+
+	// transfer requires the key from redis
+	tr := &dns.Transfer{TsigSecret: map[string]string{"redis.key.": "cmVkaXMgc2VjcmV0"}}
+	m = new(dns.Msg)
+	m.SetAxfr(tsigZone)
+	m.SetTsig("redis.key.", dns.HmacSHA512, 300, time.Now().Unix())
+	ch, err := tr.In(m, "127.0.0.1:10555")
+	count := 0
+	if err == nil {
+		for env := range ch {
+			if env.Error != nil {
+				err = env.Error
+				break
+			}
+			count += len(env.RR)
+		}
+	}
+	if err != nil || count != 3 {
+		fmt.Println("signed transfer failed : ", err, count)
+		t.Fail()
+	}
+
+	m = new(dns.Msg)
+	m.SetAxfr(tsigZone)
+	w := test.NewRecorder(&test.ResponseWriter{TCP: true})
+	state := request.Request{W: w, Req: m}
+	h.HandleRequest(&state)
+	if w.Msg.Rcode != dns.RcodeRefused {
+		fmt.Println("unsigned transfer : ", w.Msg.Rcode)
+		t.Fail()
+	}
+
+	// update with a key not allowed for update
+	m = new(dns.Msg)
+	m.SetUpdate(tsigZone)
+	m.Insert([]dns.RR{test.A("new.tsig.zon. 300 IN A 2.2.2.2")})
+	m.SetTsig("redis.key.", dns.HmacSHA512, 300, time.Now().Unix())
+	client = &dns.Client{Net: "udp", TsigSecret: map[string]string{"redis.key.": "cmVkaXMgc2VjcmV0"}}
+	r, _, err = client.Exchange(m, "127.0.0.1:10555")
+	if err != nil || r.Rcode != dns.RcodeRefused {
+		fmt.Println("expected refused update : ", err, r)
+		t.Fail()
+	}
+}
@@ -0,0 +1,520 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+type UpdateConfig struct {
+	Keys []string `json:"keys,omitempty"`
+}
+
+// HandleUpdate processes dynamic update messages (RFC 2136)
+func (h *DnsRequestHandler) HandleUpdate(state *request.Request) int {
+	if len(state.Req.Question) != 1 || state.Req.Question[0].Qtype != dns.TypeSOA {
+		return h.updateResponse(state, dns.RcodeFormatError)
+	}
+	zone := h.Matches(state.Name())
+	if zone == "" || zone != dns.Fqdn(state.Name()) {
+		return h.updateResponse(state, dns.RcodeNotAuth)
+	}
+	if h.secondary.IsSecondary(zone) {
+		return h.updateResponse(state, dns.RcodeNotImplemented)
+	}
+	z := h.LoadZone(zone)
+	if z == nil {
+		return h.updateResponse(state, dns.RcodeServerFailure)
+	}
+
+	if len(z.Config.Update.Keys) == 0 {
+		logger.Default.Warningf("update for %s from %s refused, no keys configured", zone, state.IP())
+		return h.updateResponse(state, dns.RcodeRefused)
+	}
+	if res := checkTsig(state, z.Config.Update.Keys); res != dns.RcodeSuccess {
+		logger.Default.Warningf("update for %s from %s refused : %s", zone, state.IP(), dns.RcodeToString[res])
+		return h.updateResponse(state, res)
+	}
+	tsig := state.Req.IsTsig()
+
+	// records are read, modified and written back, concurrent updates of a zone would lose changes
+	unlock, err := h.lockZone(zone)
+	if err != nil {
+		logger.Default.Errorf("cannot lock zone %s for update : %s", zone, err)
+		return h.updateResponse(state, dns.RcodeServerFailure)
+	}
+	defer unlock()
+
+	records := make(map[string]*Record)
+	if res := h.checkPrerequisites(z, state.Req.Answer, records); res != dns.RcodeSuccess {
+		return h.updateResponse(state, res)
+	}
+	if res := prescanUpdate(z, state.Req.Ns); res != dns.RcodeSuccess {
+		return h.updateResponse(state, res)
+	}
+
+	changed := make(map[string]bool)
+	for _, rr := range state.Req.Ns {
+		name := strings.ToLower(rr.Header().Name)
+		record := h.updateRecord(name, z, records)
+		if record == nil {
+			return h.updateResponse(state, dns.RcodeServerFailure)
+		}
+		if applyUpdate(record, rr, h.updateRRs(record)) {
+			changed[name] = true
+		}
+	}
+
+	if len(changed) > 0 {
+		// update is applied entirely or not at all (RFC 2136 section 3.4)
+		locations := make(map[string]*Record, len(changed))
+		for name := range changed {
+			record := records[name]
+			if name != z.Name && len(h.updateRRs(record)) == 0 && record.ANAME == nil {
+				record = nil
+			}
+			locations[zoneLabel(name, z)] = record
+		}
+		err = h.UpdateLocations(z, locations)
+		if err == nil {
+			// update is already applied, failing to bump serial is only reported
+			if serial, err := h.notifier.updateSerial(z); err == nil {
+				logger.Default.Infof("zone %s updated by %s using key %s, serial : %d", zone, state.IP(), tsig.Hdr.Name, serial)
+			} else {
+				logger.Default.Errorf("zone %s updated by %s using key %s, cannot update serial : %s", zone, state.IP(), tsig.Hdr.Name, err)
+			}
+		}
+		h.InvalidateZone(zone)
+		if err != nil {
+			logger.Default.Errorf("update of zone %s from %s failed : %s", zone, state.IP(), err)
+			return h.updateResponse(state, dns.RcodeServerFailure)
+		}
+	}
+	return h.updateResponse(state, dns.RcodeSuccess)
+}
+
+func (h *DnsRequestHandler) updateResponse(state *request.Request, rcode int) int {
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, rcode)
+	signResponse(state, m)
+	state.W.WriteMsg(m)
+	return rcode
+}
+
+// checkPrerequisites checks prerequisite section of an update message (RFC 2136 section 3.2)
+func (h *DnsRequestHandler) checkPrerequisites(z *Zone, prereqs []dns.RR, records map[string]*Record) int {
+	var valueDependent []dns.RR
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(z.Name, name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			record := h.updateRecord(name, z, records)
+			if record == nil {
+				return dns.RcodeServerFailure
+			}
+			exists := false
+			for _, r := range h.updateRRs(record) {
+				if hdr.Rrtype == dns.TypeANY || r.Header().Rrtype == hdr.Rrtype {
+					exists = true
+					break
+				}
+			}
+			if hdr.Rrtype == dns.TypeANY && record.ANAME != nil {
+				exists = true
+			}
+			switch {
+			case hdr.Class == dns.ClassANY && !exists && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeNameError
+			case hdr.Class == dns.ClassANY && !exists:
+				return dns.RcodeNXRrset
+			case hdr.Class == dns.ClassNONE && exists && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeYXDomain
+			case hdr.Class == dns.ClassNONE && exists:
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			valueDependent = append(valueDependent, rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// value dependent prerequisites must match the whole rrset
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range valueDependent {
+		key := rrsetKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	for key, expected := range rrsets {
+		expected = dns.Dedup(expected, nil)
+		record := h.updateRecord(key.name, z, records)
+		if record == nil {
+			return dns.RcodeServerFailure
+		}
+		var current []dns.RR
+		for _, r := range h.updateRRs(record) {
+			if r.Header().Rrtype == key.rrtype {
+				current = append(current, r)
+			}
+		}
+		if len(current) != len(expected) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range expected {
+			if !containsRR(current, rr) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescanUpdate checks update section of an update message (RFC 2136 section 3.4.1)
+func prescanUpdate(z *Zone, updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(z.Name, strings.ToLower(hdr.Name)) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			case dns.TypeSOA:
+			default:
+				if !addRR(new(Record), rr) {
+					return dns.RcodeNotImplemented
+				}
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			switch hdr.Rrtype {
+			case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate applies a single update rr to record (RFC 2136 section 3.4.2), current is the list of record's RRs
+func applyUpdate(record *Record, rr dns.RR, current []dns.RR) bool {
+	hdr := rr.Header()
+	apex := record.Name == record.Zone.Name
+	switch hdr.Class {
+	case dns.ClassINET:
+		if hdr.Rrtype == dns.TypeSOA {
+			// serial and soa values are managed through zone config
+			return false
+		}
+		if containsRR(current, rr) {
+			return false
+		}
+		if hdr.Rrtype == dns.TypeCNAME {
+			for _, r := range current {
+				if r.Header().Rrtype != dns.TypeCNAME {
+					return false
+				}
+			}
+		} else if record.CNAME != nil {
+			return false
+		}
+		return addRR(record, rr)
+	case dns.ClassANY:
+		if hdr.Rrtype == dns.TypeANY {
+			changed := false
+			for _, r := range current {
+				rrtype := r.Header().Rrtype
+				if apex && (rrtype == dns.TypeSOA || rrtype == dns.TypeNS) {
+					continue
+				}
+				changed = removeRRSet(record, rrtype) || changed
+			}
+			return changed
+		}
+		if apex && (hdr.Rrtype == dns.TypeSOA || hdr.Rrtype == dns.TypeNS) {
+			return false
+		}
+		return removeRRSet(record, hdr.Rrtype)
+	case dns.ClassNONE:
+		if hdr.Rrtype == dns.TypeSOA {
+			return false
+		}
+		if apex && hdr.Rrtype == dns.TypeNS && len(record.NS.Data) <= 1 {
+			return false
+		}
+		if !containsRR(current, rr) {
+			return false
+		}
+		return removeRR(record, rr)
+	}
+	return false
+}
+
+// containsRR checks whether rrs contains rr, ignoring ttl and class
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if r.Header().Rrtype != rr.Header().Rrtype {
+			continue
+		}
+		c := dns.Copy(r)
+		c.Header().Class = rr.Header().Class
+		c.Header().Name = rr.Header().Name
+		if dns.IsDuplicate(c, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRRSet(record *Record, rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeA:
+		record.A.Data = nil
+	case dns.TypeAAAA:
+		record.AAAA.Data = nil
+	case dns.TypeCNAME:
+		record.CNAME = nil
+	case dns.TypeTXT:
+		record.TXT.Data = nil
+	case dns.TypeNS:
+		record.NS.Data = nil
+	case dns.TypeMX:
+		record.MX.Data = nil
+	case dns.TypeSRV:
+		record.SRV.Data = nil
+	case dns.TypeCAA:
+		record.CAA.Data = nil
+	case dns.TypePTR:
+		record.PTR = nil
+	case dns.TypeTLSA:
+		record.TLSA.Data = nil
+	case dns.TypeDNAME:
+		record.DNAME = nil
+	case dns.TypeSSHFP:
+		record.SSHFP.Data = nil
+	case dns.TypeNAPTR:
+		record.NAPTR.Data = nil
+	case dns.TypeDS:
+		record.DS.Data = nil
+	case dns.TypeHINFO:
+		record.HINFO.Data = nil
+	case dns.TypeLOC:
+		record.LOC.Data = nil
+	case dns.TypeURI:
+		record.URI.Data = nil
+	case dns.TypeSVCB:
+		record.SVCB.Data = nil
+	case dns.TypeHTTPS:
+		record.HTTPS.Data = nil
+	default:
+		return false
+	}
+	return true
+}
+
+func removeRR(record *Record, rr dns.RR) bool {
+	switch r := rr.(type) {
+	case *dns.A:
+		var ips []IP_RR
+		for _, ip := range record.A.Data {
+			if !ip.Ip.Equal(r.A) {
+				ips = append(ips, ip)
+			}
+		}
+		record.A.Data = ips
+	case *dns.AAAA:
+		var ips []IP_RR
+		for _, ip := range record.AAAA.Data {
+			if !ip.Ip.Equal(r.AAAA) {
+				ips = append(ips, ip)
+			}
+		}
+		record.AAAA.Data = ips
+	case *dns.CNAME:
+		record.CNAME = nil
+	case *dns.DNAME:
+		record.DNAME = nil
+	case *dns.TXT:
+		var txts []TXT_RR
+		for _, txt := range record.TXT.Data {
+			if txt.Text != strings.Join(r.Txt, "") {
+				txts = append(txts, txt)
+			}
+		}
+		record.TXT.Data = txts
+	case *dns.NS:
+		var nss []NS_RR
+		for _, ns := range record.NS.Data {
+			if !strings.EqualFold(ns.Host, r.Ns) {
+				nss = append(nss, ns)
+			}
+		}
+		record.NS.Data = nss
+	case *dns.MX:
+		var mxs []MX_RR
+		for _, mx := range record.MX.Data {
+			if !strings.EqualFold(mx.Host, r.Mx) || mx.Preference != r.Preference {
+				mxs = append(mxs, mx)
+			}
+		}
+		record.MX.Data = mxs
+	case *dns.SRV:
+		var srvs []SRV_RR
+		for _, srv := range record.SRV.Data {
+			if !strings.EqualFold(srv.Target, r.Target) || srv.Priority != r.Priority || srv.Weight != r.Weight || srv.Port != r.Port {
+				srvs = append(srvs, srv)
+			}
+		}
+		record.SRV.Data = srvs
+	case *dns.CAA:
+		var caas []CAA_RR
+		for _, caa := range record.CAA.Data {
+			if caa.Tag != r.Tag || caa.Value != r.Value || caa.Flag != r.Flag {
+				caas = append(caas, caa)
+			}
+		}
+		record.CAA.Data = caas
+	case *dns.PTR:
+		record.PTR = nil
+	case *dns.TLSA:
+		var tlsas []TLSA_RR
+		for _, tlsa := range record.TLSA.Data {
+			if tlsa.Usage != r.Usage || tlsa.Selector != r.Selector || tlsa.MatchingType != r.MatchingType || !strings.EqualFold(tlsa.Certificate, r.Certificate) {
+				tlsas = append(tlsas, tlsa)
+			}
+		}
+		record.TLSA.Data = tlsas
+	case *dns.SSHFP:
+		var sshfps []SSHFP_RR
+		for _, sshfp := range record.SSHFP.Data {
+			if sshfp.Algorithm != r.Algorithm || sshfp.Type != r.Type || !strings.EqualFold(sshfp.Fingerprint, r.FingerPrint) {
+				sshfps = append(sshfps, sshfp)
+			}
+		}
+		record.SSHFP.Data = sshfps
+	case *dns.NAPTR:
+		var naptrs []NAPTR_RR
+		for _, naptr := range record.NAPTR.Data {
+			if naptr.Order != r.Order || naptr.Preference != r.Preference || naptr.Flags != r.Flags || naptr.Service != r.Service ||
+				naptr.Regexp != r.Regexp || !strings.EqualFold(dns.Fqdn(naptr.Replacement), r.Replacement) {
+				naptrs = append(naptrs, naptr)
+			}
+		}
+		record.NAPTR.Data = naptrs
+	case *dns.DS:
+		var dss []DS_RR
+		for _, ds := range record.DS.Data {
+			if ds.KeyTag != r.KeyTag || ds.Algorithm != r.Algorithm || ds.DigestType != r.DigestType || !strings.EqualFold(ds.Digest, r.Digest) {
+				dss = append(dss, ds)
+			}
+		}
+		record.DS.Data = dss
+	case *dns.HINFO:
+		var hinfos []HINFO_RR
+		for _, hinfo := range record.HINFO.Data {
+			if hinfo.Cpu != r.Cpu || hinfo.Os != r.Os {
+				hinfos = append(hinfos, hinfo)
+			}
+		}
+		record.HINFO.Data = hinfos
+	case *dns.LOC:
+		var locs []LOC_RR
+		for _, loc := range record.LOC.Data {
+			l := locRR(loc)
+			if l.Latitude != r.Latitude || l.Longitude != r.Longitude || l.Altitude != r.Altitude || l.Size != r.Size || l.HorizPre != r.HorizPre || l.VertPre != r.VertPre {
+				locs = append(locs, loc)
+			}
+		}
+		record.LOC.Data = locs
+	case *dns.URI:
+		var uris []URI_RR
+		for _, uri := range record.URI.Data {
+			if uri.Priority != r.Priority || uri.Weight != r.Weight || uri.Target != r.Target {
+				uris = append(uris, uri)
+			}
+		}
+		record.URI.Data = uris
+	case *dns.SVCB:
+		record.SVCB.Data = removeSVCB(record.SVCB.Data, r)
+	case *dns.HTTPS:
+		record.HTTPS.Data = removeSVCB(record.HTTPS.Data, &r.SVCB)
+	default:
+		return false
+	}
+	return true
+}
+
+func removeSVCB(data []SVCB_RR, r *dns.SVCB) []SVCB_RR {
+	var res []SVCB_RR
+	for _, rr := range data {
+		svcb, err := svcbRR(rr)
+		if err != nil {
+			res = append(res, rr)
+			continue
+		}
+		svcb.Hdr = r.Hdr
+		if !dns.IsDuplicate(svcb, r) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+// updateRecord loads record of name directly from zone store, records keeps changes not yet written
+func (h *DnsRequestHandler) updateRecord(name string, z *Zone, records map[string]*Record) *Record {
+	if record, ok := records[name]; ok {
+		return record
+	}
+	location := z.Name
+	if name != z.Name {
+		location = zoneLabel(name, z)
+	}
+	record := h.LoadLocation(location, z)
+	if record != nil {
+		records[name] = record
+	}
+	return record
+}
+
+// updateRRs returns current RRs of record as seen by an update
+func (h *DnsRequestHandler) updateRRs(record *Record) []dns.RR {
+	rrs := h.locationRRs(record)
+	if record.Name == record.Zone.Name {
+		rrs = append(rrs, record.Zone.Config.SOA.Data)
+	}
+	return rrs
+}
+
+func zoneLabel(name string, z *Zone) string {
+	if name == z.Name {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+z.Name)
+}
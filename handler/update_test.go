@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"arvancloud/redins/test"
+	"github.com/coredns/coredns/request"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var updateZone = "update.zon."
+
+var updateConfig = `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.update.zon.","ns":"ns1.update.zon.","refresh":44,"retry":55,"expire":66,"serial":100},"update":{"keys":["update.key."]}}`
+
+var updateEntries = [][]string{
+	{"@",
+		`{"ns":{"ttl":300, "records":[{"host":"ns1.update.zon."}]}}`,
+	},
+	{"www",
+		`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"},{"ip":"2.2.2.2"}]},"txt":{"ttl":300, "records":[{"text":"foo"}]}}`,
+	},
+}
+
+// tsigFailResponseWriter reports a tsig verification failure
+type tsigFailResponseWriter struct {
+	test.ResponseWriter
+}
+
+func (w *tsigFailResponseWriter) TsigStatus() error {
+	return dns.ErrSig
+}
+
+func newUpdate(key string, prereqs []dns.RR, updates []string, remove bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(updateZone)
+	m.Answer = prereqs
+	var rrs []dns.RR
+	for _, u := range updates {
+		rr, _ := dns.NewRR(u)
+		rrs = append(rrs, rr)
+	}
+	if remove {
+		m.Remove(rrs)
+	} else {
+		m.Insert(rrs)
+	}
+	if key != "" {
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+	return m
+}
+
+func TestUpdate(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	h := NewHandler(&handlerTestConfig)
+	h.testRedis().Del("*")
+	h.testRedis().SAdd("redins:zones", updateZone)
+	for _, cmd := range updateEntries {
+		h.testRedis().HSet("redins:zones:"+updateZone, cmd[0], cmd[1])
+	}
+	h.testRedis().Set("redins:zones:"+updateZone+":config", updateConfig)
+	h.LoadZones()
+
+	update := func(m *dns.Msg, w dns.ResponseWriter) int {
+		rec := test.NewRecorder(w)
+		state := request.Request{W: rec, Req: m}
+		h.HandleRequest(&state)
+		return rec.Msg.Rcode
+	}
+	query := func(tc test.Case) {
+		r := tc.Msg()
+		w := test.NewRecorder(&test.ResponseWriter{})
+		state := request.Request{W: w, Req: r}
+		h.HandleRequest(&state)
+		if err := test.SortAndCheck(w.Msg, tc); err != nil {
+			fmt.Println(tc.Qname, err, tc.Answer, w.Msg.Answer)
+			t.Fail()
+		}
+	}
+
+	// add records to a new name
+	m := newUpdate("update.key.", nil, []string{"new.update.zon. 300 IN A 3.3.3.3", "new.update.zon. 300 IN A 4.4.4.4"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeSuccess {
+		fmt.Println("add failed : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	query(test.Case{
+		Qname: "new.update.zon.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("new.update.zon. 300 IN A 3.3.3.3"),
+			test.A("new.update.zon. 300 IN A 4.4.4.4"),
+		},
+	})
+
+	// remove a single record, prerequisite on existing rrset
+	m = newUpdate("update.key.", []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.update.zon.", Rrtype: dns.TypeTXT, Class: dns.ClassANY}}}, []string{"www.update.zon. 300 IN A 1.1.1.1"}, true)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeSuccess {
+		fmt.Println("remove failed : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	query(test.Case{
+		Qname: "www.update.zon.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("www.update.zon. 300 IN A 2.2.2.2"),
+		},
+	})
+
+	// delete all records of a name
+	m = newUpdate("update.key.", nil, nil, false)
+	m.RemoveName([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "new.update.zon."}}})
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeSuccess {
+		fmt.Println("delete failed : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	query(test.Case{
+		Qname: "new.update.zon.", Qtype: dns.TypeA,
+		Rcode: dns.RcodeNameError,
+		Ns: []dns.RR{
+			test.SOA("update.zon. 300 IN SOA ns1.update.zon. hostmaster.update.zon. 103 44 55 66 100"),
+		},
+	})
+
+	// failed prerequisites
+	m = newUpdate("update.key.", []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.update.zon.", Rrtype: dns.TypeANY, Class: dns.ClassNONE}}}, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeYXDomain {
+		fmt.Println("expected yxdomain : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	m = newUpdate("update.key.", []dns.RR{test.A("www.update.zon. 0 IN A 1.1.1.1")}, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeNXRrset {
+		fmt.Println("expected nxrrset : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	m = newUpdate("update.key.", nil, []string{"www.other.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeNotZone {
+		fmt.Println("expected notzone : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+
+	// unsigned, unknown key and bad signature
+	m = newUpdate("", nil, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeRefused {
+		fmt.Println("unsigned update : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	m = newUpdate("other.key.", nil, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &test.ResponseWriter{}); res != dns.RcodeRefused {
+		fmt.Println("unknown key : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	m = newUpdate("update.key.", nil, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m, &tsigFailResponseWriter{}); res != dns.RcodeNotAuth {
+		fmt.Println("bad signature : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	query(test.Case{
+		Qname: "www.update.zon.", Qtype: dns.TypeA,
+		Answer: []dns.RR{
+			test.A("www.update.zon. 300 IN A 2.2.2.2"),
+		},
+	})
+
+	val, _ := h.testRedis().Get("redins:zones:" + updateZone + ":config")
+	config := ZoneConfig{}
+	json.Unmarshal([]byte(val), &config)
+	if config.SOA.Serial != 103 {
+		fmt.Println("unexpected serial : ", config.SOA.Serial)
+		t.Fail()
+	}
+}
+
+// readOnlyStore fails location writes
+type readOnlyStore struct {
+	*MemoryStore
+}
+
+func (s *readOnlyStore) UpdateLocations(zone string, locations map[string]string) error {
+	return errors.New("read only store")
+}
+
+func TestUpdateStore(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(updateZone, updateConfig)
+	for _, cmd := range updateEntries {
+		store.SetLocation(updateZone, cmd[0], cmd[1])
+	}
+	store.AddZone(updateZone)
+	time.Sleep(time.Millisecond * 100)
+
+	// another instance sharing the same store
+	other := NewHandler(&config)
+	other.Store = store
+	other.LoadZones()
+
+	update := func(m *dns.Msg) int {
+		rec := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(&request.Request{W: rec, Req: m})
+		return rec.Msg.Rcode
+	}
+	serial := func() uint32 {
+		val, _ := store.GetZoneConfig(updateZone)
+		config := ZoneConfig{}
+		json.Unmarshal([]byte(val), &config)
+		return config.SOA.Serial
+	}
+
+	// concurrent updates of the same name from both instances are all applied
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := newUpdate("update.key.", nil, []string{fmt.Sprintf("c.update.zon. 300 IN A 10.0.0.%d", i)}, false)
+			handler := h
+			if i%2 == 1 {
+				handler = other
+			}
+			rec := test.NewRecorder(&test.ResponseWriter{})
+			handler.HandleRequest(&request.Request{W: rec, Req: m})
+			if res := rec.Msg.Rcode; res != dns.RcodeSuccess {
+				fmt.Println("update failed : ", dns.RcodeToString[res])
+				t.Fail()
+			}
+		}(i)
+	}
+	wg.Wait()
+	tc := test.Case{Qname: "c.update.zon.", Qtype: dns.TypeA}
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(&request.Request{W: w, Req: tc.Msg()})
+	if len(w.Msg.Answer) != 20 {
+		fmt.Println("updates lost : ", w.Msg.Answer)
+		t.Fail()
+	}
+	if s := serial(); s != 120 {
+		fmt.Println("unexpected serial : ", s)
+		t.Fail()
+	}
+
+	// zone locked by another instance for too long
+	unlock, _ := store.LockZone(updateZone, time.Minute)
+	if res := update(newUpdate("update.key.", nil, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)); res != dns.RcodeServerFailure {
+		fmt.Println("expected servfail for locked zone : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	unlock()
+
+	// failed writes are reported and don't change serial
+	h.Store = &readOnlyStore{store}
+	m := newUpdate("update.key.", nil, []string{"www.update.zon. 300 IN A 5.5.5.5"}, false)
+	if res := update(m); res != dns.RcodeServerFailure {
+		fmt.Println("expected servfail : ", dns.RcodeToString[res])
+		t.Fail()
+	}
+	if s := serial(); s != 120 {
+		fmt.Println("unexpected serial : ", s)
+		t.Fail()
+	}
+}
+
+func TestUpdateNotify(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	received := make(chan *dns.Msg, 10)
+	secondary := &dns.Server{Addr: "127.0.0.1:10565", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go secondary.ListenAndServe()
+	defer secondary.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	config := handlerTestConfig
+	config.Store = StoreConfig{Backend: "memory"}
+	h := NewHandler(&config)
+	store := h.Store.(*MemoryStore)
+	store.SetZoneConfig(updateZone, `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.update.zon.","ns":"ns1.update.zon.","refresh":44,"retry":55,"expire":66,"serial":100},"update":{"keys":["update.key."]},"notify":{"targets":["127.0.0.1:10565"]}}`)
+	for _, cmd := range updateEntries {
+		store.SetLocation(updateZone, cmd[0], cmd[1])
+	}
+	store.AddZone(updateZone)
+	time.Sleep(time.Millisecond * 100)
+
+	// serial is bumped once by update and notified as is
+	rec := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(&request.Request{W: rec, Req: newUpdate("update.key.", nil, []string{"new.update.zon. 300 IN A 3.3.3.3"}, false)})
+	if rec.Msg.Rcode != dns.RcodeSuccess {
+		fmt.Println("update failed : ", dns.RcodeToString[rec.Msg.Rcode])
+		t.Fail()
+	}
+	select {
+	case m := <-received:
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 101 {
+			fmt.Println("unexpected serial : ", m.Answer)
+			t.Fail()
+		}
+	case <-time.After(3 * time.Second):
+		fmt.Println("notify not received")
+		t.Fail()
+	}
+	val, _ := store.GetZoneConfig(updateZone)
+	zoneConfig := ZoneConfig{}
+	json.Unmarshal([]byte(val), &zoneConfig)
+	if zoneConfig.SOA.Serial != 101 {
+		fmt.Println("unexpected config : ", val)
+		t.Fail()
+	}
+}
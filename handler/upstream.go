@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hawell/logger"
@@ -64,8 +66,12 @@ func (u *Upstream) Query(location string, qtype uint16) ([]dns.RR, int) {
 			logger.Default.Errorf("failed to retrieve record %s from upstream %s : %s", location, c.connectionStr, err)
 			continue
 		}
+		if r.Rcode != dns.RcodeSuccess {
+			return []dns.RR{}, r.Rcode
+		}
+		// no data
 		if len(r.Answer) == 0 {
-			return []dns.RR{}, dns.RcodeNameError
+			return []dns.RR{}, dns.RcodeSuccess
 		}
 		minTtl := r.Answer[0].Header().Ttl
 		for _, record := range r.Answer {
@@ -73,7 +79,10 @@ func (u *Upstream) Query(location string, qtype uint16) ([]dns.RR, int) {
 				minTtl = record.Header().Ttl
 			}
 		}
-		u.cache.Set(key, r.Answer, time.Duration(minTtl)*time.Second)
+		// zero expiration means default expiration for cache
+		if minTtl > 0 {
+			u.cache.Set(key, r.Answer, time.Duration(minTtl)*time.Second)
+		}
 		u.connections[0], c = c, u.connections[0]
 
 		return r.Answer, dns.RcodeSuccess
@@ -81,6 +90,97 @@ func (u *Upstream) Query(location string, qtype uint16) ([]dns.RR, int) {
 	return []dns.RR{}, dns.RcodeServerFailure
 }
 
+// resolveResult is a cached cname chain resolution, empty records with success rcode means no data
+type resolveResult struct {
+	records []dns.RR
+	rcode   int
+}
+
+// Resolve follows cname chain of location and returns qtype records at its end, ttl of records is the minimum ttl along the chain,
+// no data is returned as success without records
+func (u *Upstream) Resolve(location string, qtype uint16) ([]dns.RR, int) {
+	key := "resolve:" + location + ":" + strconv.Itoa(int(qtype))
+	if res, exp, found := u.cache.GetWithExpiration(key); found {
+		result := res.(*resolveResult)
+		return copyWithTtl(result.records, uint32(time.Until(exp).Seconds())), result.rcode
+	}
+	name := location
+	minTtl := uint32(math.MaxUint32)
+	rrs, res := u.Query(name, qtype)
+	for count := 0; count < maxUpstreamChain; count++ {
+		if res == dns.RcodeNameError {
+			u.setResult(key, []dns.RR{}, res, negativeTtl(minTtl))
+			return []dns.RR{}, res
+		}
+		if res != dns.RcodeSuccess {
+			return []dns.RR{}, res
+		}
+		var records []dns.RR
+		target := ""
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				records = append(records, rr)
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+			if rr.Header().Ttl < minTtl {
+				minTtl = rr.Header().Ttl
+			}
+		}
+		if len(records) > 0 {
+			records = copyWithTtl(records, minTtl)
+			u.setResult(key, records, dns.RcodeSuccess, minTtl)
+			return copyWithTtl(records, minTtl), dns.RcodeSuccess
+		}
+		if target == "" {
+			u.setResult(key, []dns.RR{}, dns.RcodeSuccess, negativeTtl(minTtl))
+			return []dns.RR{}, dns.RcodeSuccess
+		}
+		name = target
+		// recursive upstreams return the whole chain in one answer
+		found := false
+		for _, rr := range rrs {
+			found = found || strings.EqualFold(rr.Header().Name, name)
+		}
+		if !found {
+			rrs, res = u.Query(name, qtype)
+		}
+	}
+	logger.Default.Errorf("cname chain of %s is too long", location)
+	return []dns.RR{}, dns.RcodeServerFailure
+}
+
+// setResult caches result of a resolution, zero ttl results are not cached
+func (u *Upstream) setResult(key string, records []dns.RR, rcode int, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	u.cache.Set(key, &resolveResult{records: records, rcode: rcode}, time.Duration(ttl)*time.Second)
+}
+
+// negativeTtl limits caching of negative answers to a short time
+func negativeTtl(ttl uint32) uint32 {
+	if ttl > negativeCacheTtl {
+		return negativeCacheTtl
+	}
+	return ttl
+}
+
+func copyWithTtl(rrs []dns.RR, ttl uint32) []dns.RR {
+	res := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		res = append(res, rr)
+	}
+	return res
+}
+
 const (
-	defaultCacheTtl = 600
+	defaultCacheTtl  = 600
+	negativeCacheTtl = 30
+	maxUpstreamChain = 10
 )
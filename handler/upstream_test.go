@@ -1,8 +1,11 @@
 package handler
 
 import (
+	"fmt"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	"arvancloud/redins/test"
 	"github.com/coredns/coredns/request"
@@ -82,3 +85,60 @@ func TestFallback(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestResolve(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	queries := make(map[string]int)
+	var lock sync.Mutex
+	records := map[string][]string{
+		"zero.example.org.":  {"zero.example.org. 0 IN A 1.1.1.1"},
+		"alias.example.org.": {"alias.example.org. 60 IN CNAME nodata.example.org."},
+	}
+	upstream := &dns.Server{Addr: "127.0.0.1:10564", Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		lock.Lock()
+		queries[r.Question[0].Name]++
+		lock.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "nx.example.org." {
+			m.Rcode = dns.RcodeNameError
+		}
+		for _, s := range records[r.Question[0].Name] {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ListenAndServe()
+	defer upstream.Shutdown()
+	time.Sleep(time.Millisecond * 200)
+
+	u := NewUpstream([]UpstreamConfig{{Ip: "127.0.0.1", Port: 10564, Protocol: "udp", Timeout: 1000}})
+	for i := 0; i < 2; i++ {
+		if rrs, res := u.Resolve("nodata.example.org.", dns.TypeA); res != dns.RcodeSuccess || len(rrs) != 0 {
+			fmt.Println("expected nodata : ", dns.RcodeToString[res], rrs)
+			t.Fail()
+		}
+		if rrs, res := u.Resolve("alias.example.org.", dns.TypeA); res != dns.RcodeSuccess || len(rrs) != 0 {
+			fmt.Println("expected nodata through cname : ", dns.RcodeToString[res], rrs)
+			t.Fail()
+		}
+		if _, res := u.Resolve("nx.example.org.", dns.TypeA); res != dns.RcodeNameError {
+			fmt.Println("expected nxdomain : ", dns.RcodeToString[res])
+			t.Fail()
+		}
+		if rrs, res := u.Resolve("zero.example.org.", dns.TypeA); res != dns.RcodeSuccess || len(rrs) != 1 {
+			fmt.Println("unexpected zero ttl answer : ", dns.RcodeToString[res], rrs)
+			t.Fail()
+		}
+	}
+
+	// negative answers are cached, zero ttl answers are not, nodata name is queried directly and through alias
+	lock.Lock()
+	defer lock.Unlock()
+	if queries["nodata.example.org."] != 2 || queries["alias.example.org."] != 1 || queries["nx.example.org."] != 1 || queries["zero.example.org."] != 2 {
+		fmt.Println("unexpected upstream queries : ", queries)
+		t.Fail()
+	}
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+// ImportZone parses a master file (RFC 1035) and replaces zone data in store, other zone config values are kept
+func ImportZone(store ZoneStore, zone string, r io.Reader, path string) error {
+	zone = dns.CanonicalName(zone)
+	zp := dns.NewZoneParser(r, zone, path)
+	zp.SetIncludeAllowed(true)
+	var rrs []dns.RR
+	var soa *dns.SOA
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zone, name) {
+			return errors.Errorf("%s is out of zone %s", rr.Header().Name, zone)
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			if name != zone {
+				return errors.Errorf("SOA record is not at zone apex : %s", rr.String())
+			}
+			soa = rr.(*dns.SOA)
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeDNSKEY:
+			// zones are signed on the fly
+		default:
+			rrs = append(rrs, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return errors.Wrapf(err, "cannot parse zone file %s", path)
+	}
+	if soa == nil {
+		return errors.Errorf("no SOA record in zone file %s", path)
+	}
+	records, skipped := zoneRecords(zone, rrs)
+	if len(skipped) > 0 {
+		return errors.Errorf("unsupported record : %s", skipped[0].String())
+	}
+	return saveZone(store, zone, soa, records)
+}
+
+// ExportZone writes zone data from store in master file format
+func ExportZone(store ZoneStore, zone string, w io.Writer) error {
+	zone = dns.CanonicalName(zone)
+	zones, err := store.GetZones()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, z := range zones {
+		found = found || z == zone
+	}
+	if !found {
+		return errors.Errorf("zone %s not found", zone)
+	}
+
+	// handler without ttl limit, only used to convert records
+	h := &DnsRequestHandler{
+		Config:     &HandlerConfig{},
+		Store:      store,
+		ZoneCache:  cache.New(time.Minute, time.Minute),
+		signatures: NewSignatureCache(),
+	}
+	z := h.LoadZone(zone)
+
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n%s\n", zone, z.Config.SOA.Data.String()); err != nil {
+		return err
+	}
+	for _, rr := range h.zoneRRs(z) {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	// ANAME has no standard presentation format
+	var labels []string
+	for label := range z.Locations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		location := label
+		if label == "@" {
+			location = zone
+		}
+		record := h.LoadLocation(location, z)
+		if record != nil && record.ANAME != nil {
+			for _, target := range record.ANAME.targets() {
+				if _, err := fmt.Fprintf(w, "; %s ANAME %s\n", record.Name, target.Location); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// zoneRecords converts rrs into json storage format grouped by label, rrs not supported are returned as skipped
+func zoneRecords(zone string, rrs []dns.RR) (map[string]*Record, []dns.RR) {
+	records := make(map[string]*Record)
+	var skipped []dns.RR
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		label := "@"
+		if name != zone {
+			label = strings.TrimSuffix(name, "."+zone)
+		}
+		record, ok := records[label]
+		if !ok {
+			record = new(Record)
+			records[label] = record
+		}
+		if !addRR(record, rr) {
+			skipped = append(skipped, rr)
+		}
+	}
+	return records, skipped
+}
+
+// saveZone replaces zone soa and locations in store
+func saveZone(store ZoneStore, zone string, soa *dns.SOA, records map[string]*Record) error {
+	config := ZoneConfig{}
+	if val, _ := store.GetZoneConfig(zone); len(val) > 0 {
+		if err := json.Unmarshal([]byte(val), &config); err != nil {
+			return errors.Wrap(err, "cannot parse zone config")
+		}
+	}
+	config.SOA = &SOA_RRSet{
+		Ns:      soa.Ns,
+		MBox:    soa.Mbox,
+		Ttl:     soa.Hdr.Ttl,
+		Refresh: soa.Refresh,
+		Retry:   soa.Retry,
+		Expire:  soa.Expire,
+		MinTtl:  soa.Minttl,
+		Serial:  soa.Serial,
+	}
+	configValue, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	locations := make(map[string]string)
+	for label, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		locations[label] = string(value)
+	}
+	if err := store.SetLocations(zone, locations); err != nil {
+		return err
+	}
+	if err := store.SetZoneConfig(zone, string(configValue)); err != nil {
+		return err
+	}
+	return store.AddZone(zone)
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+var importZone = "import.zon."
+
+var importZoneFile = `$ORIGIN import.zon.
+$TTL 600
+@	IN	SOA	ns1 hostmaster 100 44 55 66 100
+@	IN	NS	ns1
+@	IN	NS	ns2.other.zon.
+@	300	IN	MX	10 mail
+ns1	IN	A	1.1.1.1
+www	IN	A	1.2.3.4
+www	IN	A	1.2.3.5
+www	IN	AAAA	::1
+www	IN	SSHFP	1 1 DC9BBA5AD5E1CBE30F23A5B3B5A4AD13E7B6F6B1
+www	IN	LOC	35 41 24.000 N 51 25 18.000 E 1200m 20m 100m 5m
+@	IN	HTTPS	1 . alpn=h2,h3 ipv4hint=1.2.3.4
+@	IN	NAPTR	100 10 "S" "SIP+D2U" "" _sip._udp.import.zon.
+$INCLUDE %s sub.import.zon.
+`
+
+var importIncludeFile = `$TTL 100
+@	IN	TXT	"included"
+alias	IN	CNAME	www.import.zon.
+`
+
+func TestZoneFile(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{})
+
+	dir, _ := ioutil.TempDir("", "redins")
+	defer os.RemoveAll(dir)
+	includePath := filepath.Join(dir, "include.zone")
+	ioutil.WriteFile(includePath, []byte(importIncludeFile), 0600)
+	zonePath := filepath.Join(dir, "import.zone")
+	ioutil.WriteFile(zonePath, []byte(fmt.Sprintf(importZoneFile, includePath)), 0600)
+
+	store := NewMemoryStore()
+	store.SetZoneConfig(importZone, `{"transfer":{"allow":["127.0.0.1"]}}`)
+	f, _ := os.Open(zonePath)
+	defer f.Close()
+	if err := ImportZone(store, importZone, f, zonePath); err != nil {
+		fmt.Println("import failed : ", err)
+		t.FailNow()
+	}
+
+	if zones, _ := store.GetZones(); len(zones) != 1 || zones[0] != importZone {
+		fmt.Println("unexpected zones : ", zones)
+		t.Fail()
+	}
+	if labels, _ := store.GetLocations(importZone); strings.Join(labels, ",") != "@,alias.sub,ns1,sub,www" {
+		fmt.Println("unexpected locations : ", labels)
+		t.Fail()
+	}
+	config := ZoneConfig{}
+	val, _ := store.GetZoneConfig(importZone)
+	json.Unmarshal([]byte(val), &config)
+	if config.SOA == nil || config.SOA.Serial != 100 || config.SOA.Ns != "ns1.import.zon." || config.SOA.Ttl != 600 || len(config.Transfer.Allow) != 1 {
+		fmt.Println("unexpected config : ", val)
+		t.Fail()
+	}
+	record := new(Record)
+	val, _ = store.GetLocation(importZone, "www")
+	json.Unmarshal([]byte(val), record)
+	if len(record.A.Data) != 2 || record.A.Ttl != 600 || len(record.AAAA.Data) != 1 {
+		fmt.Println("unexpected record : ", val)
+		t.Fail()
+	}
+
+	// exported zone contains the same records
+	buf := new(bytes.Buffer)
+	if err := ExportZone(store, importZone, buf); err != nil {
+		fmt.Println("export failed : ", err)
+		t.FailNow()
+	}
+	parse := func(s string, origin string) []dns.RR {
+		var rrs []dns.RR
+		zp := dns.NewZoneParser(strings.NewReader(s), origin, "")
+		zp.SetIncludeAllowed(true)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			rrs = append(rrs, rr)
+		}
+		if zp.Err() != nil {
+			fmt.Println("cannot parse : ", zp.Err())
+			t.Fail()
+		}
+		return rrs
+	}
+	exported := parse(buf.String(), importZone)
+	original := parse(fmt.Sprintf(importZoneFile, includePath), importZone)
+	if len(exported) != len(original) {
+		fmt.Println("unexpected export : ", buf.String())
+		t.Fail()
+	}
+	for _, rr := range original {
+		if !containsRR(exported, rr) {
+			fmt.Println("missing record in export : ", rr)
+			t.Fail()
+		}
+	}
+
+	invalid := []string{
+		"www IN A 1.2.3.4\n",
+		"@ IN SOA ns1 hostmaster 100 44 55 66 100\nwww.other.zon. IN A 1.2.3.4\n",
+		"@ IN SOA ns1 hostmaster 100 44 55 66 100\nwww IN A 1.2.3.256\n",
+	}
+	for i, zone := range invalid {
+		if err := ImportZone(NewMemoryStore(), importZone, strings.NewReader(zone), ""); err == nil {
+			fmt.Println(i, "invalid zone file imported")
+			t.Fail()
+		}
+	}
+	if err := ExportZone(store, "missing.zon.", buf); err == nil {
+		fmt.Println("missing zone exported")
+		t.Fail()
+	}
+}
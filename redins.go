@@ -17,7 +17,7 @@ import (
 )
 
 var (
-	s []dns.Server
+	s []handler.Server
 	h *handler.DnsRequestHandler
 	l *handler.RateLimiter
 )
@@ -173,10 +173,14 @@ func Start() {
 
 	logger.Default = logger.NewLogger(&cfg.ErrorLog)
 
-	s = handler.NewServer(cfg.Server)
-
 	h = handler.NewHandler(&cfg.Handler)
 
+	var err error
+	s, err = handler.NewServer(cfg.Server, h.TsigProvider())
+	if err != nil {
+		log.Fatalf("[ERROR] cannot start server : %s", err)
+	}
+
 	l = handler.NewRateLimiter(&cfg.RateLimit)
 
 	dns.HandleFunc(".", handleRequest)
@@ -195,6 +199,9 @@ func Stop() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "zone" {
+		os.Exit(zoneCommand(os.Args[2:]))
+	}
 
 	Start()
 
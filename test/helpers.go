@@ -105,6 +105,24 @@ func CAA(rr string) *dns.CAA { r, _ := dns.NewRR(rr); return r.(*dns.CAA) }
 // TLSA returns a TLSA record from rr. It panics on errors.
 func TLSA(rr string) *dns.TLSA { r, _ := dns.NewRR(rr); return r.(*dns.TLSA) }
 
+// SSHFP returns a SSHFP record from rr. It panics on errors.
+func SSHFP(rr string) *dns.SSHFP { r, _ := dns.NewRR(rr); return r.(*dns.SSHFP) }
+
+// NAPTR returns a NAPTR record from rr. It panics on errors.
+func NAPTR(rr string) *dns.NAPTR { r, _ := dns.NewRR(rr); return r.(*dns.NAPTR) }
+
+// LOC returns a LOC record from rr. It panics on errors.
+func LOC(rr string) *dns.LOC { r, _ := dns.NewRR(rr); return r.(*dns.LOC) }
+
+// URI returns a URI record from rr. It panics on errors.
+func URI(rr string) *dns.URI { r, _ := dns.NewRR(rr); return r.(*dns.URI) }
+
+// SVCB returns a SVCB record from rr. It panics on errors.
+func SVCB(rr string) *dns.SVCB { r, _ := dns.NewRR(rr); return r.(*dns.SVCB) }
+
+// HTTPS returns a HTTPS record from rr. It panics on errors.
+func HTTPS(rr string) *dns.HTTPS { r, _ := dns.NewRR(rr); return r.(*dns.HTTPS) }
+
 // OPT returns an OPT record with UDP buffer size set to bufsize and the DO bit set to do.
 func OPT(bufsize int, do bool) *dns.OPT {
 	o := new(dns.OPT)
@@ -191,7 +209,9 @@ func Section(tc Case, sec sect, rr []dns.RR) error {
 			if x.NextDomain != section[i].(*dns.NSEC).NextDomain {
 				return fmt.Errorf("RR %d should have a NextDomain of %s, but has %s", i, section[i].(*dns.NSEC).NextDomain, x.NextDomain)
 			}
-			// TypeBitMap
+			if fmt.Sprint(x.TypeBitMap) != fmt.Sprint(section[i].(*dns.NSEC).TypeBitMap) {
+				return fmt.Errorf("RR %d should have a TypeBitMap of %v, but has %v", i, section[i].(*dns.NSEC).TypeBitMap, x.TypeBitMap)
+			}
 		case *dns.A:
 			if x.A.String() != section[i].(*dns.A).A.String() {
 				return fmt.Errorf("RR %d should have a Address of %q, but has %q", i, section[i].(*dns.A).A.String(), x.A.String())
@@ -274,6 +294,10 @@ func Section(tc Case, sec sect, rr []dns.RR) error {
 			if x.Certificate != tt.Certificate {
 				return fmt.Errorf("TLSA Certificate should be %s, but is %s", tt.Certificate, x.Certificate)
 			}
+		case *dns.DNAME, *dns.SSHFP, *dns.NAPTR, *dns.DS, *dns.LOC, *dns.URI, *dns.SVCB, *dns.HTTPS:
+			if !dns.IsDuplicate(x, section[i]) {
+				return fmt.Errorf("RR %d should be %q, but is %q", i, section[i].String(), x.String())
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"arvancloud/redins/handler"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+const zoneUsage = `usage:
+  redins zone import [-config config.json] <zone> <file>
+  redins zone export [-config config.json] [-o file] <zone>
+  redins zone ds [-config config.json] [-digest sha256|sha384] <zone>
+`
+
+// zoneCommand imports master files into zone store, exports zones from it and prints zone DS records
+func zoneCommand(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, zoneUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("zone "+args[0], flag.ContinueOnError)
+	configFile := flags.String("config", "config.json", "config file")
+	output := flags.String("o", "", "output file, default: stdout")
+	digest := flags.String("digest", "sha256", "DS digest type, sha256 or sha384")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg := LoadConfig(*configFile)
+	logger.Default = logger.NewLogger(&cfg.ErrorLog)
+	store, err := handler.NewZoneStore(&cfg.Handler.Store, &cfg.Handler.Redis)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot create zone store : %s\n", err)
+		return 1
+	}
+	defer store.ShutDown()
+
+	switch {
+	case args[0] == "import" && flags.NArg() == 2:
+		zone, path := flags.Arg(0), flags.Arg(1)
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot open %s : %s\n", path, err)
+			return 1
+		}
+		defer f.Close()
+		if err := handler.ImportZone(store, zone, f, path); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot import zone %s : %s\n", zone, err)
+			return 1
+		}
+	case args[0] == "export" && flags.NArg() == 1:
+		zone := flags.Arg(0)
+		var w io.Writer = os.Stdout
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot create %s : %s\n", *output, err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := handler.ExportZone(store, zone, w); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot export zone %s : %s\n", zone, err)
+			return 1
+		}
+	case args[0] == "ds" && flags.NArg() == 1:
+		zone := dns.Fqdn(flags.Arg(0))
+		digestType, ok := map[string]uint8{"sha256": dns.SHA256, "sha384": dns.SHA384}[strings.ToLower(*digest)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unsupported digest type %s\n", *digest)
+			return 2
+		}
+		ds, err := handler.ZoneDS(store, zone, digestType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create DS for zone %s : %s\n", zone, err)
+			return 1
+		}
+		if len(ds) == 0 {
+			fmt.Fprintf(os.Stderr, "zone %s has no ksk\n", zone)
+			return 1
+		}
+		for _, rr := range ds {
+			fmt.Println(rr.String())
+		}
+	default:
+		fmt.Fprint(os.Stderr, zoneUsage)
+		return 2
+	}
+	return 0
+}